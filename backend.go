@@ -0,0 +1,315 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errRedirectLoop = errors.New("redirect loop")
+
+type backend struct {
+	scheme    string
+	host      string
+	client    *http.Client
+	transport *http.Transport // Wrapped by client.  Nil means default.
+	breaker   *breaker        // Optional.
+}
+
+func newBackend(addr string, config *Config, tlsConfig *tls.Config) (*backend, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("address is relative: %s", u)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("HTTP address has no host: %s", u)
+		}
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("HTTP address with path is not supported: %s", u)
+		}
+
+		if config.ForceHTTP2C && u.Scheme == "https" {
+			return nil, fmt.Errorf("h2c is not supported with https address: %s", u)
+		}
+
+		var transport *http.Transport
+		if customTransport(config) || tlsConfig != nil {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+			configureTransport(transport, config)
+			if tlsConfig != nil {
+				transport.TLSClientConfig = tlsConfig.Clone()
+			}
+		}
+
+		return &backend{
+			scheme:    u.Scheme,
+			host:      u.Host,
+			client:    newClient(transport, config.Middlewares),
+			transport: transport,
+		}, nil
+
+	case "unix":
+		if u.Host != "" {
+			return nil, fmt.Errorf("unix address with host is not supported: %s", u)
+		}
+		if u.Path == "" {
+			return nil, fmt.Errorf("unix address has no path: %s", u)
+		}
+		if config.Proxy != nil {
+			return nil, fmt.Errorf("proxy is not supported with unix address: %s", u)
+		}
+		if info, err := os.Stat(u.Path); err != nil {
+			return nil, err
+		} else if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("not a unix socket: %s", u.Path)
+		}
+
+		dialer := net.Dialer{
+			Timeout:   30 * time.Second, // Same as http.DefaultTransport (Go 1.12).
+			KeepAlive: 30 * time.Second, //
+		}
+
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", u.Path)
+			},
+			DisableCompression:    true,
+			MaxIdleConns:          1,
+			MaxIdleConnsPerHost:   1,
+			IdleConnTimeout:       1,
+			ExpectContinueTimeout: time.Second, // Same as http.DefaultTransport (Go 1.12).
+		}
+		configureTransport(transport, config)
+
+		return &backend{
+			scheme:    "http",
+			host:      "localhost",
+			client:    newClient(transport, config.Middlewares),
+			transport: transport,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("address has unsupported scheme: %s", u)
+	}
+}
+
+// newClient with the middlewares applied to the transport.  Nil transport
+// means default.
+func newClient(transport *http.Transport, middlewares []func(http.RoundTripper) http.RoundTripper,
+) *http.Client {
+	if transport == nil && len(middlewares) == 0 {
+		return http.DefaultClient
+	}
+
+	var rt http.RoundTripper = http.DefaultTransport
+	if transport != nil {
+		rt = transport
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		rt = middlewares[i](rt)
+	}
+	return &http.Client{Transport: rt}
+}
+
+// customTransport checks if the configuration requires a non-default
+// transport.
+func customTransport(config *Config) bool {
+	return config.ForceHTTP2C || config.MaxIdleConns != 0 || config.MaxIdleConnsPerHost != 0 ||
+		config.IdleConnTimeout != 0 || config.ExpectContinueTimeout != 0 || config.Proxy != nil ||
+		config.ForwardClientEncoding || len(config.HostOverrides) > 0
+}
+
+func configureTransport(t *http.Transport, config *Config) {
+	if config.ForceHTTP2C {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if config.MaxIdleConns != 0 {
+		t.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.ExpectContinueTimeout != 0 {
+		t.ExpectContinueTimeout = config.ExpectContinueTimeout
+	}
+	if config.Proxy != nil {
+		t.Proxy = http.ProxyURL(config.Proxy)
+	}
+	if config.ForwardClientEncoding {
+		t.DisableCompression = true
+	}
+	if len(config.HostOverrides) > 0 {
+		t.DialContext = overrideDial(t.DialContext, config.HostOverrides)
+	}
+}
+
+// checkHostOverrides validates the addresses.
+func checkHostOverrides(overrides map[string]string) error {
+	for name, addr := range overrides {
+		if name == "" {
+			return errors.New("empty host override name")
+		}
+
+		ip := addr
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+				return fmt.Errorf("invalid host override port: %s: %q", name, addr)
+			}
+			ip = host
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid host override address: %s: %q", name, addr)
+		}
+	}
+	return nil
+}
+
+// overrideDial wraps a dial function so that the overridden host names are
+// not resolved.
+func overrideDial(dial func(context.Context, string, string) (net.Conn, error), overrides map[string]string,
+) func(context.Context, string, string) (net.Conn, error) {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+
+	addrs := make(map[string]string, len(overrides))
+	for name, addr := range overrides {
+		addrs[strings.ToLower(name)] = addr
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if override, found := addrs[strings.ToLower(host)]; found {
+				if _, _, err := net.SplitHostPort(override); err == nil {
+					addr = override
+				} else {
+					addr = net.JoinHostPort(override, port)
+				}
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// programURI of a request as seen by the program: origin-form if it was sent
+// to the same origin as the original request, or absolute if it was sent
+// elsewhere (after a redirect).
+func programURI(u, orig *url.URL) string {
+	if u.Scheme == orig.Scheme && u.Host == orig.Host {
+		return u.RequestURI()
+	}
+	return u.String()
+}
+
+// programLocation resolves a Location header value against the URL which the
+// response was received from, and presents it to the program like programURI.
+// Unparseable values are returned as is.
+func programLocation(location string, u, orig *url.URL) string {
+	ref, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	resolved := u.ResolveReference(ref)
+	s := programURI(resolved, orig)
+	if resolved.Fragment != "" {
+		s += "#" + resolved.EscapedFragment()
+	}
+	return s
+}
+
+// redirectClient returns a shallow copy of the backend's client with the
+// redirect policy.
+func (b *backend) redirectClient(maxRedirects int, external bool) *http.Client {
+	client := *b.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return http.ErrUseLastResponse
+		}
+
+		if !external && (req.URL.Scheme != via[0].URL.Scheme || req.URL.Host != via[0].URL.Host) {
+			return http.ErrUseLastResponse
+		}
+
+		for _, prev := range via {
+			if prev.URL.String() == req.URL.String() {
+				return errRedirectLoop
+			}
+		}
+
+		return nil
+	}
+	return &client
+}
+
+// dial a connection to the backend using the client's transport settings.
+// Proxy is not used.
+func (b *backend) dial(ctx context.Context) (net.Conn, error) {
+	t, ok := b.client.Transport.(*http.Transport)
+	if !ok {
+		t = b.transport // Middlewares are bypassed.
+	}
+	if t == nil {
+		t = http.DefaultTransport.(*http.Transport)
+	}
+
+	addr := b.host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "80"
+		if b.scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.scheme == "https" {
+		config := new(tls.Config)
+		if t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, _ := net.SplitHostPort(addr)
+			config.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker which is shared by all instances.
+type breaker struct {
+	threshold int
+	window    time.Duration // Zero means no limit.
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // Consecutive.
+	first     time.Time // Time of first counted failure.
+	openUntil time.Time // Zero means closed.
+	probing   bool      // Half-open request in progress.
+}
+
+func (b *breaker) sameSettings(other *breaker) bool {
+	return b.threshold == other.threshold && b.window == other.window && b.cooldown == other.cooldown
+}
+
+// allow checks if a request may be attempted.  If true is returned, done must
+// be called with the result.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// done records the result of a request.  Errors caused by the program are
+// inconclusive: cancellation, request body errors, and exceeding a deadline
+// which was chosen by the program (indicated by programDeadline).
+func (b *breaker) done(now time.Time, err error, programDeadline bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.probing
+	b.probing = false
+
+	switch {
+	case err == nil:
+		b.failures = 0
+		b.openUntil = time.Time{}
+
+	case errors.Is(err, context.Canceled), errors.Is(err, errOverloaded), errors.Is(err, errBudgetExhausted),
+		errors.Is(err, errRequestBodyTooLarge), errors.Is(err, errUploadAborted),
+		programDeadline && errors.Is(err, context.DeadlineExceeded):
+		// Inconclusive.
+
+	case probe:
+		b.openUntil = now.Add(b.cooldown)
+
+	default:
+		if b.failures == 0 || (b.window > 0 && now.Sub(b.first) > b.window) {
+			b.failures = 0
+			b.first = now
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.failures = 0
+			b.openUntil = now.Add(b.cooldown)
+		}
+	}
+}
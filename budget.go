@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+var errBudgetExhausted = errors.New("localhost: request budget exhausted")
+
+// requestBudget limits the number of backend requests made by an instance
+// during its lifetime.
+type requestBudget struct {
+	limit int32
+	used  int32 // Atomic.
+}
+
+// take one request from the budget.
+func (b *requestBudget) take() error {
+	for {
+		n := atomic.LoadInt32(&b.used)
+		if n >= b.limit {
+			return errBudgetExhausted
+		}
+		if atomic.CompareAndSwapInt32(&b.used, n, n+1) {
+			return nil
+		}
+	}
+}
+
+type budgetKey struct{}
+
+// withBudget returns a context which carries an instance's budget to the
+// places where backend requests are made.
+func withBudget(ctx context.Context, b *requestBudget) context.Context {
+	if b == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// takeBudget takes one request from the context's budget, if any.
+func takeBudget(ctx context.Context) error {
+	if b, ok := ctx.Value(budgetKey{}).(*requestBudget); ok {
+		return b.take()
+	}
+	return nil
+}
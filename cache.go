@@ -0,0 +1,281 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// safeMethods don't invalidate cached responses.
+var safeMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodOptions: {},
+	http.MethodTrace:   {},
+}
+
+// Requests with these headers bypass the cache.
+var uncachedRequestHeaders = []string{
+	"Cookie",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Range",
+}
+
+// responseCache is an LRU cache of GET responses which is shared by all
+// instances.
+type responseCache struct {
+	size           int
+	respectHeaders bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Most recently used at front.
+}
+
+type cacheEntry struct {
+	key     string
+	res     http.Response // Without body.
+	body    []byte
+	expires time.Time // Zero means no expiration.
+}
+
+func newResponseCache(size int, respectHeaders bool) *responseCache {
+	return &responseCache{
+		size:           size,
+		respectHeaders: respectHeaders,
+		entries:        make(map[string]*list.Element),
+	}
+}
+
+// cacheKey identifies a resource of a backend.
+func cacheKey(backendName string, req *http.Request) string {
+	return backendName + "\x00" + req.Host + "\x00" + req.URL.String()
+}
+
+// cacheableRequest checks if a GET response may be served from or stored in
+// the cache.  Requests which carry program-specific state are not.
+func cacheableRequest(req *http.Request, jar *cookieJar, serviceAuth bool) bool {
+	if req.Method != http.MethodGet || req.Body != nil {
+		return false
+	}
+	if !serviceAuth && req.Header.Get("Authorization") != "" {
+		return false
+	}
+	for _, key := range uncachedRequestHeaders {
+		if req.Header.Get(key) != "" {
+			return false
+		}
+	}
+	if jar != nil && len(jar.Cookies(req.URL)) > 0 {
+		return false
+	}
+	return true
+}
+
+// revalidationRequested checks if the program doesn't want a cached response.
+func revalidationRequested(req *http.Request) bool {
+	_, noCache := cacheControl(req.Header)["no-cache"]
+	return noCache || req.Header.Get("Pragma") == "no-cache"
+}
+
+// get a cached response, or nil.  A stale response is returned only if it
+// has an ETag, so that it can be revalidated; it is not fresh.
+func (c *responseCache) get(key string, now time.Time) (res *http.Response, fresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		return
+	}
+
+	e := elem.Value.(*cacheEntry)
+	fresh = e.expires.IsZero() || now.Before(e.expires)
+	if !fresh && e.res.Header.Get("ETag") == "" {
+		c.remove(elem)
+		return
+	}
+	c.lru.MoveToFront(elem)
+
+	return e.response(), fresh
+}
+
+// revalidated updates the freshness of a stale response based on a 304
+// response.  The updated response is returned; it's removed from the cache if
+// it may no longer be cached.
+func (c *responseCache) revalidated(key string, stale, notModified *http.Response, now time.Time,
+) *http.Response {
+	etag := stale.Header.Get("ETag")
+
+	for k, values := range notModified.Header {
+		if k != "Content-Length" {
+			stale.Header[k] = values
+		}
+	}
+	expires, ok := c.freshness(stale, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		return stale
+	}
+
+	e := elem.Value.(*cacheEntry)
+	if e.res.Header.Get("ETag") != etag {
+		return stale // Replaced meanwhile.
+	}
+	if !ok {
+		c.remove(elem)
+		return stale
+	}
+
+	e.res.Header = stale.Header.Clone()
+	e.expires = expires
+	c.lru.MoveToFront(elem)
+	return stale
+}
+
+// put the response into the cache if it's cacheable and its body is not
+// larger than maxSize.  The body may be read, so the returned response must be
+// used instead.
+func (c *responseCache) put(key string, res *http.Response, maxSize int64, now time.Time) *http.Response {
+	expires, ok := c.freshness(res, now)
+	if !ok || res.ContentLength < 0 || res.ContentLength > maxSize {
+		return res
+	}
+
+	body := make([]byte, res.ContentLength)
+	n, err := io.ReadFull(res.Body, body)
+	if err != nil {
+		// Body reader reports the error again.
+		res.Body = readCloser{io.MultiReader(bytes.NewReader(body[:n]), res.Body), res.Body}
+		return res
+	}
+	res.Body = readCloser{bytes.NewReader(body), res.Body}
+
+	e := &cacheEntry{
+		key:     key,
+		res:     *res,
+		body:    body,
+		expires: expires,
+	}
+	e.res.Header = res.Header.Clone()
+	e.res.Trailer = nil
+	e.res.Body = nil
+	e.res.Request = &http.Request{URL: res.Request.URL, Response: res.Request.Response} // For final URI and redirects.
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem := c.entries[key]; elem != nil {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return res
+}
+
+// response with a copy of the header.
+func (e *cacheEntry) response() *http.Response {
+	res := e.res
+	res.Header = e.res.Header.Clone()
+	res.Body = ioutil.NopCloser(bytes.NewReader(e.body))
+	return &res
+}
+
+func (c *responseCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem := c.entries[key]; elem != nil {
+		c.remove(elem)
+	}
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	delete(c.entries, c.lru.Remove(elem).(*cacheEntry).key)
+}
+
+// freshness determines if the response may be cached, and until when.
+func (c *responseCache) freshness(res *http.Response, now time.Time) (expires time.Time, ok bool) {
+	if res.StatusCode != http.StatusOK || res.Header.Get("Set-Cookie") != "" || res.Header.Get("Vary") != "" {
+		return
+	}
+
+	// Responses which must not be shared are never cached.
+	directives := cacheControl(res.Header)
+	for _, name := range []string{"no-store", "private"} {
+		if _, found := directives[name]; found {
+			return
+		}
+	}
+
+	if !c.respectHeaders {
+		ok = true
+		return
+	}
+
+	if _, found := directives["no-cache"]; found {
+		return
+	}
+
+	var age time.Duration
+	if n, err := strconv.ParseUint(res.Header.Get("Age"), 10, 32); err == nil {
+		age = time.Duration(n) * time.Second
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, found := directives[name]; found {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return
+			}
+			expires = now.Add(time.Duration(n)*time.Second - age)
+			ok = expires.After(now)
+			return
+		}
+	}
+
+	if t, err := http.ParseTime(res.Header.Get("Expires")); err == nil {
+		expires = t
+		ok = expires.After(now)
+	}
+	return
+}
+
+// cacheControl directives with lower-case names.  Values are unquoted.
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, s := range strings.Split(line, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			name, value := s, ""
+			if i := strings.IndexByte(s, '='); i >= 0 {
+				name, value = s[:i], strings.Trim(s[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+var errChecksumMismatch = errors.New("localhost: response body checksum mismatch")
+
+// checksum of response body.  SHA-256 is always computed; MD5 only if the
+// backend specified it.
+type checksum struct {
+	sha256       hash.Hash
+	md5          hash.Hash
+	expectSHA256 []byte
+	expectMD5    []byte
+}
+
+// newChecksum with expectations from Digest (RFC 3230) and Content-MD5
+// headers.  Malformed values are ignored.
+func newChecksum(h http.Header) *checksum {
+	c := &checksum{sha256: sha256.New()}
+
+	for _, field := range h["Digest"] {
+		for _, item := range strings.Split(field, ",") {
+			i := strings.IndexByte(item, '=')
+			if i < 0 {
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(item[i+1:]))
+			if err != nil {
+				continue
+			}
+
+			switch strings.ToLower(strings.TrimSpace(item[:i])) {
+			case "sha-256":
+				c.expectSHA256 = value
+			case "md5":
+				c.expectMD5 = value
+			}
+		}
+	}
+
+	if c.expectMD5 == nil {
+		if value, err := base64.StdEncoding.DecodeString(h.Get("Content-Md5")); err == nil && len(value) > 0 {
+			c.expectMD5 = value
+		}
+	}
+	if c.expectMD5 != nil {
+		c.md5 = md5.New()
+	}
+
+	return c
+}
+
+func (c *checksum) Write(b []byte) (int, error) {
+	c.sha256.Write(b)
+	if c.md5 != nil {
+		c.md5.Write(b)
+	}
+	return len(b), nil
+}
+
+func (c *checksum) sum() []byte {
+	return c.sha256.Sum(nil)
+}
+
+// verify the complete body.
+func (c *checksum) verify() error {
+	if c.expectSHA256 != nil && !bytes.Equal(c.sha256.Sum(nil), c.expectSHA256) {
+		return errChecksumMismatch
+	}
+	if c.md5 != nil && !bytes.Equal(c.md5.Sum(nil), c.expectMD5) {
+		return errChecksumMismatch
+	}
+	return nil
+}
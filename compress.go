@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// gzipBytes compresses an inline request body.
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// gzipStream compresses a streamed request body on the fly.  The returned
+// reader must be closed to terminate the compressor.
+func gzipStream(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	return &gzipReader{
+		PipeReader: pr,
+		start: func() {
+			go func() {
+				w := gzip.NewWriter(pw)
+				_, err := io.Copy(w, r)
+				if err == nil {
+					err = w.Close()
+				}
+				pw.CloseWithError(err)
+			}()
+		},
+	}
+}
+
+// prefetchBody reads up to n bytes of a streamed request body.  The body is
+// closed if the context is done first.  EOF is reported if the whole body was
+// read.
+func prefetchBody(ctx context.Context, body io.ReadCloser, n int) (prefix []byte, eof bool, err error) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		var m int
+		prefix = make([]byte, n)
+		m, err = io.ReadFull(body, prefix)
+		prefix = prefix[:m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+			err = nil
+		}
+	}()
+
+	select {
+	case <-done:
+		return
+
+	case <-ctx.Done():
+		body.Close()
+		<-done
+		return nil, false, ctx.Err()
+	}
+}
+
+// gzipReader starts compressing on first read, so that the source is not
+// read before the body is needed.
+type gzipReader struct {
+	*io.PipeReader
+	start func()
+	once  sync.Once
+}
+
+func (r *gzipReader) Read(b []byte) (int, error) {
+	r.once.Do(r.start)
+	return r.PipeReader.Read(b)
+}
+
+// decompressResponse replaces the body of a gzip or deflate encoded response
+// with a decompressing reader, and removes the encoding from the headers.
+// Other responses are left alone.
+func decompressResponse(res *http.Response) error {
+	var (
+		r   io.Reader
+		err error
+	)
+
+	switch res.Header.Get("Content-Encoding") {
+	case "gzip", "x-gzip":
+		if len(res.Header["Content-Encoding"]) != 1 {
+			return nil
+		}
+		r, err = gzip.NewReader(res.Body)
+
+	case "deflate":
+		if len(res.Header["Content-Encoding"]) != 1 {
+			return nil
+		}
+		r, err = zlib.NewReader(res.Body)
+
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	res.Body = readCloser{r, res.Body}
+	res.ContentLength = -1
+	res.Uncompressed = true
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	return nil
+}
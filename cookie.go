@@ -0,0 +1,176 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cookieJar of an instance.  Cookies are scoped by backend host; the Domain
+// attribute is ignored.  The contents can be serialized into a snapshot.
+type cookieJar struct {
+	mu      sync.Mutex
+	cookies map[string][]jarCookie // Keyed by host.
+}
+
+type jarCookie struct {
+	Name    string
+	Value   string
+	Path    string
+	Expires int64 `json:",omitempty"` // Unix time.  Zero means session cookie.
+	Secure  bool  `json:",omitempty"`
+}
+
+func (c *jarCookie) expired(now time.Time) bool {
+	return c.Expires != 0 && c.Expires <= now.Unix()
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	list := j.cookies[u.Host]
+
+	for _, c := range cookies {
+		jc := jarCookie{
+			Name:   c.Name,
+			Value:  c.Value,
+			Path:   c.Path,
+			Secure: c.Secure,
+		}
+		if !strings.HasPrefix(jc.Path, "/") {
+			jc.Path = defaultCookiePath(u.Path)
+		}
+
+		remove := false
+		switch {
+		case c.MaxAge < 0:
+			remove = true
+
+		case c.MaxAge > 0:
+			jc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second).Unix()
+
+		case !c.Expires.IsZero():
+			jc.Expires = c.Expires.Unix()
+			remove = jc.expired(now)
+		}
+
+		for i := range list {
+			if list[i].Name == jc.Name && list[i].Path == jc.Path {
+				list = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		if !remove {
+			list = append(list, jc)
+		}
+	}
+
+	if len(list) == 0 {
+		delete(j.cookies, u.Host)
+		return
+	}
+	if j.cookies == nil {
+		j.cookies = make(map[string][]jarCookie)
+	}
+	j.cookies[u.Host] = list
+}
+
+func (j *cookieJar) Cookies(u *url.URL) (cookies []*http.Cookie) {
+	now := time.Now()
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var matches []jarCookie
+	for _, c := range j.cookies[u.Host] {
+		if !c.expired(now) && (!c.Secure || u.Scheme == "https") && cookiePathMatch(path, c.Path) {
+			matches = append(matches, c)
+		}
+	}
+
+	// Cookies with longer paths are listed first (RFC 6265, section 5.4).
+	sort.SliceStable(matches, func(i, k int) bool {
+		return len(matches[i].Path) > len(matches[k].Path)
+	})
+
+	for _, c := range matches {
+		cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return
+}
+
+func (j *cookieJar) clear() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.cookies = nil
+}
+
+// marshal returns nil if there are no unexpired cookies.
+func (j *cookieJar) marshal() ([]byte, error) {
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	cookies := make(map[string][]jarCookie)
+	for host, list := range j.cookies {
+		for _, c := range list {
+			if !c.expired(now) {
+				cookies[host] = append(cookies[host], c)
+			}
+		}
+	}
+	if len(cookies) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(cookies)
+}
+
+func (j *cookieJar) unmarshal(data []byte) error {
+	var cookies map[string][]jarCookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.cookies = cookies
+	return nil
+}
+
+// defaultCookiePath is the directory of the request path (RFC 6265, section
+// 5.1.4).
+func defaultCookiePath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// cookiePathMatch as specified in RFC 6265, section 5.1.4.
+func cookiePathMatch(path, cookiePath string) bool {
+	if !strings.HasPrefix(path, cookiePath) {
+		return false
+	}
+	return len(path) == len(cookiePath) || strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/'
+}
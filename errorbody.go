@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxErrorMessageSize limits the length of messages extracted from error
+// bodies, so that they can be accounted for in the response packet.
+const maxErrorMessageSize = 512
+
+// Fields which are tried if Config.ErrorMessagePath is not specified.
+var defaultErrorMessagePaths = [][]string{
+	{"message"},
+	{"error"},
+	{"error", "message"},
+}
+
+// parseErrorMessagePath splits a dot-separated path.
+func parseErrorMessagePath(s string) ([]string, bool) {
+	path := strings.Split(s, ".")
+	for _, name := range path {
+		if name == "" {
+			return nil, false
+		}
+	}
+	return path, true
+}
+
+// isJSON media type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// jsonErrorMessage finds the first non-empty string at one of the paths of a JSON
+// object.  Empty string is returned if there is none, or if the body is not a
+// JSON object.  The string is truncated to maxErrorMessageSize bytes.
+func jsonErrorMessage(body []byte, paths [][]string) string {
+	var object map[string]interface{}
+	if json.Unmarshal(body, &object) != nil {
+		return ""
+	}
+
+	for _, path := range paths {
+		var value interface{} = object
+		for _, name := range path {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = m[name]
+		}
+		if s, ok := value.(string); ok && s != "" {
+			return truncateString(s, maxErrorMessageSize)
+		}
+	}
+	return ""
+}
+
+// truncateString to at most n bytes without splitting a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bufio"
+	"io"
+	"mime"
+)
+
+func isEventStream(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	return err == nil && t == "text/event-stream"
+}
+
+// eventReader returns data up to the end of a server-sent event, so that
+// each data packet ends at an event boundary unless the event is larger than
+// the packet.
+type eventReader struct {
+	r       *bufio.Reader
+	pending []byte
+	err     error
+}
+
+func newEventReader(r io.Reader) *eventReader {
+	return &eventReader{r: bufio.NewReader(r)}
+}
+
+func (er *eventReader) Read(b []byte) (n int, err error) {
+	for len(er.pending) < len(b) && er.err == nil {
+		var line []byte
+		line, er.err = er.r.ReadSlice('\n')
+		if er.err == bufio.ErrBufferFull {
+			er.err = nil
+		}
+		er.pending = append(er.pending, line...)
+
+		// Blank line terminates an event.
+		if string(line) == "\n" || string(line) == "\r\n" {
+			break
+		}
+	}
+
+	n = copy(b, er.pending)
+	er.pending = er.pending[n:]
+	if len(er.pending) == 0 {
+		er.pending = nil
+		err = er.err
+	}
+	return
+}
@@ -12,10 +12,12 @@ import (
 
 const extName = "localhost"
 
-var extConfig Config
+var extConfig = Config{
+	InlineBodyLimit: DefaultInlineBodyLimit,
+}
 
 var Ext = service.Extend(extName, &extConfig, func(ctx context.Context, r *service.Registry) error {
-	if extConfig.Addr == "" {
+	if extConfig.Addr == "" && len(extConfig.Backends) == 0 {
 		return nil
 	}
 
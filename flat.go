@@ -4,4 +4,81 @@
 
 package localhost
 
+import (
+	"errors"
+	"fmt"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
 //go:generate flatc --go --go-namespace flat localhost.fbs
+
+var errStreamedResponseBody = errors.New("localhost: response body is streamed")
+
+// BuildRequestCall creates a call packet for the Request function.  Content
+// type and body are optional.
+func BuildRequestCall(code packet.Code, method, uri, contentType string, body []byte) packet.Buf {
+	b := flatbuffers.NewBuilder(0)
+	methodOffset := b.CreateString(method)
+	uriOffset := b.CreateString(uri)
+	var contentTypeOffset, bodyOffset flatbuffers.UOffsetT
+	if contentType != "" {
+		contentTypeOffset = b.CreateString(contentType)
+	}
+	if len(body) > 0 {
+		bodyOffset = b.CreateByteVector(body)
+	}
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, methodOffset)
+	flat.RequestAddUri(b, uriOffset)
+	if contentTypeOffset != 0 {
+		flat.RequestAddContentType(b, contentTypeOffset)
+	}
+	if bodyOffset != 0 {
+		flat.RequestAddBody(b, bodyOffset)
+	}
+	function := flat.RequestEnd(b)
+	flat.CallStart(b)
+	flat.CallAddFunctionType(b, flat.FunctionRequest)
+	flat.CallAddFunction(b, function)
+	b.Finish(flat.CallEnd(b))
+
+	p := packet.MakeCall(code, len(b.FinishedBytes()))
+	copy(p.Content(), b.FinishedBytes())
+	return p
+}
+
+// ParseResponse decodes a call response packet.  An error is returned if the
+// packet is malformed, if the response has an error message, or if the body is
+// streamed; status and content type are returned in the latter cases.
+func ParseResponse(p packet.Buf) (status int, contentType string, body []byte, err error) {
+	if len(p) <= packet.HeaderSize || p.Domain() != packet.DomainCall {
+		err = errors.New("localhost: not a call response packet")
+		return
+	}
+
+	defer func() {
+		if x := recover(); x != nil {
+			status, contentType, body = 0, "", nil
+			err = fmt.Errorf("localhost: malformed response: %v", x)
+		}
+	}()
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	status = int(r.StatusCode())
+	contentType = string(r.ContentType())
+
+	switch {
+	case len(r.ErrorMessage()) > 0:
+		err = errors.New(string(r.ErrorMessage()))
+
+	case r.BodyStreamId() >= 0:
+		err = errStreamedResponseBody
+
+	default:
+		body = r.BodyBytes()
+	}
+	return
+}
@@ -6,10 +6,26 @@ type Function = byte
 const (
 	FunctionNONE Function = 0
 	FunctionRequest Function = 1
+	FunctionGetText Function = 2
+	FunctionClearCookies Function = 3
+	FunctionFormPost Function = 4
+	FunctionMultipart Function = 5
+	FunctionAbortRequest Function = 6
+	FunctionWebSocket Function = 7
+	FunctionConnect Function = 8
+	FunctionRawRequest Function = 9
 )
 
 var EnumNamesFunction = map[Function]string{
 	FunctionNONE:"NONE",
 	FunctionRequest:"Request",
+	FunctionGetText:"GetText",
+	FunctionClearCookies:"ClearCookies",
+	FunctionFormPost:"FormPost",
+	FunctionMultipart:"Multipart",
+	FunctionAbortRequest:"AbortRequest",
+	FunctionWebSocket:"WebSocket",
+	FunctionConnect:"Connect",
+	FunctionRawRequest:"RawRequest",
 }
 
@@ -84,8 +84,140 @@ func (rcv *Request) MutateBody(j int, n byte) bool {
 	return false
 }
 
+func (rcv *Request) BodyStreamId() int32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(12))
+	if o != 0 {
+		return rcv._tab.GetInt32(o + rcv._tab.Pos)
+	}
+	return -1
+}
+
+func (rcv *Request) MutateBodyStreamId(n int32) bool {
+	return rcv._tab.MutateInt32Slot(12, n)
+}
+
+func (rcv *Request) ContentLength() int64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(14))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *Request) MutateContentLength(n int64) bool {
+	return rcv._tab.MutateInt64Slot(14, n)
+}
+
+func (rcv *Request) Headers(obj *Header, j int) bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		x := rcv._tab.Vector(o)
+		x += flatbuffers.UOffsetT(j) * 4
+		x = rcv._tab.Indirect(x)
+		obj.Init(rcv._tab.Bytes, x)
+		return true
+	}
+	return false
+}
+
+func (rcv *Request) HeadersLength() int {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		return rcv._tab.VectorLen(o)
+	}
+	return 0
+}
+
+func (rcv *Request) Backend() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(18))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Request) CompressBody() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(20))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Request) MutateCompressBody(n bool) bool {
+	return rcv._tab.MutateBoolSlot(20, n)
+}
+
+func (rcv *Request) TimeoutMs() uint32 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(22))
+	if o != 0 {
+		return rcv._tab.GetUint32(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *Request) MutateTimeoutMs(n uint32) bool {
+	return rcv._tab.MutateUint32Slot(22, n)
+}
+
+func (rcv *Request) Scheme() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(24))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Request) ExpectContinue() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(26))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Request) MutateExpectContinue(n bool) bool {
+	return rcv._tab.MutateBoolSlot(26, n)
+}
+
+func (rcv *Request) IdempotencyKey() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(28))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Request) AutoIdempotencyKey() bool {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(30))
+	if o != 0 {
+		return rcv._tab.GetBool(o + rcv._tab.Pos)
+	}
+	return false
+}
+
+func (rcv *Request) MutateAutoIdempotencyKey(n bool) bool {
+	return rcv._tab.MutateBoolSlot(30, n)
+}
+
+func (rcv *Request) RequestId() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(32))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
+func (rcv *Request) HttpVersion() []byte {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(34))
+	if o != 0 {
+		return rcv._tab.ByteVector(o + rcv._tab.Pos)
+	}
+	return nil
+}
+
 func RequestStart(builder *flatbuffers.Builder) {
-	builder.StartObject(4)
+	builder.StartObject(16)
 }
 func RequestAddMethod(builder *flatbuffers.Builder, method flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(method), 0)
@@ -102,6 +234,45 @@ func RequestAddBody(builder *flatbuffers.Builder, body flatbuffers.UOffsetT) {
 func RequestStartBodyVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(1, numElems, 1)
 }
+func RequestAddBodyStreamId(builder *flatbuffers.Builder, bodyStreamId int32) {
+	builder.PrependInt32Slot(4, bodyStreamId, -1)
+}
+func RequestAddContentLength(builder *flatbuffers.Builder, contentLength int64) {
+	builder.PrependInt64Slot(5, contentLength, 0)
+}
+func RequestAddHeaders(builder *flatbuffers.Builder, headers flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(6, flatbuffers.UOffsetT(headers), 0)
+}
+func RequestStartHeadersVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
+	return builder.StartVector(4, numElems, 4)
+}
+func RequestAddBackend(builder *flatbuffers.Builder, backend flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(7, flatbuffers.UOffsetT(backend), 0)
+}
+func RequestAddCompressBody(builder *flatbuffers.Builder, compressBody bool) {
+	builder.PrependBoolSlot(8, compressBody, false)
+}
+func RequestAddTimeoutMs(builder *flatbuffers.Builder, timeoutMs uint32) {
+	builder.PrependUint32Slot(9, timeoutMs, 0)
+}
+func RequestAddScheme(builder *flatbuffers.Builder, scheme flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(10, flatbuffers.UOffsetT(scheme), 0)
+}
+func RequestAddExpectContinue(builder *flatbuffers.Builder, expectContinue bool) {
+	builder.PrependBoolSlot(11, expectContinue, false)
+}
+func RequestAddIdempotencyKey(builder *flatbuffers.Builder, idempotencyKey flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(12, flatbuffers.UOffsetT(idempotencyKey), 0)
+}
+func RequestAddAutoIdempotencyKey(builder *flatbuffers.Builder, autoIdempotencyKey bool) {
+	builder.PrependBoolSlot(13, autoIdempotencyKey, false)
+}
+func RequestAddRequestId(builder *flatbuffers.Builder, requestId flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(14, flatbuffers.UOffsetT(requestId), 0)
+}
+func RequestAddHttpVersion(builder *flatbuffers.Builder, httpVersion flatbuffers.UOffsetT) {
+	builder.PrependUOffsetTSlot(15, flatbuffers.UOffsetT(httpVersion), 0)
+}
 func RequestEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
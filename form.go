@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+const formContentType = "application/x-www-form-urlencoded"
+
+// handleFormPost is implemented in terms of handleRequest.
+func handleFormPost(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	jar *cookieJar, call flat.FormPost,
+) ([]byte, *stream) {
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodPost)
+	uri := b.CreateByteString(call.Uri())
+	backend := b.CreateByteString(call.Backend())
+	contentType := b.CreateString(formContentType)
+	body := b.CreateByteString([]byte(encodeForm(call)))
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBackend(b, backend)
+	flat.RequestAddContentType(b, contentType)
+	flat.RequestAddBody(b, body)
+	b.Finish(flat.RequestEnd(b))
+
+	return handleRequest(ctx, local, config, streams, jar, *flat.GetRootAsRequest(b.FinishedBytes(), 0), nil)
+}
+
+// encodeForm fields in order.  (url.Values would sort them by key.)
+func encodeForm(call flat.FormPost) string {
+	var (
+		buf   strings.Builder
+		field flat.FormField
+	)
+	for i := 0; i < call.FieldsLength(); i++ {
+		call.Fields(&field, i)
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(url.QueryEscape(string(field.Key())))
+		buf.WriteByte('=')
+		buf.WriteString(url.QueryEscape(string(field.Value())))
+	}
+	return buf.String()
+}
@@ -1,8 +1,9 @@
 module gate.computer/localhost
 
-go 1.11
+go 1.24
 
 require (
 	gate.computer/gate v0.0.0-20210220013651-0b4ac1803fb7
 	github.com/google/flatbuffers v1.12.0
+	golang.org/x/text v0.3.3
 )
@@ -7,9 +7,21 @@ package localhost
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"gate.computer/gate/packet"
 	"gate.computer/localhost/flat"
@@ -18,103 +30,1096 @@ import (
 
 // Any encoded flat.Response (just the table) must not be larger than this,
 // excluding fields which are stored out of line.
-const maxFlatResponseSize = 100
+const maxFlatResponseSize = 160
+
+// Upper bound for the encoding overhead of a string or a vector which is stored
+// out of line.
+const flatVectorOverhead = 8
 
 type handled struct {
-	req packet.Buf
-	res packet.Buf
+	req  packet.Buf // Nil for stream data.
+	res  packet.Buf
+	sent chan<- struct{} // Closed when res has been sent (or stopped sending).  Optional.
 }
 
-func handle(ctx context.Context, local *Localhost, config packet.Service, req packet.Buf) handled {
+func handle(ctx context.Context, local *Localhost, config packet.Service, streams *streams, jar *cookieJar,
+	req packet.Buf,
+) (h handled, s *stream) {
 	var b []byte
 
 	tab := new(flatbuffers.Table)
 	call := flat.GetRootAsCall(req, packet.HeaderSize)
-	if call.Function(tab) && call.FunctionType() == flat.FunctionRequest {
-		var f flat.Request
-		f.Init(tab.Bytes, tab.Pos)
-		b = handleRequest(ctx, local, config, f)
+	if !call.Function(tab) {
+		b = buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusBadRequest, "malformed call")
+	} else {
+		switch call.FunctionType() {
+		case flat.FunctionRequest:
+			var f flat.Request
+			f.Init(tab.Bytes, tab.Pos)
+
+			var body requestBody
+			if id := f.BodyStreamId(); id >= 0 {
+				if u := streams.upload(id, req); u != nil {
+					stop := u.abortOnCancel(ctx)
+					defer func() {
+						stop()
+						u.Close()
+						streams.unregisterUpload(u)
+					}()
+					body = u
+				}
+			}
+
+			b, s = handleRequest(ctx, local, config, streams, jar, f, body)
+
+		case flat.FunctionGetText:
+			var f flat.GetText
+			f.Init(tab.Bytes, tab.Pos)
+
+			b = handleGetText(ctx, local, config, streams, jar, f)
+
+		case flat.FunctionFormPost:
+			var f flat.FormPost
+			f.Init(tab.Bytes, tab.Pos)
+
+			b, s = handleFormPost(ctx, local, config, streams, jar, f)
+
+		case flat.FunctionMultipart:
+			var f flat.Multipart
+			f.Init(tab.Bytes, tab.Pos)
+
+			uploads := make(map[int32]*upload)
+			for _, id := range multipartStreamIDs(f) {
+				if u := streams.upload(id, req); u != nil {
+					stop := u.abortOnCancel(ctx)
+					defer func() {
+						stop()
+						u.Close()
+						streams.unregisterUpload(u)
+					}()
+					uploads[id] = u
+				}
+			}
+
+			b, s = handleMultipart(ctx, local, config, streams, jar, f, uploads)
+
+		case flat.FunctionWebSocket:
+			var f flat.WebSocket
+			f.Init(tab.Bytes, tab.Pos)
+
+			b, s = handleWebSocket(ctx, local, config, streams, jar, f)
+
+		case flat.FunctionConnect:
+			var f flat.Connect
+			f.Init(tab.Bytes, tab.Pos)
+
+			b, s = handleConnect(ctx, local, config, streams, f)
+
+		case flat.FunctionRawRequest:
+			var f flat.RawRequest
+			f.Init(tab.Bytes, tab.Pos)
+
+			b, s = handleRawRequest(ctx, local, config, streams, f)
+
+		case flat.FunctionAbortRequest:
+			var f flat.AbortRequest
+			f.Init(tab.Bytes, tab.Pos)
+
+			if streams.abort(f.StreamId()) {
+				b = buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusNoContent, "")
+			} else {
+				b = buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusNotFound, "unknown stream")
+			}
+
+		case flat.FunctionClearCookies:
+			if jar == nil {
+				b = buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusNotImplemented, "cookies not enabled")
+			} else {
+				jar.clear()
+				b = buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusNoContent, "")
+			}
+		}
+	}
+	if b == nil {
+		b = buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusNotImplemented, "unsupported function")
 	}
 
+	h = handled{req: req, res: makeCallResponse(config, b)}
+	return
+}
+
+func makeCallResponse(config packet.Service, b []byte) packet.Buf {
 	res := packet.Make(config.Code, packet.DomainCall, packet.HeaderSize+len(b))
 	copy(res.Content(), b)
+	return res
+}
+
+// requestBodyStreamIDs of a call with streamed body or body parts.
+func requestBodyStreamIDs(req packet.Buf) []int32 {
+	tab := new(flatbuffers.Table)
+	call := flat.GetRootAsCall(req, packet.HeaderSize)
+	if !call.Function(tab) {
+		return nil
+	}
+
+	switch call.FunctionType() {
+	case flat.FunctionRequest:
+		var f flat.Request
+		f.Init(tab.Bytes, tab.Pos)
+		if id := f.BodyStreamId(); id >= 0 {
+			return []int32{id}
+		}
+
+	case flat.FunctionMultipart:
+		var f flat.Multipart
+		f.Init(tab.Bytes, tab.Pos)
+		return multipartStreamIDs(f)
+	}
 
-	return handled{req, res}
+	return nil
 }
 
-func handleRequest(ctx context.Context, local *Localhost, config packet.Service, call flat.Request) []byte {
+// restartableRequest checks if the call is a GET or HEAD request without a
+// streamed body.
+func restartableRequest(req packet.Buf) bool {
+	tab := new(flatbuffers.Table)
+	call := flat.GetRootAsCall(req, packet.HeaderSize)
+	if !call.Function(tab) {
+		return false
+	}
+
+	switch call.FunctionType() {
+	case flat.FunctionRequest:
+		var f flat.Request
+		f.Init(tab.Bytes, tab.Pos)
+		switch string(f.Method()) {
+		case http.MethodGet, http.MethodHead:
+			return f.BodyStreamId() < 0
+		}
+
+	case flat.FunctionGetText:
+		return true
+	}
+
+	return false
+}
+
+// requestTimeout is the smaller of the configured and requested timeouts.
+// Zero means no timeout.
+func requestTimeout(local *Localhost, call flat.Request) time.Duration {
+	timeout := local.requestTimeout
+	if ms := call.TimeoutMs(); ms > 0 {
+		if d := time.Duration(ms) * time.Millisecond; timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	return timeout
+}
+
+// programTimeout reports if the timeout requested by the program is shorter
+// than the configured timeout.
+func programTimeout(local *Localhost, call flat.Request) bool {
+	ms := call.TimeoutMs()
+	return ms > 0 && (local.requestTimeout == 0 || time.Duration(ms)*time.Millisecond < local.requestTimeout)
+}
+
+// restartableDeadline is the absolute deadline of a restartable request which
+// is handled starting at the given time.  Zero time means no deadline.
+func restartableDeadline(local *Localhost, req packet.Buf, now time.Time) time.Time {
+	timeout := local.requestTimeout
+
+	tab := new(flatbuffers.Table)
+	call := flat.GetRootAsCall(req, packet.HeaderSize)
+	if call.Function(tab) && call.FunctionType() == flat.FunctionRequest {
+		var f flat.Request
+		f.Init(tab.Bytes, tab.Pos)
+		timeout = requestTimeout(local, f)
+	}
+
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return now.Add(timeout)
+}
+
+// handleRequest returns a stream if the response body exceeded the inline
+// limit or didn't fit in the response packet.  The caller takes ownership of
+// the stream.  Request body is read from the upload if the call specifies a
+// body stream.
+func handleRequest(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	jar *cookieJar, call flat.Request, u requestBody,
+) (_ []byte, st *stream) {
 	b := flatbuffers.NewBuilder(0)
 
+	// Deadline of a restarted request may have passed during suspension.
+	if ctx.Err() == context.DeadlineExceeded {
+		return buildErrorResponse(b, http.StatusGatewayTimeout, "timeout"), nil
+	}
+
 	req := http.Request{
 		Method: string(call.Method()),
 	}
+	if !isToken(req.Method) {
+		return buildErrorResponse(b, http.StatusBadRequest, "invalid method"), nil
+	}
+	if _, ok := local.methods[req.Method]; !ok {
+		return buildErrorResponse(b, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
 
-	callURL, err := url.Parse(string(call.Uri()))
-	if err != nil || callURL.IsAbs() || callURL.Host != callURL.Hostname() {
-		return buildErrorResponse(b, http.StatusBadRequest)
+	backend, errRes := resolveTarget(b, local, &req, call.Backend(), call.Uri())
+	if errRes != nil {
+		return errRes, nil
 	}
-	req.URL = &url.URL{
-		Scheme:   local.scheme,
-		Host:     local.host,
-		Path:     callURL.Path,
-		RawQuery: callURL.RawQuery,
+	if s := string(call.Scheme()); s != "" && s != req.URL.Scheme {
+		if _, ok := local.allowedSchemes[s]; !ok {
+			return buildErrorResponse(b, http.StatusBadRequest, "scheme not allowed"), nil
+		}
+		req.URL.Scheme = s
+	}
+
+	http10 := false
+	switch v := string(call.HttpVersion()); v {
+	case "", "1.1":
+	case "1.0":
+		if call.ExpectContinue() {
+			return buildErrorResponse(b, http.StatusBadRequest, "expect continue requires HTTP/1.1"), nil
+		}
+		http10 = true
+	default:
+		return buildErrorResponse(b, http.StatusBadRequest, "unsupported HTTP version"), nil
+	}
+
+	if req.Method == http.MethodOptions && local.answerOptions {
+		return buildOptionsResponse(b, local.allow), nil
 	}
-	req.Host = callURL.Hostname()
 
+	if local.maxReqHeaders > 0 && call.HeadersLength() > local.maxReqHeaders {
+		return buildErrorResponse(b, http.StatusBadRequest, "too many headers"), nil
+	}
+	header, ok := requestHeader(&call)
+	if !ok {
+		return buildErrorResponse(b, http.StatusBadRequest, "invalid header"), nil
+	}
+	req.Header = header
 	if b := call.ContentType(); len(b) > 0 {
-		req.Header = http.Header{
-			"Content-Type": []string{string(b)},
+		req.Header.Set("Content-Type", string(b))
+	}
+
+	// The actual body length takes precedence.
+	declaredLength := req.Header["Content-Length"]
+	delete(req.Header, "Content-Length")
+
+	if errRes := authorizeRequest(b, local, &req); errRes != nil {
+		return errRes, nil
+	}
+
+	if key := string(call.IdempotencyKey()); key != "" {
+		if !isHeaderValue(key) {
+			return buildErrorResponse(b, http.StatusBadRequest, "invalid idempotency key"), nil
+		}
+		req.Header.Set("Idempotency-Key", key)
+	} else if call.AutoIdempotencyKey() && req.Header.Get("Idempotency-Key") == "" {
+		key, err := randomUUID()
+		if err != nil {
+			return buildErrorResponse(b, http.StatusInternalServerError, "random source failed"), nil
+		}
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	requestID := string(call.RequestId())
+	if requestID == "" {
+		requestID = req.Header.Get(local.requestIDHeader)
+	}
+	if requestID == "" && local.generateIDs {
+		id, err := randomUUID()
+		if err != nil {
+			return buildErrorResponse(b, http.StatusInternalServerError, "random source failed"), nil
+		}
+		requestID = id
+	}
+	if requestID != "" {
+		if !isHeaderValue(requestID) {
+			return buildErrorResponse(b, http.StatusBadRequest, "invalid request id"), nil
+		}
+		req.Header.Set(local.requestIDHeader, requestID)
+	}
+
+	applyServiceHeaders(local, &req)
+
+	if limit := local.maxRequestBody; limit > 0 {
+		if int64(call.BodyLength()) > limit || call.ContentLength() > limit {
+			return buildErrorResponse(b, http.StatusRequestEntityTooLarge, "request body too large"), nil
+		}
+	}
+
+	if call.BodyStreamId() >= 0 {
+		if u == nil || call.BodyLength() > 0 || call.ContentLength() == 0 || call.ContentLength() < -1 {
+			return buildErrorResponse(b, http.StatusBadRequest, "invalid body stream"), nil
+		}
+	}
+
+	bodyLength := int64(call.BodyLength())
+	if call.BodyStreamId() >= 0 {
+		bodyLength = call.ContentLength() // -1 if unknown
+	}
+	if declaredLength != nil {
+		if bodyLength < 0 || len(declaredLength) != 1 || declaredLength[0] != strconv.FormatInt(bodyLength, 10) {
+			local.observeLengthMismatch(ctx, &req, declaredLength, bodyLength)
+		}
+	}
+
+	if local.dryRun {
+		return buildDryRunResponse(b, &req, bodyLength), nil
+	}
+
+	var cancel context.CancelFunc
+	if timeout := requestTimeout(local, call); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer func() {
+			if st == nil {
+				cancel()
+			}
+		}()
+	}
+
+	compress := call.CompressBody()
+
+	if call.BodyStreamId() >= 0 {
+		if call.ExpectContinue() {
+			// Flow is not granted until the transport wants the body.
+			u = &deferredBody{requestBody: u, limit: local.maxRequestBody}
+		} else {
+			u.start(local.maxRequestBody)
+		}
+		req.ContentLength = call.ContentLength()
+		req.Body = u
+
+		if min := local.compressMinSize; compress && min > 0 {
+			if req.ContentLength >= 0 {
+				compress = req.ContentLength >= int64(min)
+			} else if !call.ExpectContinue() {
+				prefix, eof, err := prefetchBody(ctx, u, min)
+				if err != nil {
+					return buildTransportErrorResponse(ctx, b, err), nil
+				}
+				if eof {
+					compress = false
+					req.ContentLength = int64(len(prefix))
+				}
+				req.Body = readCloser{io.MultiReader(bytes.NewReader(prefix), u), u}
+			}
+		}
+		if compress {
+			req.ContentLength = -1
+			req.Body = gzipStream(req.Body)
+		}
+		if local.maxRetries > 0 && local.maxReplayBody > 0 {
+			buf := &replayBuffer{r: req.Body, limit: local.maxReplayBody}
+			req.Body = buf.reader()
+			req.GetBody = func() (io.ReadCloser, error) {
+				return buf.reader(), nil
+			}
+		}
+	} else if n := call.BodyLength(); n > 0 {
+		data := call.BodyBytes()
+		compress = compress && n >= local.compressMinSize
+		if compress {
+			data = gzipBytes(data)
+		}
+		req.ContentLength = int64(len(data))
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	if req.Body != nil && compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if req.Body != nil && call.ExpectContinue() {
+		req.Header.Set("Expect", "100-continue")
+		// Transport waits for 100 Continue only for HTTP/1.1 requests, and
+		// sends the body after a final response unless the connection is
+		// being closed.
+		req.ProtoMajor = 1
+		req.ProtoMinor = 1
+		req.Close = true
+	}
+	if http10 {
+		if req.Body != nil && req.ContentLength < 0 {
+			return buildErrorResponse(b, http.StatusLengthRequired, "content length required"), nil
+		}
+		// Transport writes HTTP/1.1 request line in any case.
+		req.Proto = "HTTP/1.0"
+		req.ProtoMajor = 1
+		req.ProtoMinor = 0
+		req.Close = true
+	}
+	if req.Body != nil && local.contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", local.contentType)
+	}
+
+	var uploaded *uploadCounter
+	if req.Body != nil {
+		uploaded = &uploadCounter{ReadCloser: req.Body}
+		req.Body = uploaded
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				uploaded = &uploadCounter{ReadCloser: body} // Only the last attempt counts.
+				return uploaded, nil
+			}
+		}
+	}
+
+	client := backend.redirectClient(local.maxRedirects, local.extRedirects)
+	if jar != nil {
+		client.Jar = jar
+	}
+
+	var (
+		key        string
+		cacheRes   bool
+		res        *http.Response
+		stale      *http.Response // Cached response which is being revalidated.
+		start      time.Time
+		remoteAddr string
+		err        error
+	)
+	if local.cache != nil {
+		key = cacheKey(string(call.Backend()), &req)
+		cacheRes = cacheableRequest(&req, jar, local.basicAuth != nil || local.bearerToken != "")
+		if cacheRes && !revalidationRequested(&req) {
+			start = time.Now()
+			if cached, fresh := local.cache.get(key, start); fresh {
+				res = cached
+			} else if cached != nil {
+				stale = cached
+				req.Header.Set("If-None-Match", stale.Header.Get("ETag"))
+			}
+		}
+	}
+
+	if res == nil {
+		if local.limiter != nil {
+			if err := local.limiter.take(ctx); err != nil {
+				return buildTransportErrorResponse(ctx, b, err), nil
+			}
+		}
+
+		start = time.Now()
+
+		if backend.breaker != nil && !backend.breaker.allow(start) {
+			return buildErrorResponse(b, http.StatusServiceUnavailable, "backend unavailable"), nil
+		}
+
+		doCtx := ctx
+		if local.exposeRemoteAddr {
+			doCtx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					remoteAddr = info.Conn.RemoteAddr().String() // Last attempt wins.
+				},
+			})
+		}
+
+		res, err = local.doTraced(doCtx, client, &req)
+		if backend.breaker != nil {
+			backend.breaker.done(time.Now(), err, programTimeout(local, call))
+		}
+		if _, safe := safeMethods[req.Method]; !safe && local.cache != nil {
+			local.cache.invalidate(key)
+		}
+		if err != nil {
+			local.observeError(ctx, &req, time.Since(start), err)
+			return buildTransportErrorResponse(ctx, b, err), nil
+		}
+		if stale != nil && res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+			res = local.cache.revalidated(key, stale, res, time.Now())
+		} else if cacheRes {
+			res = local.cache.put(key, res, local.inlineBodyLimit, time.Now())
+		}
+	}
+	ttfb := milliseconds(time.Since(start))
+	defer func() {
+		if st == nil {
+			res.Body.Close()
+		}
+	}()
+
+	// Partial content cannot be decoded on its own.
+	partial := res.StatusCode == http.StatusPartialContent
+
+	if local.decompress && !partial {
+		if err := decompressResponse(res); err != nil {
+			local.observeError(ctx, &req, time.Since(start), err)
+			return buildErrorResponse(b, http.StatusBadGateway, "invalid response encoding"), nil
+		}
+	}
+
+	var transcoded bool
+	if local.transcode && req.Method != http.MethodHead && res.StatusCode != http.StatusNotModified && !partial {
+		transcoded = transcodeResponse(res)
+	}
+
+	head := buildResponseHead(b, local, &req, res, ttfb)
+	if requestID != "" {
+		head.requestID = b.CreateString(requestID)
+	}
+	if remoteAddr != "" {
+		head.remoteAddr = b.CreateString(remoteAddr)
+	}
+	if uploaded != nil {
+		head.uploaded = atomic.LoadInt64(&uploaded.n)
+	}
+
+	// HEAD and 304 responses have no body even if they declare a length.
+	if req.Method == http.MethodHead || res.StatusCode == http.StatusNotModified {
+		contentLength := res.ContentLength
+		if req.Method != http.MethodHead {
+			contentLength = -1
 		}
+		local.observeResponse(ctx, &req, res.StatusCode, time.Since(start), 0)
+		return buildBodylessResponse(b, res, &head, contentLength), nil
 	}
 
-	if n := call.BodyLength(); n > 0 {
-		req.ContentLength = int64(n)
-		req.Body = ioutil.NopCloser(bytes.NewReader(call.BodyBytes()))
+	if local.allowedTypes != nil && !mediaTypeAllowed(res.Header.Get("Content-Type"), local.allowedTypes) {
+		local.observeResponse(ctx, &req, res.StatusCode, time.Since(start), 0)
+		return buildBlockedResponse(b, res, &head), nil
 	}
 
-	res, err := local.client.Do(req.WithContext(ctx))
-	if err != nil {
-		return buildErrorResponse(b, http.StatusBadGateway)
+	packetLimit := int64(config.MaxSendSize - int(b.Offset()) - maxFlatResponseSize)
+	inlineLimit := packetLimit
+	if inlineLimit > local.inlineBodyLimit {
+		inlineLimit = local.inlineBodyLimit
 	}
-	defer res.Body.Close()
 
-	var contentType flatbuffers.UOffsetT
-	if s := res.Header.Get("Content-Type"); s != "" {
-		contentType = b.CreateString(s)
+	var (
+		bodyReader io.Reader = res.Body
+		limiter    *bodyLimiter
+		truncated  bool
+	)
+	if limit := local.maxResponseBody; limit > 0 {
+		limiter = &bodyLimiter{r: res.Body, n: limit}
+		bodyReader = limiter
+		truncated = res.ContentLength > limit
 	}
 
-	contentSpace := config.MaxSendSize - int(b.Offset()) - maxFlatResponseSize
-	if res.ContentLength > int64(contentSpace) {
-		return buildErrorResponse(b, http.StatusBadGateway)
+	var sum *checksum
+	if local.checksums {
+		sum = newChecksum(res.Header)
+		if res.Uncompressed || transcoded || partial {
+			sum.expectSHA256 = nil // Digest is of the encoded or complete body.
+			sum.md5 = nil
+		}
+		bodyReader = io.TeeReader(bodyReader, sum)
 	}
-	content, err := ioutil.ReadAll(res.Body) // TODO: limit
-	if err != nil {
-		return buildErrorResponse(b, http.StatusBadGateway)
+
+	var content []byte
+	// Event streams may never end, so nothing is read before streaming.
+	events := isEventStream(res.Header.Get("Content-Type"))
+	if events {
+		bodyReader = newEventReader(bodyReader)
 	}
-	if len(content) > contentSpace {
-		return buildErrorResponse(b, http.StatusBadGateway)
+
+	inline := !events && (res.ContentLength <= inlineLimit || (limiter != nil && limiter.n <= inlineLimit))
+	var (
+		errorMessage flatbuffers.UOffsetT
+		errorKind    flat.ErrorKind
+	)
+	if inline {
+		content, err = ioutil.ReadAll(io.LimitReader(bodyReader, inlineLimit+1))
+		if err != nil {
+			status, message, kind := transportError(ctx, err)
+			if len(content) == 0 {
+				local.observeError(ctx, &req, time.Since(start), err)
+				return buildErrorKindResponse(b, status, kind, message), nil
+			}
+
+			// Partial body is returned with the reason.
+			errorMessage = b.CreateString(message)
+			errorKind = kind
+			truncated = true
+		}
 	}
 
-	var body flatbuffers.UOffsetT
-	if len(content) > 0 {
-		body = b.CreateByteVector(content)
+	streamed := !inline || int64(len(content)) > inlineLimit
+	complete := !truncated && (limiter == nil || !limiter.truncated) // Body was read until EOF.
+	room := packetLimit - int64(len(content)) - flatVectorOverhead
+	if sum != nil {
+		room -= sha256.Size + flatVectorOverhead
+	}
+	if !streamed && complete {
+		// The body is streamed if the trailers don't fit; they follow it.
+		room -= headerSize(res.Trailer)
+		streamed = room < 0
+	}
+
+	var (
+		body, trailers, bodySHA256 flatbuffers.UOffsetT
+		duration                   uint32
+	)
+	if streamed {
+		// The part which has already been read is streamed first.
+		st = &stream{
+			id:      streams.newID(),
+			body:    readCloser{io.MultiReader(bytes.NewReader(content), bodyReader), res.Body},
+			limiter: limiter,
+			sum:     sum,
+			trailer: &res.Trailer,
+			events:  events,
+			cancel:  cancel,
+			start:   start,
+		}
+		if local.bytesPerSecond > 0 {
+			st.throttle = newRateLimiter(local.bytesPerSecond, streamChunkSize(local, config), RateLimitWait)
+		}
+		local.observeResponse(ctx, &req, res.StatusCode, time.Since(start), res.ContentLength)
+	} else {
+		if len(content) > 0 {
+			body = b.CreateByteVector(content)
+		}
+		if local.parseErrors && errorMessage == 0 && (res.StatusCode < 200 || res.StatusCode > 299) &&
+			isJSON(res.Header.Get("Content-Type")) {
+			// Truncated body is not valid JSON.  The message is omitted if it
+			// doesn't fit in the packet.
+			if s := jsonErrorMessage(content, local.errorPaths); s != "" && int64(len(s)+flatVectorOverhead) <= room {
+				errorMessage = b.CreateString(s)
+			}
+		}
+		if limiter != nil && limiter.truncated {
+			truncated = true
+		} else if complete {
+			if sum != nil && sum.verify() != nil {
+				local.observeError(ctx, &req, time.Since(start), errChecksumMismatch)
+				return buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusBadGateway, "checksum mismatch"), nil
+			}
+			trailers = buildTrailers(b, res.Trailer)
+		}
+		if sum != nil {
+			bodySHA256 = b.CreateByteVector(sum.sum())
+		}
+		duration = milliseconds(time.Since(start))
+		local.observeResponse(ctx, &req, res.StatusCode, time.Since(start), int64(len(content)))
 	}
 
 	flat.ResponseStart(b)
 	flat.ResponseAddStatusCode(b, uint16(res.StatusCode))
-	if contentType != 0 {
-		flat.ResponseAddContentType(b, contentType)
-	}
+	head.add(b)
 	if body != 0 {
 		flat.ResponseAddBody(b, body)
 	}
+	if st != nil {
+		flat.ResponseAddBodyStreamId(b, st.id)
+	}
+	if truncated {
+		flat.ResponseAddTruncated(b, true)
+	}
+	if trailers != 0 {
+		flat.ResponseAddTrailers(b, trailers)
+	}
+	if bodySHA256 != 0 {
+		flat.ResponseAddBodySha256(b, bodySHA256)
+	}
+	if errorMessage != 0 {
+		flat.ResponseAddErrorMessage(b, errorMessage)
+	}
+	if errorKind != flat.ErrorKindNone {
+		flat.ResponseAddErrorKind(b, errorKind)
+	}
+	if duration != 0 {
+		flat.ResponseAddDurationMs(b, duration)
+	}
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes(), st
+}
+
+// resolveTarget sets the request URL and Host.  An error response is returned
+// if the backend or URI is invalid.
+func resolveTarget(b *flatbuffers.Builder, local *Localhost, req *http.Request, backendName, uri []byte,
+) (*backend, []byte) {
+	backend := local.backends[string(backendName)]
+	if backend == nil {
+		return nil, buildErrorResponse(b, http.StatusBadRequest, "unknown backend")
+	}
+
+	callURL, err := url.Parse(string(uri))
+	if err != nil || callURL.IsAbs() || callURL.Host != callURL.Hostname() {
+		return nil, buildErrorResponse(b, http.StatusBadRequest, "invalid URI")
+	}
+	reqPath := callURL.Path
+	if local.rewritePath != nil {
+		reqPath = cleanPath(local.rewritePath(cleanPath(reqPath)))
+	}
+	if local.allowedPaths != nil || local.authorize != nil {
+		reqPath = cleanPath(reqPath)
+		if local.allowedPaths != nil && !pathAllowed(reqPath, local.allowedPaths) {
+			return nil, buildErrorResponse(b, http.StatusForbidden, "path not allowed")
+		}
+	}
+
+	req.URL = &url.URL{
+		Scheme:   backend.scheme,
+		Host:     backend.host,
+		Path:     reqPath,
+		RawQuery: callURL.RawQuery, // Verbatim; don't reorder or re-encode.
+	}
+	req.Host = local.overrideHost
+	if h := callURL.Hostname(); h != "" && local.guestHost {
+		req.Host = h
+	}
+	return backend, nil
+}
+
+// authorizeRequest using the configured hook.  An error response is returned
+// if the request is denied.
+func authorizeRequest(b *flatbuffers.Builder, local *Localhost, req *http.Request) []byte {
+	if local.authorize == nil {
+		return nil
+	}
+
+	path := req.URL.Path
+	if req.Method == http.MethodConnect {
+		path = req.URL.Host
+	}
+
+	allow, reason := local.authorize(req.Method, path, req.Header.Clone())
+	if allow {
+		return nil
+	}
+	if reason == "" {
+		reason = "request not authorized"
+	}
+	return buildErrorResponse(b, http.StatusForbidden, reason)
+}
+
+// applyServiceHeaders sets the headers which are controlled by the service.
+func applyServiceHeaders(local *Localhost, req *http.Request) {
+	applyStaticHeaders(req.Header, local.staticHeaders, local.protectedHeaders)
+	req.Header.Set("User-Agent", local.userAgent)
+	if a := local.basicAuth; a != nil {
+		req.SetBasicAuth(a.User, a.Password)
+	} else if local.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+local.bearerToken)
+	}
+}
+
+// buildBodylessResponse reports the content length instead of body.
+func buildBodylessResponse(b *flatbuffers.Builder, res *http.Response, head *responseHead, contentLength int64,
+) []byte {
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, uint16(res.StatusCode))
+	head.add(b)
+	flat.ResponseAddContentLength(b, contentLength)
+	flat.ResponseAddDurationMs(b, head.ttfb)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes()
+}
+
+// buildBlockedResponse without body.
+func buildBlockedResponse(b *flatbuffers.Builder, res *http.Response, head *responseHead) []byte {
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, uint16(res.StatusCode))
+	head.add(b)
+	flat.ResponseAddContentBlocked(b, true)
+	flat.ResponseAddDurationMs(b, head.ttfb)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes()
+}
+
+// responseHead contains the Response fields which describe a backend
+// response apart from its status code and body.
+type responseHead struct {
+	headers          flatbuffers.UOffsetT
+	headersTruncated bool
+	contentType      flatbuffers.UOffsetT
+	finalURI         flatbuffers.UOffsetT
+	redirects        flatbuffers.UOffsetT // Zero if none were followed.
+	statusText       flatbuffers.UOffsetT
+	ttfb             uint32
+	uploaded         int64                // Request body bytes.
+	requestID        flatbuffers.UOffsetT // Zero if there is none.
+	remoteAddr       flatbuffers.UOffsetT // Zero if not exposed.
+	tlsPeerSHA256    flatbuffers.UOffsetT // Zero if not exposed.
+	tlsSubject       flatbuffers.UOffsetT // Zero if not exposed.
+}
+
+func buildResponseHead(b *flatbuffers.Builder, local *Localhost, req *http.Request, res *http.Response, ttfb uint32,
+) (head responseHead) {
+	header := res.Header
+	if location := header.Get("Location"); location != "" {
+		header = header.Clone()
+		header.Set("Location", programLocation(location, res.Request.URL, req.URL))
+	}
+
+	var forwarded http.Header
+	forwarded, head.headersTruncated = limitHeader(header, local.maxResponseHeader, local.maxResHeaders)
+	head.headers, head.contentType = buildResponseHeaders(b, forwarded)
+	head.finalURI = b.CreateString(programURI(res.Request.URL, req.URL))
+	head.redirects = buildRedirectChain(b, req, res)
+	head.statusText = b.CreateString(responseStatusText(res))
+	head.ttfb = ttfb
+
+	if local.exposeTLSInfo && res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+		cert := res.TLS.PeerCertificates[0]
+		sum := sha256.Sum256(cert.Raw)
+		head.tlsPeerSHA256 = b.CreateByteVector(sum[:])
+		head.tlsSubject = b.CreateString(cert.Subject.String())
+	}
+	return
+}
+
+// buildRedirectChain creates a vector of the redirects which led to the
+// response, or returns zero if there were none.  The chain is limited by the
+// redirect policy of the client.
+func buildRedirectChain(b *flatbuffers.Builder, req *http.Request, res *http.Response) flatbuffers.UOffsetT {
+	var hops []*http.Response
+	for r := res.Request.Response; r != nil; r = r.Request.Response {
+		hops = append(hops, r)
+	}
+	if len(hops) == 0 {
+		return 0
+	}
+
+	redirects := make([]flatbuffers.UOffsetT, len(hops))
+	for i, r := range hops {
+		uri := b.CreateString(programURI(r.Request.URL, req.URL))
+		flat.RedirectStart(b)
+		flat.RedirectAddUri(b, uri)
+		flat.RedirectAddStatusCode(b, uint16(r.StatusCode))
+		redirects[len(hops)-1-i] = flat.RedirectEnd(b)
+	}
+
+	flat.ResponseStartRedirectChainVector(b, len(redirects))
+	for i := len(redirects) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(redirects[i])
+	}
+	return b.EndVector(len(redirects))
+}
+
+// add fields to a Response table which is being built.
+func (head *responseHead) add(b *flatbuffers.Builder) {
+	if head.headers != 0 {
+		flat.ResponseAddHeaders(b, head.headers)
+	}
+	if head.headersTruncated {
+		flat.ResponseAddHeadersTruncated(b, true)
+	}
+	if head.contentType != 0 {
+		flat.ResponseAddContentType(b, head.contentType)
+	}
+	flat.ResponseAddFinalUri(b, head.finalURI)
+	if head.redirects != 0 {
+		flat.ResponseAddRedirectChain(b, head.redirects)
+	}
+	flat.ResponseAddStatusText(b, head.statusText)
+	flat.ResponseAddTtfbMs(b, head.ttfb)
+	if head.uploaded != 0 {
+		flat.ResponseAddUploadedBytes(b, head.uploaded)
+	}
+	if head.requestID != 0 {
+		flat.ResponseAddRequestId(b, head.requestID)
+	}
+	if head.remoteAddr != 0 {
+		flat.ResponseAddRemoteAddr(b, head.remoteAddr)
+	}
+	if head.tlsPeerSHA256 != 0 {
+		flat.ResponseAddTlsPeerSha256(b, head.tlsPeerSHA256)
+		flat.ResponseAddTlsSubject(b, head.tlsSubject)
+	}
+}
+
+// milliseconds saturates at the maximum value of uint32.
+func milliseconds(d time.Duration) uint32 {
+	if ms := d.Milliseconds(); ms < math.MaxUint32 {
+		return uint32(ms)
+	}
+	return math.MaxUint32
+}
+
+// transportError maps a request or response body error to a status code, an
+// error message and an error kind.
+func transportError(ctx context.Context, err error) (status uint16, message string, kind flat.ErrorKind) {
+	var (
+		netErr  net.Error
+		dnsErr  *net.DNSError
+		certErr *tls.CertificateVerificationError
+		alert   tls.AlertError
+		record  tls.RecordHeaderError
+	)
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout", flat.ErrorKindTimeout
+
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, "canceled", flat.ErrorKindUnavailable
+
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "timeout", flat.ErrorKindTimeout
+
+	case errors.Is(err, errRequestBodyTooLarge):
+		return http.StatusRequestEntityTooLarge, "request body too large", flat.ErrorKindTooLarge
+
+	case errors.Is(err, errRateLimited):
+		return http.StatusTooManyRequests, "rate limit exceeded", flat.ErrorKindRateLimited
+
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, "too many concurrent requests", flat.ErrorKindUnavailable
+
+	case errors.Is(err, errBudgetExhausted):
+		return http.StatusTooManyRequests, "request budget exhausted", flat.ErrorKindRateLimited
+
+	case errors.Is(err, errRedirectLoop):
+		return http.StatusLoopDetected, "redirect loop", flat.ErrorKindBackendError
+
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusServiceUnavailable, "connection refused", flat.ErrorKindConnectionRefused
+
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, "host lookup failed", flat.ErrorKindDNSFailure
+
+	case errors.As(err, &certErr) || errors.As(err, &alert) || errors.As(err, &record):
+		return http.StatusBadGateway, "TLS handshake failed", flat.ErrorKindTLSError
+
+	default:
+		return http.StatusBadGateway, "backend request failed", flat.ErrorKindBackendError
+	}
+}
+
+// buildTransportErrorResponse for a request or response body error.
+func buildTransportErrorResponse(ctx context.Context, b *flatbuffers.Builder, err error) []byte {
+	status, message, kind := transportError(ctx, err)
+	return buildErrorKindResponse(b, status, kind, message)
+}
+
+// buildOptionsResponse with Allow header and field.
+func buildOptionsResponse(b *flatbuffers.Builder, allow string) []byte {
+	headers, _ := buildResponseHeaders(b, http.Header{"Allow": {allow}})
+	allowString := b.CreateString(allow)
+	statusText := b.CreateString(http.StatusText(http.StatusNoContent))
+
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, http.StatusNoContent)
+	flat.ResponseAddHeaders(b, headers)
+	flat.ResponseAddAllow(b, allowString)
+	flat.ResponseAddStatusText(b, statusText)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes()
+}
+
+// buildDryRunResponse describes a request instead of its response.
+func buildDryRunResponse(b *flatbuffers.Builder, req *http.Request, contentLength int64) []byte {
+	var headerCount int
+	for _, values := range req.Header {
+		headerCount += len(values)
+	}
+
+	method := b.CreateString(req.Method)
+	target := b.CreateString(req.URL.String())
+	statusText := b.CreateString(http.StatusText(http.StatusNoContent))
+
+	flat.DryRunStart(b)
+	flat.DryRunAddMethod(b, method)
+	flat.DryRunAddUrl(b, target)
+	flat.DryRunAddHeaderCount(b, int32(headerCount))
+	flat.DryRunAddContentLength(b, contentLength)
+	dryRun := flat.DryRunEnd(b)
+
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, http.StatusNoContent)
+	flat.ResponseAddStatusText(b, statusText)
+	flat.ResponseAddDryRun(b, dryRun)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes()
+}
+
+// responseStatusText returns the reason phrase of the status line, or the
+// standard text if the backend didn't send one.
+func responseStatusText(res *http.Response) string {
+	if i := strings.IndexByte(res.Status, ' '); i >= 0 {
+		return strings.TrimSpace(res.Status[i+1:])
+	}
+	return http.StatusText(res.StatusCode)
+}
+
+// buildAbortedResponse for a request which was aborted by the program.
+func buildAbortedResponse(b *flatbuffers.Builder) []byte {
+	errorMessage := b.CreateString("aborted")
+	statusText := b.CreateString(http.StatusText(http.StatusServiceUnavailable))
+
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, http.StatusServiceUnavailable)
+	flat.ResponseAddStatusText(b, statusText)
+	flat.ResponseAddErrorMessage(b, errorMessage)
+	flat.ResponseAddErrorKind(b, flat.ErrorKindUnavailable)
+	flat.ResponseAddAborted(b, true)
 	b.Finish(flat.ResponseEnd(b))
 	return b.FinishedBytes()
 }
 
-func buildErrorResponse(b *flatbuffers.Builder, status uint16) []byte {
+// buildErrorResponse with the error kind implied by the status.
+func buildErrorResponse(b *flatbuffers.Builder, status uint16, message string) []byte {
+	return buildErrorKindResponse(b, status, statusErrorKind(status), message)
+}
+
+func buildErrorKindResponse(b *flatbuffers.Builder, status uint16, kind flat.ErrorKind, message string,
+) []byte {
+	var errorMessage flatbuffers.UOffsetT
+	if message != "" {
+		errorMessage = b.CreateString(message)
+	}
+	statusText := b.CreateString(http.StatusText(int(status)))
+
 	flat.ResponseStart(b)
 	flat.ResponseAddStatusCode(b, status)
+	flat.ResponseAddStatusText(b, statusText)
+	if errorMessage != 0 {
+		flat.ResponseAddErrorMessage(b, errorMessage)
+	}
+	if kind != flat.ErrorKindNone {
+		flat.ResponseAddErrorKind(b, kind)
+	}
 	b.Finish(flat.ResponseEnd(b))
 	return b.FinishedBytes()
 }
+
+// statusErrorKind of an error response generated by the service.
+func statusErrorKind(status uint16) flat.ErrorKind {
+	switch status {
+	case http.StatusBadRequest, http.StatusLengthRequired:
+		return flat.ErrorKindBadRequest
+
+	case http.StatusForbidden, http.StatusMethodNotAllowed:
+		return flat.ErrorKindBlocked
+
+	case http.StatusRequestEntityTooLarge:
+		return flat.ErrorKindTooLarge
+
+	case http.StatusTooManyRequests:
+		return flat.ErrorKindRateLimited
+
+	case http.StatusNotFound:
+		return flat.ErrorKindNotFound
+
+	case http.StatusInternalServerError:
+		return flat.ErrorKindInternal
+
+	case http.StatusNotImplemented:
+		return flat.ErrorKindNotImplemented
+
+	case http.StatusBadGateway, http.StatusLoopDetected:
+		return flat.ErrorKindBackendError
+
+	case http.StatusServiceUnavailable:
+		return flat.ErrorKindUnavailable
+
+	case http.StatusGatewayTimeout:
+		return flat.ErrorKindTimeout
+
+	default:
+		return flat.ErrorKindNone
+	}
+}
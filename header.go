@@ -0,0 +1,267 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// Hop-by-hop headers are not forwarded.
+var hopHeaders = map[string]struct{}{
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Proxy-Connection":    {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+}
+
+// headerCount of all values.
+func headerCount(h http.Header) (n int) {
+	for _, values := range h {
+		n += len(values)
+	}
+	return
+}
+
+// headerCall is a flat table with headers.
+type headerCall interface {
+	Headers(obj *flat.Header, j int) bool
+	HeadersLength() int
+}
+
+// requestHeader from call.  False is returned if the headers are invalid or
+// try to override Host.
+func requestHeader(call headerCall) (http.Header, bool) {
+	h := make(http.Header)
+
+	var header flat.Header
+	for i := 0; i < call.HeadersLength(); i++ {
+		call.Headers(&header, i)
+
+		name := string(header.Name())
+		value := string(header.Value())
+		if !isToken(name) || !isHeaderValue(value) {
+			return nil, false
+		}
+
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if key == "Host" {
+			return nil, false
+		}
+		if _, hop := hopHeaders[key]; hop {
+			continue
+		}
+
+		h[key] = append(h[key], value)
+	}
+
+	return h, true
+}
+
+// newStaticHeaders validates and canonicalizes the configuration.
+func newStaticHeaders(static http.Header, protected []string,
+) (headers http.Header, protectedKeys map[string]struct{}, err error) {
+	headers = make(http.Header)
+	for name, values := range static {
+		key, err := staticHeaderKey(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, value := range values {
+			if !isHeaderValue(value) {
+				return nil, nil, fmt.Errorf("invalid static header value: %s: %q", key, value)
+			}
+		}
+		headers[key] = append(headers[key], values...)
+	}
+
+	protectedKeys = make(map[string]struct{})
+	for _, name := range protected {
+		key, err := staticHeaderKey(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		protectedKeys[key] = struct{}{}
+	}
+
+	return
+}
+
+func staticHeaderKey(name string) (string, error) {
+	if !isToken(name) {
+		return "", fmt.Errorf("invalid header name: %q", name)
+	}
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	if _, hop := hopHeaders[key]; hop || key == "Host" {
+		return "", fmt.Errorf("header cannot be configured: %s", key)
+	}
+	return key, nil
+}
+
+// applyStaticHeaders to a request header specified by a program.
+func applyStaticHeaders(h, static http.Header, protected map[string]struct{}) {
+	for key := range protected {
+		delete(h, key)
+	}
+	for key, values := range static {
+		if _, found := h[key]; !found {
+			h[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+// limitHeader to the given number of bytes (names and values) and values in
+// key order.  Content-Type is always included.  Hop-by-hop headers are not
+// counted.  Zero limits mean no limit.
+func limitHeader(h http.Header, limit int64, maxCount int) (limited http.Header, truncated bool) {
+	if limit == 0 && maxCount == 0 {
+		return h, false
+	}
+
+	limited = make(http.Header)
+	var size int64
+	var count int
+
+	if values, found := h["Content-Type"]; found {
+		limited["Content-Type"] = values
+		for _, s := range values {
+			size += int64(len("Content-Type") + len(s))
+		}
+		count = len(values)
+	}
+
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		if _, hop := hopHeaders[key]; !hop && key != "Content-Type" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, s := range h[key] {
+			size += int64(len(key) + len(s))
+			count++
+			if (limit > 0 && size > limit) || (maxCount > 0 && count > maxCount) {
+				truncated = true
+				return
+			}
+			limited[key] = append(limited[key], s)
+		}
+	}
+	return
+}
+
+// Upper bound for the encoding overhead of a header entry, excluding the name
+// and value.
+const flatHeaderOverhead = 40
+
+// headerSize is an upper bound for the encoded size of a header vector.
+func headerSize(h http.Header) int64 {
+	n := int64(flatVectorOverhead)
+	for key, values := range h {
+		if _, hop := hopHeaders[key]; !hop {
+			for _, s := range values {
+				n += int64(len(key) + len(s) + flatHeaderOverhead)
+			}
+		}
+	}
+	return n
+}
+
+// buildResponseHeaders creates a header vector with an entry for each value.
+// Offset of the first Content-Type value is also returned (or zero).
+func buildResponseHeaders(b *flatbuffers.Builder, h http.Header) (headers, contentType flatbuffers.UOffsetT) {
+	offsets, contentType := buildHeaders(b, h)
+	if len(offsets) > 0 {
+		flat.ResponseStartHeadersVector(b, len(offsets))
+		headers = endHeaderVector(b, offsets)
+	}
+	return
+}
+
+// buildTrailers creates a trailer vector, or returns zero if there are none.
+func buildTrailers(b *flatbuffers.Builder, h http.Header) (trailers flatbuffers.UOffsetT) {
+	offsets, _ := buildHeaders(b, h)
+	if len(offsets) > 0 {
+		flat.ResponseStartTrailersVector(b, len(offsets))
+		trailers = endHeaderVector(b, offsets)
+	}
+	return
+}
+
+func buildHeaders(b *flatbuffers.Builder, h http.Header) (offsets []flatbuffers.UOffsetT, contentType flatbuffers.UOffsetT) {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		if _, hop := hopHeaders[key]; !hop {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := b.CreateString(key)
+
+		for _, s := range h[key] {
+			value := b.CreateString(s)
+			if key == "Content-Type" && contentType == 0 {
+				contentType = value
+			}
+
+			flat.HeaderStart(b)
+			flat.HeaderAddName(b, name)
+			flat.HeaderAddValue(b, value)
+			offsets = append(offsets, flat.HeaderEnd(b))
+		}
+	}
+	return
+}
+
+func endHeaderVector(b *flatbuffers.Builder, offsets []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	for i := len(offsets) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(offsets[i])
+	}
+	return b.EndVector(len(offsets))
+}
+
+// isToken checks if s is a non-empty RFC 7230 token.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func isHeaderValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// CheckBackend makes a HEAD request to the health check path of each backend.
+// It succeeds if all backends respond with a status other than 5xx within the
+// health check timeout.  Rate limit and circuit breaker are not applied, and
+// the requests are not observed.
+func (l *Localhost) CheckBackend(ctx context.Context) error {
+	l = l.current()
+
+	ctx, cancel := context.WithTimeout(ctx, l.healthTimeout)
+	defer cancel()
+
+	names := make([]string, 0, len(l.backends))
+	for name := range l.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := checkBackend(ctx, l, l.backends[name]); err != nil {
+			if name == "" {
+				return fmt.Errorf("localhost: backend health check: %v", err)
+			}
+			return fmt.Errorf("localhost: backend %q health check: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func checkBackend(ctx context.Context, l *Localhost, backend *backend) error {
+	req := (&http.Request{
+		Method: http.MethodHead,
+		URL: &url.URL{
+			Scheme: backend.scheme,
+			Host:   backend.host,
+			Path:   l.healthPath,
+		},
+		Header: make(http.Header),
+		Host:   l.overrideHost,
+	}).WithContext(ctx)
+	applyServiceHeaders(l, req)
+
+	res, err := backend.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode >= 500 {
+		return errors.New(res.Status)
+	}
+	return nil
+}
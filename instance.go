@@ -8,24 +8,56 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gate.computer/gate/packet"
 	"gate.computer/gate/service"
+	flatbuffers "github.com/google/flatbuffers/go"
 )
 
 const maxRequests = 10 // Cannot be greater than 256.
 
+// Snapshot starts with magic and version.
+const (
+	snapshotMagic   = "\x00lh\x00"
+	snapshotVersion = 5 // Version 1 didn't have cookies, version 2 didn't have deadlines, version 3 didn't have budget, version 4 didn't have spill references.
+)
+
 type instance struct {
 	service.InstanceBase
 
-	local *Localhost
+	local *Localhost // Its current configuration is used.
 	packet.Service
 
+	// Done when the instance is shut down: in-flight requests are canceled.
+	shutdown       context.Context
+	cancelRequests context.CancelFunc
+
+	// Done when the instance is suspended: event streams are ended.
+	suspend      context.Context
+	cancelEvents context.CancelFunc
+
+	// Closed when suspension begins: response bodies are spilled.
+	suspending chan struct{}
+
 	handlers sync.WaitGroup
 	handled  chan<- handled
 	unsent   <-chan []packet.Buf
 	s        sender
+	streams  streams
+	jar      *cookieJar     // Nil if cookies are not enabled.
+	budget   *requestBudget // Nil if requests are not limited.
+
+	mu        sync.Mutex
+	deadlines map[*byte]time.Time // Of restartable requests, keyed by packet.
+
+	// Restored from snapshot, consumed by Start.
+	pendingRequests []packet.Buf
+	pendingUnsent   []packet.Buf
 }
 
 func newInstance(local *Localhost, config service.InstanceConfig) *instance {
@@ -33,32 +65,124 @@ func newInstance(local *Localhost, config service.InstanceConfig) *instance {
 		local:   local,
 		Service: config.Service,
 	}
+	local = local.current() // Settings are read once.
+
+	inst.shutdown, inst.cancelRequests = context.WithCancel(context.Background())
+	inst.suspend, inst.cancelEvents = context.WithCancel(context.Background())
+	inst.suspending = make(chan struct{})
 	inst.s.init()
+	inst.deadlines = make(map[*byte]time.Time)
+	if local.cookies {
+		inst.jar = new(cookieJar)
+	}
+	if local.instanceRequests > 0 {
+		inst.budget = &requestBudget{limit: int32(local.instanceRequests)}
+	}
 	return inst
 }
 
 func (inst *instance) restore(snapshot []byte) error {
-	if len(snapshot) > 0 {
-		panic("TODO")
+	if len(snapshot) == 0 {
+		return nil
 	}
 
+	if len(snapshot) <= len(snapshotMagic) || string(snapshot[:len(snapshotMagic)]) != snapshotMagic {
+		return errors.New("localhost: unrecognized snapshot format")
+	}
+	v := snapshot[len(snapshotMagic)]
+	if v < 1 || v > snapshotVersion {
+		return fmt.Errorf("localhost: unsupported snapshot version %d (supported version is %d)", v, snapshotVersion)
+	}
+
+	d := decoder{b: snapshot[len(snapshotMagic)+1:]}
+	nextStreamID := d.uvarint()
+	requests := d.packets()
+	unsent := d.packets()
+	var cookies, deadlines []byte
+	if v >= 2 {
+		cookies = d.bytes()
+	}
+	if v >= 3 {
+		deadlines = d.bytes()
+		if d.err == nil && len(deadlines) != 8*len(requests) {
+			d.err = errors.New("deadline count mismatch")
+		}
+	}
+	var used uint64
+	if v >= 4 {
+		used = d.uvarint()
+	}
+	if d.err == nil && len(d.b) != 0 {
+		d.err = errors.New("trailing data")
+	}
+	for _, p := range requests {
+		if d.err == nil && p.Domain() != packet.DomainCall {
+			d.err = fmt.Errorf("request packet has domain %d", p.Domain())
+		}
+	}
+	for _, p := range unsent {
+		if dom := p.Domain(); d.err == nil && dom != packet.DomainCall && !dom.IsStream() {
+			d.err = fmt.Errorf("unsent packet has domain %d", dom)
+		}
+		if d.err == nil && isSpillPacket(p) {
+			if _, _, ok := parseSpillPacket(packet.DataBuf(p)); !ok {
+				d.err = errors.New("invalid spill reference")
+			}
+		}
+	}
+	if d.err == nil && len(cookies) > 0 && inst.jar != nil {
+		d.err = inst.jar.unmarshal(cookies)
+	}
+	if d.err != nil {
+		return fmt.Errorf("localhost: invalid snapshot: %v", d.err)
+	}
+
+	for i := 0; i < len(deadlines); i += 8 {
+		if ns := int64(binary.LittleEndian.Uint64(deadlines[i:])); ns != 0 {
+			inst.deadlines[&requests[i/8][0]] = time.Unix(0, ns)
+		}
+	}
+
+	if inst.budget != nil {
+		inst.budget.used = int32(used)
+	}
+	inst.streams.nextID = int32(nextStreamID)
+	inst.pendingRequests = requests
+	inst.pendingUnsent = unsent
 	return nil
 }
 
 func (inst *instance) Start(ctx context.Context, send chan<- packet.Buf, abort func(error)) error {
+	buffered, spills := takeSpills(inst.pendingUnsent)
+
 	c := make(chan handled)
-	inst.unsent = inst.s.start(send, c)
+	inst.unsent = inst.s.start(send, c, buffered)
 	inst.handled = c
+	inst.pendingUnsent = nil
+
+	for _, sp := range spills {
+		inst.resumeSpill(sp)
+	}
+
+	requests := inst.pendingRequests
+	inst.pendingRequests = nil
+	for _, p := range requests {
+		inst.handleCall(ctx, p)
+	}
+
 	return nil
 }
 
 func (inst *instance) Handle(ctx context.Context, send chan<- packet.Buf, p packet.Buf) error {
-	switch dom := p.Domain(); {
-	case dom == packet.DomainCall:
+	switch p.Domain() {
+	case packet.DomainCall:
 		inst.handleCall(ctx, p)
 
-	case dom.IsStream():
-		return errors.New("localhost: unexpected stream packet")
+	case packet.DomainData:
+		inst.streams.receive(packet.DataBuf(p))
+
+	case packet.DomainFlow:
+		// Response streams and WebSocket frames are not flow-controlled.
 	}
 
 	return nil
@@ -69,14 +193,160 @@ func (inst *instance) handleCall(ctx context.Context, p packet.Buf) {
 		return
 	}
 
+	// Register before returning so that body data can be received
+	// immediately.  Duplicate id is detected by the handler.
+	uploadIDs := requestBodyStreamIDs(p)
+	for _, id := range uploadIDs {
+		inst.streams.registerUpload(id, p, inst.Service, inst.handled)
+	}
+
+	// Restartable requests are canceled by suspension until they have been
+	// handled; they will be handled again after resumption.  Their deadline
+	// is retained across suspension.
+	var (
+		restarting <-chan struct{}
+		state      int32 // 0 = handling, 1 = handled, 2 = restarting
+	)
+	local := inst.local.current()
+
+	restartable := local.restartIdempotent && restartableRequest(p)
+	if restartable {
+		restarting = inst.suspend.Done()
+		ctx = withRestartState(ctx, &state)
+	}
+
+	cancelDeadline := func() {}
+	if deadline := inst.requestDeadline(local, p, restartable); !deadline.IsZero() {
+		ctx, cancelDeadline = context.WithDeadline(ctx, deadline)
+	}
+
+	ctx = withBudget(ctx, inst.budget)
+
+	// Canceled by shutdown, abort, or when the handler is done.
+	ctx, cancel := context.WithCancel(ctx)
+
+	aborter := &abortable{cancel: cancel}
+	for _, id := range uploadIDs {
+		inst.streams.registerAbort(id, aborter)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-inst.shutdown.Done():
+			case <-restarting:
+				if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+					restarting = nil // Too late.
+					continue
+				}
+			case <-ctx.Done():
+			}
+			cancel()
+			return
+		}
+	}()
+
 	inst.handlers.Add(1)
 	go func() {
 		defer inst.handlers.Done()
-		inst.handled <- handle(ctx, inst.local, inst.Service, p)
+		defer cancelDeadline()
+		defer cancel()
+
+		h, s := handle(ctx, local, inst.Service, &inst.streams, inst.jar, p)
+		for _, id := range uploadIDs {
+			inst.streams.unregisterAbort(id, aborter)
+		}
+		if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+			if s != nil {
+				s.close()
+			}
+			return // Request remains pending.
+		}
+		inst.forgetDeadline(p)
+
+		if aborter.aborted() {
+			if s != nil {
+				s.close()
+				s = nil
+			}
+			h.res = makeCallResponse(inst.Service, buildAbortedResponse(flatbuffers.NewBuilder(0)))
+		}
+
+		if s != nil {
+			s.aborter = aborter
+			s.unthrottle = inst.suspend.Done()
+			if local.spillDir != "" && !s.events {
+				s.spill = inst.suspending
+				s.spillDir = local.spillDir
+			}
+			s.keepAlive = local.streamKeepAlive
+			inst.streams.registerAbort(s.id, aborter)
+			defer inst.streams.unregisterAbort(s.id, aborter)
+		}
+
+		inst.handled <- h
+		if s != nil {
+			if s.events {
+				go func() {
+					select {
+					case <-inst.suspend.Done():
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+			}
+
+			s.send(ctx, inst.Service, streamChunkSize(local, inst.Service), inst.handled)
+		}
 	}()
 }
 
+// resumeSpill streams a spilled response body.  It can be aborted like the
+// request which it belongs to.
+func (inst *instance) resumeSpill(sp *spilled) {
+	local := inst.local.current()
+
+	ctx, cancel := context.WithCancel(inst.shutdown)
+
+	aborter := &abortable{cancel: cancel}
+	inst.streams.registerAbort(sp.id, aborter)
+
+	inst.handlers.Add(1)
+	go func() {
+		defer inst.handlers.Done()
+		defer cancel()
+		defer inst.streams.unregisterAbort(sp.id, aborter)
+
+		sp.send(ctx, inst.suspending, aborter, local.spillDir, inst.Service, streamChunkSize(local, inst.Service), inst.handled)
+	}()
+}
+
+// requestDeadline which was restored or recorded earlier.  A restartable
+// request's deadline is recorded when it's seen for the first time.  Zero time
+// means no deadline.
+func (inst *instance) requestDeadline(local *Localhost, p packet.Buf, restartable bool) time.Time {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	deadline, found := inst.deadlines[&p[0]]
+	if !found && restartable {
+		deadline = restartableDeadline(local, p, time.Now())
+		if !deadline.IsZero() {
+			inst.deadlines[&p[0]] = deadline
+		}
+	}
+	return deadline
+}
+
+func (inst *instance) forgetDeadline(p packet.Buf) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	delete(inst.deadlines, &p[0])
+}
+
 func (inst *instance) shut() (requests, unsent []packet.Buf) {
+	inst.streams.abortUploads()
 	inst.handlers.Wait()
 
 	if inst.handled != nil {
@@ -84,44 +354,104 @@ func (inst *instance) shut() (requests, unsent []packet.Buf) {
 		inst.handled = nil
 	}
 
-	requests = inst.s.wait()
+	requests = append(inst.pendingRequests, inst.s.wait()...)
+	inst.pendingRequests = nil
 
 	if inst.unsent != nil {
 		unsent = <-inst.unsent
 		inst.unsent = nil
+	} else {
+		unsent = inst.pendingUnsent
+		inst.pendingUnsent = nil
 	}
 
 	return
 }
 
+// Shutdown the instance.  In-flight requests are canceled, and their
+// completion is awaited during the grace period.  Spill files of the instance
+// are removed.  No packets are sent after Shutdown returns, even if it returns
+// an error.
 func (inst *instance) Shutdown(ctx context.Context) error {
-	inst.shut()
-	return nil
+	inst.s.stop()
+	inst.cancelRequests()
+
+	local := inst.local.current()
+
+	if d := local.shutdownGrace; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, unsent := inst.shut()
+		removeSpills(local.spillDir, unsent)
+	}()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-ctx.Done():
+		return errors.New("localhost: requests did not finish during shutdown")
+	}
 }
 
+// Suspend the instance.  Packets are not sent after Suspend is called.  Stream
+// data which has not been sent is included in the unsent packets (or spilled
+// to files which they refer to), along with the stream id counter, cookies,
+// deadlines of pending requests and the number of requests made.  Event
+// streams are ended.
 func (inst *instance) Suspend(ctx context.Context) ([]byte, error) {
+	close(inst.suspending) // Before streams are released.
+	inst.s.stop()          // Releases streams waiting for backpressure.
+	inst.cancelEvents()
 	requests, unsent := inst.shut()
 
-	n := binary.MaxVarintLen32 * 2
-	for _, p := range requests {
-		n += len(p)
+	var cookies []byte
+	if inst.jar != nil {
+		var err error
+		if cookies, err = inst.jar.marshal(); err != nil {
+			return nil, err
+		}
 	}
-	for _, p := range unsent {
-		n += len(p)
+
+	deadlines := make([]byte, 8*len(requests)) // Zero means no deadline.
+	inst.mu.Lock()
+	for i, p := range requests {
+		if deadline, found := inst.deadlines[&p[0]]; found {
+			binary.LittleEndian.PutUint64(deadlines[i*8:], uint64(deadline.UnixNano()))
+		}
 	}
+	inst.mu.Unlock()
 
-	b := make([]byte, 0, n)
+	var used int // Budget.
+	if inst.budget != nil {
+		used = int(atomic.LoadInt32(&inst.budget.used))
+	}
 
-	b = appendUvarint(b, len(requests))
+	n := len(snapshotMagic) + 1 + binary.MaxVarintLen32*6 + len(cookies) + len(deadlines)
 	for _, p := range requests {
-		b = append(b, p...)
+		n += binary.MaxVarintLen32 + len(p)
 	}
-
-	b = appendUvarint(b, len(unsent))
 	for _, p := range unsent {
-		b = append(b, p...)
+		n += binary.MaxVarintLen32 + len(p)
 	}
 
+	b := make([]byte, 0, n)
+	b = append(b, snapshotMagic...)
+	b = append(b, snapshotVersion)
+	b = appendUvarint(b, int(atomic.LoadInt32(&inst.streams.nextID)))
+	b = appendPackets(b, requests)
+	b = appendPackets(b, unsent)
+	b = appendBytes(b, cookies)
+	b = appendBytes(b, deadlines)
+	b = appendUvarint(b, used)
+
+	inst.local.current().observeSuspend(ctx, len(requests), len(unsent), len(b))
 	return b, nil
 }
 
@@ -130,27 +460,60 @@ type sender struct {
 	cond     sync.Cond
 	requests []packet.Buf // Nil means not started or shut down.
 	sending  bool
+
+	stopping chan struct{}
+	stopped  chan struct{} // Closed when the loop no longer sends.
 }
 
 func (s *sender) init() {
 	s.cond.L = &s.mu
+	s.stopping = make(chan struct{})
+	s.stopped = make(chan struct{})
+}
+
+// stop sending packets.  Handled packets are still buffered.  When stop
+// returns, no more packets will be sent.
+func (s *sender) stop() {
+	select {
+	case <-s.stopping:
+	default:
+		close(s.stopping)
+	}
+
+	s.mu.Lock()
+	started := s.requests != nil || s.sending
+	s.mu.Unlock()
+
+	if started {
+		<-s.stopped
+	}
 }
 
-func (s *sender) start(send chan<- packet.Buf, handled <-chan handled) <-chan []packet.Buf {
+func (s *sender) start(send chan<- packet.Buf, handled <-chan handled, buffered []packet.Buf,
+) <-chan []packet.Buf {
 	unsent := make(chan []packet.Buf, 1)
 
 	// Locking not necessary.
 	s.requests = []packet.Buf{}
 	s.sending = true
-	go s.loop(unsent, send, handled)
+	go s.loop(unsent, send, handled, buffered)
 
 	return unsent
 }
 
-func (s *sender) loop(unsent chan<- []packet.Buf, send chan<- packet.Buf, handled <-chan handled) {
-	var buffered []packet.Buf
+// loop sends buffered packets.  Stream data packets are acknowledged when they
+// have been sent, so that stream bodies are not read ahead while the send
+// channel is blocked.  After stopping, packets are acknowledged immediately.
+func (s *sender) loop(unsent chan<- []packet.Buf, send chan<- packet.Buf, handled <-chan handled,
+	buffered []packet.Buf,
+) {
+	stopping := s.stopping
+	acks := make([]chan<- struct{}, len(buffered)) // Parallel to buffered.
 
 	defer func() {
+		if stopping != nil {
+			close(s.stopped)
+		}
 		unsent <- buffered
 	}()
 
@@ -167,17 +530,39 @@ func (s *sender) loop(unsent chan<- []packet.Buf, send chan<- packet.Buf, handle
 			sending  chan<- packet.Buf
 			sendable packet.Buf
 		)
-		if len(buffered) > 0 {
+		// Spill references may appear just before stopping.
+		if len(buffered) > 0 && stopping != nil && !isSpillPacket(buffered[0]) {
 			sending = send
 			sendable = buffered[0]
 		}
 
 		select {
+		case <-stopping:
+			stopping = nil
+			close(s.stopped)
+
+			for i, ack := range acks {
+				if ack != nil {
+					close(ack)
+					acks[i] = nil
+				}
+			}
+
 		case h, ok := <-handled:
 			if !ok {
 				return
 			}
 
+			if h.req == nil {
+				if h.sent != nil && stopping == nil {
+					close(h.sent)
+					h.sent = nil
+				}
+				buffered = append(buffered, h.res)
+				acks = append(acks, h.sent)
+				break
+			}
+
 			index := func() uint8 {
 				s.mu.Lock()
 				defer s.mu.Unlock()
@@ -195,9 +580,14 @@ func (s *sender) loop(unsent chan<- []packet.Buf, send chan<- packet.Buf, handle
 			p := h.res
 			p.SetIndex(index)
 			buffered = append(buffered, p)
+			acks = append(acks, nil)
 
 		case sending <- sendable:
+			if acks[0] != nil {
+				close(acks[0])
+			}
 			buffered = buffered[1:]
+			acks = acks[1:]
 		}
 	}
 }
@@ -230,3 +620,69 @@ func appendUvarint(b []byte, value int) []byte {
 	n := binary.PutUvarint(b[len(b):len(b)+binary.MaxVarintLen32], uint64(value))
 	return b[:len(b)+n]
 }
+
+// appendPackets with count and length prefixes.
+func appendPackets(b []byte, packets []packet.Buf) []byte {
+	b = appendUvarint(b, len(packets))
+	for _, p := range packets {
+		b = appendUvarint(b, len(p))
+		b = append(b, p...)
+	}
+	return b
+}
+
+// appendBytes with length prefix.
+func appendBytes(b, data []byte) []byte {
+	b = appendUvarint(b, len(data))
+	return append(b, data...)
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 || x > math.MaxInt32 {
+		d.err = errors.New("bad varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decoder) packets() (packets []packet.Buf) {
+	count := d.uvarint()
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		size := d.uvarint()
+		if d.err != nil {
+			break
+		}
+		if size < packet.HeaderSize || size > uint64(len(d.b)) {
+			d.err = errors.New("bad packet size")
+			break
+		}
+		packets = append(packets, packet.Buf(d.b[:size:size]))
+		d.b = d.b[size:]
+	}
+	return
+}
+
+func (d *decoder) bytes() (data []byte) {
+	size := d.uvarint()
+	if d.err != nil {
+		return
+	}
+	if size > uint64(len(d.b)) {
+		d.err = errors.New("bad data size")
+		return
+	}
+	data = d.b[:size:size]
+	d.b = d.b[size:]
+	return
+}
@@ -5,12 +5,38 @@
 package localhost
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -41,16 +67,9 @@ func TestRequest(t *testing.T) {
 	}))
 	defer s.Close()
 
-	u, err := url.Parse(s.URL)
-	if err != nil {
-		panic(err)
-	}
-
-	inst := newInstance(&Localhost{u.Scheme, u.Host, s.Client()}, service.InstanceConfig{
-		Service: packet.Service{
-			MaxSendSize: testMaxSendSize,
-			Code:        testCode,
-		},
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		AllowGuestHost:  true,
 	})
 
 	b := flatbuffers.NewBuilder(0)
@@ -59,23 +78,8 @@ func TestRequest(t *testing.T) {
 	flat.RequestStart(b)
 	flat.RequestAddMethod(b, method)
 	flat.RequestAddUri(b, uri)
-	request := flat.RequestEnd(b)
-	flat.CallStart(b)
-	flat.CallAddFunctionType(b, flat.FunctionRequest)
-	flat.CallAddFunction(b, request)
-	b.Finish(flat.CallEnd(b))
-
-	p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
-	copy(p.Content(), b.FinishedBytes())
-
-	if !packet.IsValidCall(p, testCode) {
-		t.Error(p)
-	}
+	p := makeTestCall(t, b, flat.RequestEnd(b))
 
-	c := make(chan packet.Buf, 1)
-	if err := inst.Start(context.Background(), c, nil); err != nil {
-		t.Fatal(err)
-	}
 	if err := inst.Handle(context.Background(), c, p); err != nil {
 		t.Fatal(err)
 	}
@@ -99,3 +103,6954 @@ func TestRequest(t *testing.T) {
 		t.Errorf("%q", r.BodyBytes())
 	}
 }
+
+func TestStreamedResponse(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), testMaxSendSize/8)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{StreamChunkSize: 1000})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+	if r.BodyLength() != 0 {
+		t.Error(r.BodyLength())
+	}
+	id := r.BodyStreamId()
+	if id < 0 {
+		t.Fatal(id)
+	}
+
+	var body []byte
+	for {
+		p := packet.DataBuf(<-c)
+		if packet.Buf(p).Domain() != packet.DomainData || p.ID() != id {
+			t.Fatal(p)
+		}
+		if p.DataLen() > 1000 {
+			t.Error(p.DataLen())
+		}
+		if p.DataLen() == 0 {
+			break
+		}
+		if p.Note() != streamNoteTrailers {
+			body = append(body, p.Data()...)
+		}
+	}
+	if !bytes.Equal(body, content) {
+		t.Error(len(body))
+	}
+}
+
+func TestSuspendStreamedResponse(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{StreamChunkSize: 1000})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets which got through before suspension.
+	var received []packet.Buf
+	for len(c) > 0 {
+		received = append(received, <-c)
+	}
+
+	restored, err := inst.local.CreateInstance(context.Background(), service.InstanceConfig{
+		Service: inst.Service,
+	}, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = make(chan packet.Buf, 100)
+	if err := restored.Start(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	for p := range c {
+		received = append(received, p)
+		if p.Domain() == packet.DomainData && packet.DataBuf(p).DataLen() == 0 {
+			break
+		}
+	}
+
+	r := flat.GetRootAsResponse(received[0], packet.HeaderSize)
+	if r.BodyStreamId() != 0 {
+		t.Fatal(r.BodyStreamId())
+	}
+
+	var body []byte
+	for _, p := range received[1:] {
+		if packet.DataBuf(p).Note() != streamNoteTrailers {
+			body = append(body, packet.DataBuf(p).Data()...)
+		}
+	}
+	if !bytes.Equal(body, content) {
+		t.Error(len(body))
+	}
+
+	if id := restored.(*instance).streams.newID(); id != 1 {
+		t.Error(id)
+	}
+}
+
+func TestSuspendSpilledResponse(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4000)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "localhost-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := New(&Config{Addr: s.URL, SpillDir: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("missing spill directory accepted")
+	}
+
+	local, err := New(&Config{
+		Addr:            s.URL,
+		StreamChunkSize: 1000,
+		SpillDir:        dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spillFiles := func() int {
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names)
+	}
+
+	// Suspend while streaming, and collect the packets which got through.
+	suspend := func(inst service.Instance, c <-chan packet.Buf) (snapshot []byte, received []packet.Buf) {
+		snapshot, err := inst.Suspend(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for len(c) > 0 {
+			received = append(received, <-c)
+		}
+		return
+	}
+
+	restore := func(snapshot []byte, c chan<- packet.Buf) service.Instance {
+		inst, err := local.CreateInstance(context.Background(), service.InstanceConfig{
+			Service: packet.Service{
+				MaxSendSize: testMaxSendSize,
+				Code:        testCode,
+			},
+		}, snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != nil {
+			if err := inst.Start(context.Background(), c, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return inst
+	}
+
+	receiveAll := func(c <-chan packet.Buf) (received []packet.Buf) {
+		for p := range c {
+			received = append(received, p)
+			if p.Domain() == packet.DomainData && packet.DataBuf(p).DataLen() == 0 {
+				return
+			}
+		}
+		return
+	}
+
+	start := func() ([]byte, []packet.Buf) {
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		received := []packet.Buf{<-c} // Response header.
+
+		snapshot, more := suspend(inst, c)
+		if len(snapshot) > len(content)/2 {
+			t.Errorf("snapshot size: %d", len(snapshot))
+		}
+		if n := spillFiles(); n != 1 {
+			t.Fatalf("%d spill files", n)
+		}
+		return snapshot, append(received, more...)
+	}
+
+	body := func(received []packet.Buf) (data []byte, trailers *flat.Trailers) {
+		r := flat.GetRootAsResponse(received[0], packet.HeaderSize)
+		if r.BodyStreamId() != 0 {
+			t.Fatal(r.BodyStreamId())
+		}
+		for _, p := range received[1:] {
+			d := packet.DataBuf(p)
+			if d.ID() != 0 {
+				t.Fatal(d.ID())
+			}
+			if d.Note() == streamNoteTrailers {
+				trailers = flat.GetRootAsTrailers(d.Data(), 0)
+			} else {
+				data = append(data, d.Data()...)
+			}
+		}
+		return
+	}
+
+	// Resumed, suspended again, and resumed again.
+	{
+		snapshot, received := start()
+
+		c := make(chan packet.Buf, 1)
+		inst := restore(snapshot, c)
+		received = append(received, <-c, <-c)
+		snapshot, more := suspend(inst, c)
+		received = append(received, more...)
+		if n := spillFiles(); n != 1 {
+			t.Errorf("%d spill files", n)
+		}
+
+		c = make(chan packet.Buf, 100)
+		restore(snapshot, c)
+		received = append(received, receiveAll(c)...)
+
+		data, trailers := body(received)
+		if !bytes.Equal(data, content) {
+			t.Error(len(data))
+		}
+		if trailers == nil || len(trailers.ErrorMessage()) != 0 {
+			t.Error("trailers")
+		}
+		if n := spillFiles(); n != 0 {
+			t.Errorf("%d spill files", n)
+		}
+	}
+
+	// Spill file is missing.
+	{
+		snapshot, received := start()
+
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		c := make(chan packet.Buf, 100)
+		restore(snapshot, c)
+		received = append(received, receiveAll(c)...)
+
+		data, trailers := body(received)
+		if len(data) >= len(content) {
+			t.Error(len(data))
+		}
+		if trailers == nil || string(trailers.ErrorMessage()) != "spilled body is unavailable" {
+			t.Error("trailers")
+		}
+	}
+
+	// Shut down without resumption.
+	{
+		snapshot, _ := start()
+
+		inst := restore(snapshot, nil)
+		if err := inst.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := spillFiles(); n != 0 {
+			t.Errorf("%d spill files", n)
+		}
+	}
+}
+
+func TestRestoreSnapshotFormat(t *testing.T) {
+	local, err := New(&Config{Addr: "http://localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	}
+
+	inst, err := local.CreateInstance(context.Background(), config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.CreateInstance(context.Background(), config, snapshot); err != nil {
+		t.Error(err)
+	}
+
+	// Unversioned format: request count, requests, unsent count, unsent.
+	if _, err := local.CreateInstance(context.Background(), config, []byte{0, 0}); err == nil {
+		t.Error("unversioned snapshot was accepted")
+	}
+
+	future := append([]byte{}, snapshot...)
+	future[len(snapshotMagic)]++
+	if _, err := local.CreateInstance(context.Background(), config, future); err == nil {
+		t.Error("future snapshot version was accepted")
+	}
+
+	if _, err := local.CreateInstance(context.Background(), config, snapshot[:len(snapshot)-1]); err == nil {
+		t.Error("truncated snapshot was accepted")
+	}
+}
+
+type testSuspendMetrics struct {
+	observations []string
+}
+
+func (*testSuspendMetrics) ObserveRequest(string, int, time.Duration) {}
+
+func (m *testSuspendMetrics) ObserveSuspend(requests, unsent, size int) {
+	m.observations = append(m.observations, fmt.Sprintf("suspend %d %d %d", requests, unsent, size))
+}
+
+func (m *testSuspendMetrics) ObserveResume(requests, unsent, size int) {
+	m.observations = append(m.observations, fmt.Sprintf("resume %d %d %d", requests, unsent, size))
+}
+
+func TestSuspendObservation(t *testing.T) {
+	var (
+		log     bytes.Buffer
+		metrics testSuspendMetrics
+	)
+
+	local, err := New(&Config{
+		Addr:    "http://localhost",
+		Logger:  slog.New(slog.NewTextHandler(&log, nil)),
+		Metrics: &metrics,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+
+	// The second response doesn't fit in the channel, so it's buffered.
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodOptions)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+	for i := 0; i < 2; i++ {
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(c) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.CreateInstance(context.Background(), service.InstanceConfig{Service: inst.Service}, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		fmt.Sprintf("suspend 0 1 %d", len(snapshot)),
+		fmt.Sprintf("resume 0 1 %d", len(snapshot)),
+	}
+	if fmt.Sprint(metrics.observations) != fmt.Sprint(expect) {
+		t.Error(metrics.observations)
+	}
+
+	for _, line := range []string{
+		fmt.Sprintf(`msg="localhost instance suspended" requests=0 unsent=1 snapshot_size=%d`, len(snapshot)),
+		fmt.Sprintf(`msg="localhost instance resumed" requests=0 unsent=1 snapshot_size=%d`, len(snapshot)),
+	} {
+		if !strings.Contains(log.String(), line) {
+			t.Errorf("missing: %s", line)
+		}
+	}
+}
+
+func TestStreamBackpressure(t *testing.T) {
+	const chunkSize = 1000
+
+	var read int64 // Atomic.
+
+	local, err := New(&Config{Addr: "http://localhost", StreamChunkSize: chunkSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.backends[""].client = &http.Client{
+		Transport: testRoundTripper(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        make(http.Header),
+				Body:          ioutil.NopCloser(&endlessReader{req.Context(), &read}),
+				ContentLength: -1,
+				Request:       req,
+			}, nil
+		}),
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+	defer inst.Shutdown(context.Background())
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	if r := flat.GetRootAsResponse(<-c, packet.HeaderSize); r.BodyStreamId() < 0 {
+		t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+	}
+
+	// Slow consumer.
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+
+		// Received chunks, one in the send channel, one being sent, and one
+		// waiting.  (Plus a byte which was read while checking for inline
+		// body.)
+		if n := atomic.LoadInt64(&read); n > int64(i+3)*chunkSize+1 {
+			t.Fatalf("%d bytes read ahead after %d packets", n, i)
+		}
+		if p := <-c; p.Domain() != packet.DomainData {
+			t.Fatal(p.Domain())
+		}
+	}
+}
+
+type testRoundTripper func(*http.Request) (*http.Response, error)
+
+func (f testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// endlessReader returns zeros until the context is done.
+type endlessReader struct {
+	ctx  context.Context
+	read *int64 // Atomic.
+}
+
+func (r *endlessReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	atomic.AddInt64(r.read, int64(len(b)))
+	return len(b), nil
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	const (
+		rate      = 256 * 1024
+		chunkSize = 16 * 1024
+		size      = 128 * 1024
+	)
+
+	content := bytes.Repeat([]byte("x"), size)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		MaxBytesPerSecond: rate,
+		StreamChunkSize:   chunkSize,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+
+	r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	if r.BodyStreamId() < 0 {
+		t.Fatal("body was not streamed")
+	}
+
+	var received int
+	for {
+		d := packet.DataBuf(<-c)
+		if d.DataLen() == 0 {
+			break
+		}
+		if d.Note() == 0 {
+			received += d.DataLen()
+		}
+	}
+	elapsed := time.Since(start)
+
+	if received != size {
+		t.Error("received", received)
+	}
+
+	// The first chunk is a burst.
+	expect := time.Duration(size-chunkSize) * time.Second / rate
+	if elapsed < expect*9/10 || elapsed > expect*5 {
+		t.Errorf("%v elapsed; expected %v", elapsed, expect)
+	}
+}
+
+func TestStreamKeepAlive(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	resume := make(chan struct{})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "a")
+		w.(http.Flusher).Flush()
+		<-resume
+		fmt.Fprint(w, "b")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:         0,
+		StreamKeepAliveInterval: interval,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+
+	r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	id := r.BodyStreamId()
+	if id < 0 {
+		t.Fatal("body was not streamed")
+	}
+
+	var (
+		content    string
+		keepAlives int
+	)
+	for {
+		p := <-c
+		if p.Domain() == packet.DomainFlow {
+			flow := packet.FlowBuf(p)
+			if flow.Num() != 1 {
+				t.Fatal(flow.Num())
+			}
+			if flowID, increment := flow.Get(0); flowID != id || increment != 0 {
+				t.Fatal(flowID, increment)
+			}
+			if keepAlives++; keepAlives == 2 {
+				close(resume)
+			}
+			continue
+		}
+
+		d := packet.DataBuf(p)
+		if d.DataLen() == 0 {
+			break
+		}
+		if d.Note() == 0 {
+			content += string(d.Data())
+		}
+	}
+
+	if content != "ab" {
+		t.Errorf("%q", content)
+	}
+	if keepAlives < 2 {
+		t.Error("keep-alives:", keepAlives)
+	}
+
+	select {
+	case p := <-c:
+		t.Error("packet after final packet:", p.Domain())
+	case <-time.After(interval * 5):
+	}
+}
+
+func TestInlineBodyLimitZero(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "x")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: 0})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.BodyLength() != 0 || r.BodyStreamId() < 0 {
+		t.Error(r.BodyLength(), r.BodyStreamId())
+	}
+	if d := packet.DataBuf(<-c); string(d.Data()) != "x" {
+		t.Errorf("%q", d.Data())
+	}
+	if d := packet.DataBuf(<-c); d.Note() != streamNoteTrailers {
+		t.Error(d.Note())
+	}
+	if d := packet.DataBuf(<-c); d.DataLen() != 0 {
+		t.Error(d.DataLen())
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		config    time.Duration
+		requestMs uint32
+	}{
+		{50 * time.Millisecond, 0},
+		{0, 50},
+		{50 * time.Millisecond, 60000},
+	} {
+		inst, c := startTestInstance(t, s, &Config{RequestTimeout: x.config})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddTimeoutMs(b, x.requestMs)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case p = <-c:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v %dms: no response", x.config, x.requestMs)
+		}
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusGatewayTimeout {
+			t.Error(r.StatusCode())
+		}
+		if string(r.ErrorMessage()) != "timeout" {
+			t.Errorf("%q", r.ErrorMessage())
+		}
+	}
+}
+
+func TestConnectionRefused(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusServiceUnavailable {
+		t.Error(r.StatusCode())
+	}
+	if string(r.ErrorMessage()) != "connection refused" {
+		t.Errorf("%q", r.ErrorMessage())
+	}
+}
+
+func TestStreamedRequest(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), uploadWindow/8)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunked := len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		if chunked != (r.ContentLength < 0) {
+			t.Error(r.ContentLength, r.TransferEncoding)
+		}
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Error(len(b))
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer s.Close()
+
+	// Unknown length is sent using chunked encoding.
+	for _, contentLength := range []int64{int64(len(content)), -1} {
+		inst, c := startTestInstance(t, s, &Config{})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddBodyStreamId(b, 7)
+		flat.RequestAddContentLength(b, contentLength)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		for sent := 0; ; {
+			p := <-c
+			if p.Domain() == packet.DomainCall {
+				r := flat.GetRootAsResponse(p, packet.HeaderSize)
+				if r.StatusCode() != http.StatusAccepted {
+					t.Error(r.StatusCode())
+				}
+				if r.UploadedBytes() != int64(len(content)) {
+					t.Error("uploaded bytes:", r.UploadedBytes())
+				}
+				break
+			}
+
+			id, increment := packet.FlowBuf(p).Get(0)
+			if id != 7 {
+				t.Fatal(id)
+			}
+
+			for increment > 0 && sent < len(content) {
+				n := int(increment)
+				if n > 1000 {
+					n = 1000
+				}
+				if n > len(content)-sent {
+					n = len(content) - sent
+				}
+
+				d := packet.MakeData(testCode, 7, n)
+				copy(d.Data(), content[sent:])
+				if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+					t.Fatal(err)
+				}
+				sent += n
+				increment -= int32(n)
+
+				if sent == len(content) {
+					eof := packet.MakeData(testCode, 7, 0)
+					if err := inst.Handle(context.Background(), c, packet.Buf(eof)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%v %d %s", r.Close, r.ContentLength, data)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: DefaultInlineBodyLimit})
+
+	for _, x := range []struct {
+		version  string
+		streamed bool
+		expect   bool
+		status   uint16
+		result   string
+	}{
+		{"", false, false, http.StatusOK, "false 5 hello"},
+		{"1.1", false, false, http.StatusOK, "false 5 hello"},
+		{"1.1", true, false, http.StatusOK, "false -1 hello"},
+		{"1.0", false, false, http.StatusOK, "true 5 hello"},
+		{"1.0", true, false, http.StatusLengthRequired, ""},
+		{"1.0", false, true, http.StatusBadRequest, ""},
+		{"2", false, false, http.StatusBadRequest, ""},
+		{"1.2", false, false, http.StatusBadRequest, ""},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString("/")
+		version := b.CreateString(x.version)
+		var body flatbuffers.UOffsetT
+		if !x.streamed {
+			body = b.CreateByteVector([]byte("hello"))
+		}
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddHttpVersion(b, version)
+		if x.streamed {
+			flat.RequestAddBodyStreamId(b, 7)
+			flat.RequestAddContentLength(b, -1)
+		} else {
+			flat.RequestAddBody(b, body)
+		}
+		flat.RequestAddExpectContinue(b, x.expect)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		if x.streamed {
+			if p := <-c; p.Domain() != packet.DomainFlow {
+				t.Fatal(p.Domain())
+			}
+			for _, data := range []string{"hello", ""} {
+				d := packet.MakeData(testCode, 7, len(data))
+				copy(d.Data(), data)
+				if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for {
+			p = <-c
+			if p.Domain() == packet.DomainCall {
+				break
+			}
+		}
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%+v: %d %s", x, r.StatusCode(), r.ErrorMessage())
+		}
+		if x.status == http.StatusOK && string(r.BodyBytes()) != x.result {
+			t.Errorf("%+v: %q", x, r.BodyBytes())
+		}
+	}
+}
+
+func TestUploadedBytes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	for _, content := range []string{"", "hello, world"} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPut)
+		uri := b.CreateString("/")
+		var body flatbuffers.UOffsetT
+		if content != "" {
+			body = b.CreateByteString([]byte(content))
+		}
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if body != 0 {
+			flat.RequestAddBody(b, body)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode())
+		}
+		if r.UploadedBytes() != int64(len(content)) {
+			t.Errorf("%q: uploaded bytes: %d", content, r.UploadedBytes())
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	content := []byte("hello, world")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("Expect: %q", r.Header.Get("Expect"))
+		}
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		b, err := ioutil.ReadAll(r.Body) // Sends 100 Continue.
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("%q", b)
+		}
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		path   string
+		status uint16
+	}{
+		{"/reject", http.StatusExpectationFailed},
+		{"/accept", http.StatusOK},
+	} {
+		local, err := New(&Config{
+			Addr:                  s.URL,
+			ExpectContinueTimeout: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPut)
+		uri := b.CreateString(x.path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddBodyStreamId(b, 7)
+		flat.RequestAddContentLength(b, int64(len(content)))
+		flat.RequestAddExpectContinue(b, true)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		var uploaded bool
+		for {
+			p := <-c
+			if p.Domain() == packet.DomainCall {
+				r := flat.GetRootAsResponse(p, packet.HeaderSize)
+				if r.StatusCode() != x.status {
+					t.Errorf("%s: status %d", x.path, r.StatusCode())
+				}
+				break
+			}
+
+			// Flow is granted only after the backend has accepted.
+			if x.status != http.StatusOK {
+				t.Fatalf("%s: %v packet", x.path, p.Domain())
+			}
+			if !uploaded {
+				d := packet.MakeData(testCode, 7, len(content))
+				copy(d.Data(), content)
+				if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+					t.Fatal(err)
+				}
+				if err := inst.Handle(context.Background(), c, packet.Buf(packet.MakeData(testCode, 7, 0))); err != nil {
+					t.Fatal(err)
+				}
+				uploaded = true
+			}
+		}
+	}
+}
+
+func TestMaxRequestBodySize(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("backend was contacted")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{MaxRequestBodySize: 10})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodPost)
+	uri := b.CreateString("/")
+	body := b.CreateByteVector(make([]byte, 11))
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBody(b, body)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	if r := flat.GetRootAsResponse(p, packet.HeaderSize); r.StatusCode() != http.StatusRequestEntityTooLarge {
+		t.Error(r.StatusCode())
+	}
+}
+
+func TestAbandonedStreamedRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodPut)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBodyStreamId(b, 0)
+	flat.RequestAddContentLength(b, 100)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-c; p.Domain() != packet.DomainFlow {
+		t.Fatal(p)
+	}
+
+	d := packet.MakeData(testCode, 0, 10)
+	if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inst.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shutdown timeout")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header["X-Test"]; len(v) != 2 || v[0] != "a" || v[1] != "b" {
+			t.Errorf("%q", v)
+		}
+		if v := r.Header.Get("Accept"); v != "text/plain" {
+			t.Errorf("%q", v)
+		}
+		if v := r.Header.Get("Upgrade"); v != "" {
+			t.Errorf("%q", v)
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	headers := buildTestHeaders(b, "x-test", "a", "Accept", "text/plain", "Upgrade", "foo", "X-Test", "b")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddHeaders(b, headers)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	if r := flat.GetRootAsResponse(p, packet.HeaderSize); r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+}
+
+func TestRequestHostHeader(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("backend was contacted")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	headers := buildTestHeaders(b, "Host", "example.net")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddHeaders(b, headers)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	if r := flat.GetRootAsResponse(p, packet.HeaderSize); r.StatusCode() != http.StatusBadRequest {
+		t.Error(r.StatusCode())
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	var host string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer s.Close()
+
+	backendHost := strings.TrimPrefix(s.URL, "http://")
+
+	for _, x := range []struct {
+		config Config
+		uri    string
+		host   string
+	}{
+		{Config{}, "//guest/", backendHost},
+		{Config{}, "/", backendHost},
+		{Config{OverrideHost: "backend.test"}, "//guest/", "backend.test"},
+		{Config{AllowGuestHost: true}, "//guest/", "guest"},
+		{Config{AllowGuestHost: true}, "/", backendHost},
+		{Config{AllowGuestHost: true, OverrideHost: "backend.test:8080"}, "/", "backend.test:8080"},
+	} {
+		inst, c := startTestInstance(t, s, &x.config)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(x.uri)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		host = ""
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		if r := flat.GetRootAsResponse(<-c, packet.HeaderSize); r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode())
+		}
+		if host != x.host {
+			t.Errorf("allow %v, override %q, uri %q: %q", x.config.AllowGuestHost, x.config.OverrideHost, x.uri, host)
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, OverrideHost: "bad/host"}); err == nil {
+		t.Error("invalid override host was accepted")
+	}
+}
+
+func TestRequestMethod(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" {
+			t.Error(r.Method)
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{AllowedMethods: []string{http.MethodGet, "PROPFIND"}})
+
+	for method, status := range map[string]uint16{
+		"PROPFIND":         http.StatusOK,
+		http.MethodPost:    http.StatusMethodNotAllowed,
+		http.MethodTrace:   http.StatusMethodNotAllowed,
+		http.MethodConnect: http.StatusMethodNotAllowed,
+		"":                 http.StatusBadRequest,
+		"GET /":            http.StatusBadRequest,
+		"GET\r\nX-Foo: x":  http.StatusBadRequest,
+	} {
+		b := flatbuffers.NewBuilder(0)
+		methodString := b.CreateString(method)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, methodString)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		if r := flat.GetRootAsResponse(p, packet.HeaderSize); r.StatusCode() != status {
+			t.Errorf("%q: %d", method, r.StatusCode())
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	if _, err := New(&Config{Addr: s.URL, AllowedSchemes: []string{"ftp"}}); err == nil {
+		t.Error("ftp scheme accepted")
+	}
+
+	local, err := New(&Config{
+		Addr:           "http://" + s.Listener.Addr().String(),
+		AllowedSchemes: []string{"https"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.backends[""].client = s.Client()
+
+	inst, c := startTestLocalInstance(t, local)
+
+	for _, x := range []struct {
+		scheme string
+		status uint16
+		errMsg string
+	}{
+		{"https", http.StatusOK, ""},
+		{"ftp", http.StatusBadRequest, "scheme not allowed"},
+		{"", http.StatusBadRequest, ""}, // Plain HTTP sent to HTTPS server.
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/x")
+		scheme := b.CreateString(x.scheme)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if x.scheme != "" {
+			flat.RequestAddScheme(b, scheme)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != x.status || string(r.ErrorMessage()) != x.errMsg {
+			t.Errorf("scheme %q: %d %q", x.scheme, r.StatusCode(), r.ErrorMessage())
+		}
+		if r.StatusCode() == http.StatusOK && string(r.FinalUri()) != "/x" {
+			t.Errorf("scheme %q: final URI %q", x.scheme, r.FinalUri())
+		}
+	}
+}
+
+func TestNamedBackend(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("default backend was contacted")
+	}))
+	defer s.Close()
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer other.Close()
+
+	inst, c := startTestInstance(t, s, &Config{Backends: map[string]string{"other": other.URL}})
+
+	for name, status := range map[string]uint16{
+		"other": http.StatusNoContent,
+		"bogus": http.StatusBadRequest,
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		backend := b.CreateString(name)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddBackend(b, backend)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		if r := flat.GetRootAsResponse(p, packet.HeaderSize); r.StatusCode() != status {
+			t.Errorf("%s: %d", name, r.StatusCode())
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/c":
+			http.Redirect(w, r, "/a", http.StatusMovedPermanently)
+		case "/b":
+			w.WriteHeader(http.StatusNoContent)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, "http://example.invalid/", http.StatusFound)
+		}
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		max      int
+		path     string
+		status   uint16
+		finalURI string
+		chain    string
+	}{
+		{0, "/a?x=1", http.StatusFound, "/a?x=1", ""},
+		{1, "/a", http.StatusNoContent, "/b", "302 /a"},
+		{2, "/c", http.StatusNoContent, "/b", "301 /c, 302 /a"},
+		{1, "/c", http.StatusFound, "/a", "301 /c"},
+		{5, "/loop", http.StatusLoopDetected, "", ""},
+		{5, "/external", http.StatusFound, "/external", ""},
+	} {
+		inst, c := startTestInstance(t, s, &Config{MaxRedirects: x.max})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(x.path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%d %s: %d", x.max, x.path, r.StatusCode())
+		}
+		if x.status == http.StatusFound && testResponseHeader(r).Get("Location") == "" {
+			t.Errorf("%d %s: no location", x.max, x.path)
+		}
+		if string(r.FinalUri()) != x.finalURI {
+			t.Errorf("%d %s: final URI %q", x.max, x.path, r.FinalUri())
+		}
+
+		var chain []string
+		for i := 0; i < r.RedirectChainLength(); i++ {
+			var hop flat.Redirect
+			r.RedirectChain(&hop, i)
+			chain = append(chain, fmt.Sprintf("%d %s", hop.StatusCode(), hop.Uri()))
+		}
+		if s := strings.Join(chain, ", "); s != x.chain {
+			t.Errorf("%d %s: redirect chain %q", x.max, x.path, s)
+		}
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location := r.URL.Query().Get("location")
+		if location == "self" {
+			location = s.URL + "/full"
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	for _, x := range []struct {
+		location string
+		expect   string
+	}{
+		{"c", "/a/c"},
+		{"../x?y=1", "/x?y=1"},
+		{"/abs", "/abs"},
+		{"c#frag", "/a/c#frag"},
+		{"self", "/full"},
+		{"http://example.invalid/z", "http://example.invalid/z"},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/a/b?location=" + url.QueryEscape(x.location))
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if r.StatusCode() != http.StatusFound {
+			t.Errorf("%q: status %d", x.location, r.StatusCode())
+		}
+		if v := testResponseHeader(r).Get("Location"); v != x.expect {
+			t.Errorf("%q: Location %q", x.location, v)
+		}
+	}
+}
+
+func TestServiceCredentials(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			t.Errorf("%q", r.Header["Authorization"])
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{BasicAuth: &BasicAuth{"user", "secret"}})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	headers := buildTestHeaders(b, "Authorization", "Bearer guest")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddHeaders(b, headers)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	if bytes.Contains(p, []byte("secret")) || bytes.Contains(p, []byte("dXNlcjpzZWNyZXQ=")) {
+		t.Error("credentials leaked to program")
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"x"`)
+		w.Header().Add("X-Test", "a")
+		w.Header().Add("X-Test", "b")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if string(r.ContentType()) != "text/plain" {
+		t.Errorf("%q", r.ContentType())
+	}
+
+	h := testResponseHeader(r)
+	if v := h["X-Test"]; len(v) != 2 || v[0] != "a" || v[1] != "b" {
+		t.Errorf("%q", v)
+	}
+	if v := h.Get("Etag"); v != `"x"` {
+		t.Errorf("%q", v)
+	}
+	if v := h.Get("Content-Type"); v != "text/plain" {
+		t.Errorf("%q", v)
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("ETag", `"x"`)
+		w.Header().Add("X-Test", "a")
+		w.Header().Add("X-Test", "b")
+	}))
+	defer s.Close()
+
+	// Content-Type (22 bytes) is counted first, then the others in order:
+	// Content-Length (15), Date (33), Etag (7), X-Test (7 + 7).
+	for _, x := range []struct {
+		limit     int64
+		truncated bool
+		etag      bool
+		tests     int
+	}{
+		{0, false, true, 2},
+		{91, false, true, 2},
+		{90, true, true, 1},
+		{77, true, true, 0},
+		{76, true, false, 0},
+		{1, true, false, 0},
+	} {
+		inst, c := startTestInstance(t, s, &Config{MaxResponseHeaderBytes: x.limit})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if r.HeadersTruncated() != x.truncated {
+			t.Errorf("limit %d: truncated: %v", x.limit, r.HeadersTruncated())
+		}
+		if string(r.ContentType()) != "text/plain" {
+			t.Errorf("limit %d: content type: %q", x.limit, r.ContentType())
+		}
+
+		h := testResponseHeader(r)
+		if v := h.Get("Content-Type"); v != "text/plain" {
+			t.Errorf("limit %d: Content-Type: %q", x.limit, v)
+		}
+		if etag := h.Get("Etag") != ""; etag != x.etag {
+			t.Errorf("limit %d: Etag: %v", x.limit, etag)
+		}
+		if n := len(h["X-Test"]); n != x.tests {
+			t.Errorf("limit %d: %d X-Test values", x.limit, n)
+		}
+	}
+}
+
+func TestMaxResponseHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("ETag", `"x"`)
+		w.Header().Add("X-Test", "a")
+		w.Header().Add("X-Test", "b")
+	}))
+	defer s.Close()
+
+	// Content-Type is counted first, then the others in order: Content-Length,
+	// Date, Etag, X-Test, X-Test.
+	for _, x := range []struct {
+		limit     int
+		truncated bool
+		etag      bool
+		tests     int
+	}{
+		{0, false, true, 2},
+		{6, false, true, 2},
+		{5, true, true, 1},
+		{4, true, true, 0},
+		{3, true, false, 0},
+		{1, true, false, 0},
+	} {
+		inst, c := startTestInstance(t, s, &Config{MaxResponseHeaders: x.limit})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if r.HeadersTruncated() != x.truncated {
+			t.Errorf("limit %d: truncated: %v", x.limit, r.HeadersTruncated())
+		}
+
+		h := testResponseHeader(r)
+		if v := h.Get("Content-Type"); v != "text/plain" {
+			t.Errorf("limit %d: Content-Type: %q", x.limit, v)
+		}
+		if etag := h.Get("Etag") != ""; etag != x.etag {
+			t.Errorf("limit %d: Etag: %v", x.limit, etag)
+		}
+		if n := len(h["X-Test"]); n != x.tests {
+			t.Errorf("limit %d: %d X-Test values", x.limit, n)
+		}
+	}
+}
+
+func TestMaxRequestHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, len(r.Header["X-Test"]))
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:   DefaultInlineBodyLimit,
+		MaxRequestHeaders: 2,
+	})
+
+	for _, x := range []struct {
+		headers []string
+		status  int
+	}{
+		{nil, http.StatusOK},
+		{[]string{"X-Test", "a", "X-Test", "b"}, http.StatusOK},
+		{[]string{"X-Test", "a", "X-Test", "b", "X-Test", "c"}, http.StatusBadRequest},
+		{[]string{"X-Test", "a", "X-Test", "b", "Connection", "close"}, http.StatusBadRequest},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		headers := buildTestHeaders(b, x.headers...)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddHeaders(b, headers)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if int(r.StatusCode()) != x.status {
+			t.Errorf("%q: status %d: %s", x.headers, r.StatusCode(), r.ErrorMessage())
+		}
+		if x.status == http.StatusOK {
+			if body := string(r.BodyBytes()); body != strconv.Itoa(len(x.headers)/2) {
+				t.Errorf("%q: body %q", x.headers, body)
+			}
+		}
+	}
+}
+
+func TestParseErrorBodies(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+		fmt.Fprint(w, r.URL.Query().Get("body"))
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		path        string
+		status      int
+		contentType string
+		body        string
+		message     string
+	}{
+		{"", 400, "application/json", `{"message":"bad input"}`, "bad input"},
+		{"", 500, "application/problem+json", `{"error":"oops"}`, "oops"},
+		{"", 503, "application/json; charset=utf-8", `{"error":{"message":"down"}}`, "down"},
+		{"", 400, "application/json", `{"message":"","error":"empty message"}`, "empty message"},
+		{"", 400, "application/json", `{"detail":"unknown"}`, ""},
+		{"", 400, "application/json", `["message"]`, ""},
+		{"", 400, "application/json", `{"message":`, ""},
+		{"", 400, "text/plain", `{"message":"not json"}`, ""},
+		{"", 200, "application/json", `{"message":"success"}`, ""},
+		{"error.detail", 422, "application/json", `{"message":"x","error":{"detail":"invalid field"}}`, "invalid field"},
+		{"error.detail", 422, "application/json", `{"message":"x"}`, ""},
+	} {
+		inst, c := startTestInstance(t, s, &Config{
+			InlineBodyLimit:  DefaultInlineBodyLimit,
+			ParseErrorBodies: true,
+			ErrorMessagePath: x.path,
+		})
+
+		query := url.Values{
+			"status": {strconv.Itoa(x.status)},
+			"type":   {x.contentType},
+			"body":   {x.body},
+		}
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/?" + query.Encode())
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if int(r.StatusCode()) != x.status {
+			t.Errorf("%s: status %d", x.body, r.StatusCode())
+		}
+		if string(r.ErrorMessage()) != x.message {
+			t.Errorf("%s: error message %q", x.body, r.ErrorMessage())
+		}
+		if string(r.BodyBytes()) != x.body {
+			t.Errorf("%s: body %q", x.body, r.BodyBytes())
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, ErrorMessagePath: "error..message"}); err == nil {
+		t.Error("invalid error message path accepted")
+	}
+}
+
+func TestParseErrorBodySize(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		message, _ := strconv.Atoi(r.URL.Query().Get("message"))
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		body := fmt.Sprintf(`{"message":"%s","pad":""}`, strings.Repeat("x", message))
+		body = body[:len(body)-2] + strings.Repeat("y", size-len(body)) + `"}`
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, body)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:  testMaxSendSize,
+		ParseErrorBodies: true,
+	})
+
+	call := func(message, size int) *flat.Response {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(fmt.Sprintf("/?message=%d&size=%d", message, size))
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+		if len(p) > testMaxSendSize {
+			t.Fatalf("body size %d: packet size %d", size, len(p))
+		}
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.BodyStreamId() >= 0 {
+			for {
+				if d := packet.DataBuf(<-c); d.DataLen() == 0 && d.Note() == 0 {
+					break
+				}
+			}
+		}
+		return r
+	}
+
+	if r := call(1000, 2000); string(r.ErrorMessage()) != strings.Repeat("x", maxErrorMessageSize) {
+		t.Errorf("error message length %d", len(r.ErrorMessage()))
+	}
+
+	// The message is omitted if it doesn't fit next to an inline body.
+	for size := testMaxSendSize - 1000; size < testMaxSendSize; size += 7 {
+		r := call(400, size)
+		if r.BodyStreamId() < 0 && len(r.ErrorMessage()) != 0 && len(r.ErrorMessage()) != 400 {
+			t.Errorf("body size %d: error message length %d", size, len(r.ErrorMessage()))
+		}
+	}
+}
+
+func TestMaxResponseBodySize(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			w.Write(content[:1])
+			w.(http.Flusher).Flush()
+			w.Write(content[1:])
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content)
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:     100,
+		MaxResponseBodySize: 1000,
+	})
+
+	for _, path := range []string{"/", "/chunked"} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Error(path, r.StatusCode())
+		}
+		if r.Truncated() != (path == "/") {
+			t.Error(path, "truncated flag:", r.Truncated())
+		}
+		id := r.BodyStreamId()
+		if id < 0 {
+			t.Fatal(path, id)
+		}
+
+		var body []byte
+		for {
+			p := packet.DataBuf(<-c)
+			if p.ID() != id {
+				t.Fatal(path, p)
+			}
+			if p.DataLen() == 0 {
+				if p.Note() != streamNoteTruncated {
+					t.Error(path, "note:", p.Note())
+				}
+				break
+			}
+			if p.Note() != streamNoteTrailers {
+				body = append(body, p.Data()...)
+			}
+		}
+		if !bytes.Equal(body, content[:1000]) {
+			t.Error(path, len(body))
+		}
+	}
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	inst.local.maxResponseBody = 50
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if !r.Truncated() {
+		t.Error("inline response not truncated")
+	}
+	if r.BodyStreamId() >= 0 {
+		t.Error(r.BodyStreamId())
+	}
+	if !bytes.Equal(r.BodyBytes(), content[:50]) {
+		t.Error(r.BodyLength())
+	}
+}
+
+func TestPartialResponseBody(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n")
+		if r.URL.Path == "/partial" {
+			buf.WriteString("hello")
+		}
+		buf.Flush()
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+
+	for _, path := range []string{"/partial", "/empty"} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if len(r.ErrorMessage()) == 0 {
+			t.Error(path, "no error message")
+		}
+
+		if path == "/partial" {
+			if r.StatusCode() != http.StatusOK {
+				t.Error(path, r.StatusCode())
+			}
+			if !r.Truncated() {
+				t.Error(path, "not truncated")
+			}
+			if s := string(r.BodyBytes()); s != "hello" {
+				t.Error(path, s)
+			}
+		} else {
+			if r.StatusCode() != http.StatusBadGateway {
+				t.Error(path, r.StatusCode())
+			}
+			if r.BodyLength() != 0 {
+				t.Error(path, r.BodyLength())
+			}
+		}
+	}
+}
+
+func TestRangeRequest(t *testing.T) {
+	const content = "hello, world"
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(content))
+		w.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "test.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:     DefaultInlineBodyLimit,
+		MaxResponseBodySize: 8,
+		BodyChecksums:       true,
+		TranscodeToUTF8:     true,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/test.txt")
+	headers := buildTestHeaders(b, "Range", "bytes=7-11")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddHeaders(b, headers)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+	if r.StatusCode() != http.StatusPartialContent {
+		t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	if string(r.BodyBytes()) != "world" {
+		t.Errorf("body: %q", r.BodyBytes())
+	}
+	if r.Truncated() {
+		t.Error("truncated")
+	}
+	h := testResponseHeader(r)
+	if v := h.Get("Content-Range"); v != "bytes 7-11/12" {
+		t.Errorf("Content-Range: %q", v)
+	}
+	if v := h.Get("Accept-Ranges"); v != "bytes" {
+		t.Errorf("Accept-Ranges: %q", v)
+	}
+	if v := h.Get("Content-Length"); v != "5" {
+		t.Errorf("Content-Length: %q", v)
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Error(r.Method)
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "12345")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodHead)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+	if s := string(r.ContentType()); s != "text/plain" {
+		t.Error(s)
+	}
+	if r.ContentLength() != 12345 {
+		t.Error(r.ContentLength())
+	}
+	if r.BodyStreamId() >= 0 {
+		t.Error(r.BodyStreamId())
+	}
+	if r.BodyLength() != 0 {
+		t.Error(r.BodyLength())
+	}
+
+	select {
+	case p := <-c:
+		t.Error(p)
+	default:
+	}
+}
+
+func TestCookies(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			http.SetCookie(w, &http.Cookie{Name: "scoped", Value: "x", Path: "/other"})
+
+		default:
+			for _, c := range r.Cookies() {
+				fmt.Fprintf(w, "%s=%s;", c.Name, c.Value)
+			}
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		EnableCookies:   true,
+	})
+
+	get := func(inst service.Instance, path string) string {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Fatal(path, r.StatusCode())
+		}
+		return string(r.BodyBytes())
+	}
+
+	if s := get(inst, "/whoami"); s != "" {
+		t.Error(s)
+	}
+	get(inst, "/login")
+	if s := get(inst, "/whoami"); s != "session=abc;" {
+		t.Error(s)
+	}
+	if s := get(inst, "/other/page"); s != "scoped=x;session=abc;" {
+		t.Error(s)
+	}
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	}
+	resumed, err := inst.local.CreateInstance(context.Background(), config, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Start(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := get(resumed, "/whoami"); s != "session=abc;" {
+		t.Error("resumed:", s)
+	}
+
+	b := flatbuffers.NewBuilder(0)
+	flat.ClearCookiesStart(b)
+	function := flat.ClearCookiesEnd(b)
+	flat.CallStart(b)
+	flat.CallAddFunctionType(b, flat.FunctionClearCookies)
+	flat.CallAddFunction(b, function)
+	b.Finish(flat.CallEnd(b))
+
+	p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+	copy(p.Content(), b.FinishedBytes())
+
+	if err := resumed.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusNoContent {
+		t.Error(r.StatusCode(), string(r.ErrorMessage()))
+	}
+
+	if s := get(resumed, "/whoami"); s != "" {
+		t.Error("cleared:", s)
+	}
+
+	// Version 1 snapshots have no cookies.
+	v1 := []byte(snapshotMagic + "\x01\x00\x00\x00")
+	if _, err := inst.local.CreateInstance(context.Background(), config, v1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Length", "2")
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("y"))
+	}))
+	defer s.Close()
+
+	for _, inlineLimit := range []int64{0, DefaultInlineBodyLimit} {
+		inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: inlineLimit})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.TtfbMs() < 20 {
+			t.Error(inlineLimit, "ttfb:", r.TtfbMs())
+		}
+
+		duration := r.DurationMs()
+		if id := r.BodyStreamId(); id >= 0 {
+			if duration != 0 {
+				t.Error(inlineLimit, "streamed response duration:", duration)
+			}
+			for {
+				p := packet.DataBuf(<-c)
+				if p.DataLen() == 0 {
+					break
+				}
+				if p.Note() == streamNoteTrailers {
+					duration = flat.GetRootAsTrailers(p.Data(), 0).DurationMs()
+				}
+			}
+		}
+		if duration < 40 || duration < r.TtfbMs() {
+			t.Error(inlineLimit, "duration:", duration)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	const etag = `"v1"`
+	modified := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer s.Close()
+
+	for _, inlineLimit := range []int64{0, DefaultInlineBodyLimit} {
+		inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: inlineLimit})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		headers := buildTestHeaders(b, "If-None-Match", etag)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddHeaders(b, headers)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusNotModified {
+			t.Error(inlineLimit, r.StatusCode())
+		}
+		if r.BodyStreamId() >= 0 || r.BodyLength() != 0 {
+			t.Error(inlineLimit, r.BodyStreamId(), r.BodyLength())
+		}
+		h := testResponseHeader(r)
+		if s := h.Get("ETag"); s != etag {
+			t.Error(inlineLimit, s)
+		}
+		if s := h.Get("Last-Modified"); s != modified {
+			t.Error(inlineLimit, s)
+		}
+
+		select {
+		case p := <-c:
+			t.Error(inlineLimit, p)
+		default:
+		}
+	}
+}
+
+func TestTranscodeToUTF8(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latin1":
+			w.Header().Set("Content-Type", "text/plain; charset=ISO-8859-1")
+			w.Write([]byte("caf\xe9"))
+
+		case "/bom":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("\xff\xfec\x00a\x00f\x00\xe9\x00"))
+
+		case "/utf8":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`"café"`))
+
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("caf\xe9"))
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		TranscodeToUTF8: true,
+	})
+
+	for _, x := range []struct {
+		path        string
+		body        string
+		contentType string
+	}{
+		{"/latin1", "café", "text/plain; charset=utf-8"},
+		{"/bom", "café", "text/html; charset=utf-8"},
+		{"/utf8", `"café"`, "application/json; charset=utf-8"},
+		{"/binary", "caf\xe9", "application/octet-stream"},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(x.path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if s := string(r.BodyBytes()); s != x.body {
+			t.Errorf("%s: %q", x.path, s)
+		}
+		if s := string(r.ContentType()); s != x.contentType {
+			t.Errorf("%s: %q", x.path, s)
+		}
+		if x.path != "/utf8" && x.path != "/binary" && testResponseHeader(r).Get("Content-Length") != "" {
+			t.Errorf("%s: Content-Length header", x.path)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localhost-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := New(&Config{Addr: "unix://" + dir + "/missing"}); err == nil {
+		t.Error("missing socket accepted")
+	}
+	if _, err := New(&Config{Addr: "unix://" + dir}); err == nil {
+		t.Error("directory accepted as socket")
+	}
+
+	path := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	local, err := New(&Config{
+		Addr:            "unix://" + path,
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/foo/bar")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	if string(r.BodyBytes()) != "/foo/bar" {
+		t.Errorf("%q", r.BodyBytes())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("request encoding: %q", r.Header.Get("Content-Encoding"))
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Error(err)
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(bytes.ToUpper(data))
+		zw.Close()
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:     DefaultInlineBodyLimit,
+		DecompressResponses: true,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodPost)
+	uri := b.CreateString("/")
+	body := b.CreateByteVector([]byte("hello"))
+	headers := buildTestHeaders(b, "Accept-Encoding", "gzip")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBody(b, body)
+	flat.RequestAddHeaders(b, headers)
+	flat.RequestAddCompressBody(b, true)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	if string(r.BodyBytes()) != "HELLO" {
+		t.Errorf("%q", r.BodyBytes())
+	}
+	if v := testResponseHeader(r).Get("Content-Encoding"); v != "" {
+		t.Errorf("response encoding: %q", v)
+	}
+}
+
+func TestForwardClientEncoding(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			fmt.Fprint(w, "hello")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("hello"))
+		zw.Close()
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		acceptEncoding string
+		decompress     bool
+		sent           string
+		encoding       string
+	}{
+		{"", false, "", ""},
+		{"gzip", false, "gzip", "gzip"},
+		{"gzip", true, "gzip", ""},
+	} {
+		local, err := New(&Config{
+			Addr:                  s.URL,
+			InlineBodyLimit:       DefaultInlineBodyLimit,
+			DecompressResponses:   x.decompress,
+			ForwardClientEncoding: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		var headers flatbuffers.UOffsetT
+		if x.acceptEncoding != "" {
+			headers = buildTestHeaders(b, "Accept-Encoding", x.acceptEncoding)
+		}
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if headers != 0 {
+			flat.RequestAddHeaders(b, headers)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+		}
+
+		h := testResponseHeader(r)
+		if v := h.Get("X-Accept-Encoding"); v != x.sent {
+			t.Errorf("%+v: Accept-Encoding sent: %q", x, v)
+		}
+		if v := h.Get("Content-Encoding"); v != x.encoding {
+			t.Errorf("%+v: Content-Encoding: %q", x, v)
+		}
+
+		body := r.BodyBytes()
+		if x.encoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(body) != "hello" {
+			t.Errorf("%+v: %q", x, body)
+		}
+	}
+}
+
+func TestCompressRequestMinSize(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintf(w, "%q %d %s", r.Header.Get("Content-Encoding"), r.ContentLength, data)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:        DefaultInlineBodyLimit,
+		CompressRequestMinSize: 10,
+	})
+
+	for _, x := range []struct {
+		content       string
+		streamed      bool
+		contentLength int64
+		result        string
+	}{
+		{"short", false, 0, `"" 5 short`},
+		{"0123456789", false, 0, `"gzip" 35 0123456789`},
+		{"short", true, 5, `"" 5 short`},
+		{"0123456789", true, 10, `"gzip" -1 0123456789`},
+		{"short", true, -1, `"" 5 short`},
+		{"0123456789", true, -1, `"gzip" -1 0123456789`},
+		{"0123456789abcdef", true, -1, `"gzip" -1 0123456789abcdef`},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString("/")
+		var body flatbuffers.UOffsetT
+		if !x.streamed {
+			body = b.CreateByteVector([]byte(x.content))
+		}
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if x.streamed {
+			flat.RequestAddBodyStreamId(b, 7)
+			flat.RequestAddContentLength(b, x.contentLength)
+		} else {
+			flat.RequestAddBody(b, body)
+		}
+		flat.RequestAddCompressBody(b, true)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		if x.streamed {
+			if p := <-c; p.Domain() != packet.DomainFlow {
+				t.Fatal(p.Domain())
+			}
+			for _, data := range []string{x.content, ""} {
+				d := packet.MakeData(testCode, 7, len(data))
+				copy(d.Data(), data)
+				if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for {
+			p = <-c
+			if p.Domain() == packet.DomainCall {
+				break
+			}
+		}
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode(), string(r.ErrorMessage()))
+		}
+		if string(r.BodyBytes()) != x.result {
+			t.Errorf("%q %v %d: %s", x.content, x.streamed, x.contentLength, r.BodyBytes())
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, CompressRequestMinSize: -1}); err == nil {
+		t.Error("negative compress request min size accepted")
+	}
+}
+
+func TestRequestContentLength(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		fmt.Fprintf(w, "%d %q %s", r.ContentLength, r.TransferEncoding, data)
+	}))
+	defer s.Close()
+
+	var log bytes.Buffer
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		Logger:          slog.New(slog.NewTextHandler(&log, nil)),
+	})
+
+	for _, x := range []struct {
+		header        string
+		streamed      bool
+		contentLength int64
+		result        string
+		mismatch      bool
+	}{
+		{"", false, 0, `5 [] hello`, false},
+		{"5", false, 0, `5 [] hello`, false},
+		{"100", false, 0, `5 [] hello`, true},
+		{"", true, 5, `5 [] hello`, false},
+		{"5", true, 5, `5 [] hello`, false},
+		{"3", true, 5, `5 [] hello`, true},
+		{"", true, -1, `-1 ["chunked"] hello`, false},
+		{"5", true, -1, `-1 ["chunked"] hello`, true},
+	} {
+		log.Reset()
+
+		b := flatbuffers.NewBuilder(0)
+		var headers flatbuffers.UOffsetT
+		if x.header != "" {
+			headers = buildTestHeaders(b, "Content-Length", x.header)
+		}
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString("/")
+		var body flatbuffers.UOffsetT
+		if !x.streamed {
+			body = b.CreateByteVector([]byte("hello"))
+		}
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if headers != 0 {
+			flat.RequestAddHeaders(b, headers)
+		}
+		if x.streamed {
+			flat.RequestAddBodyStreamId(b, 7)
+			flat.RequestAddContentLength(b, x.contentLength)
+		} else {
+			flat.RequestAddBody(b, body)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		if x.streamed {
+			if p := <-c; p.Domain() != packet.DomainFlow {
+				t.Fatal(p.Domain())
+			}
+			for _, data := range []string{"hello", ""} {
+				d := packet.MakeData(testCode, 7, len(data))
+				copy(d.Data(), data)
+				if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for {
+			p = <-c
+			if p.Domain() == packet.DomainCall {
+				break
+			}
+		}
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode(), string(r.ErrorMessage()))
+		}
+		if string(r.BodyBytes()) != x.result {
+			t.Errorf("%q %v %d: %s", x.header, x.streamed, x.contentLength, r.BodyBytes())
+		}
+		if mismatch := strings.Contains(log.String(), "content length mismatch"); mismatch != x.mismatch {
+			t.Errorf("%q %v %d: mismatch logged: %v", x.header, x.streamed, x.contentLength, mismatch)
+		}
+	}
+}
+
+func TestAllowedPaths(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.EscapedPath())
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		AllowedPaths:    []string{"/api", "/static/"},
+	})
+
+	for _, x := range []struct {
+		uri    string
+		status uint16
+		path   string
+	}{
+		{"/api", http.StatusOK, "/api"},
+		{"/api/", http.StatusOK, "/api/"},
+		{"/api/x?y=z", http.StatusOK, "/api/x"},
+		{"/static/a/../b", http.StatusOK, "/static/b"},
+		{"/api//x", http.StatusOK, "/api/x"},
+		{"/apix", http.StatusForbidden, ""},
+		{"/static", http.StatusForbidden, ""},
+		{"/", http.StatusForbidden, ""},
+		{"/secret", http.StatusForbidden, ""},
+		{"/api/../secret", http.StatusForbidden, ""},
+		{"/api/%2e%2e/secret", http.StatusForbidden, ""},
+		{"/api/..%2fsecret", http.StatusForbidden, ""},
+		{"/static/../../api/../secret", http.StatusForbidden, ""},
+		{"api", http.StatusOK, "/api"},
+		{"../api/x", http.StatusOK, "/api/x"},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(x.uri)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%s: %d", x.uri, r.StatusCode())
+		}
+		if x.status == http.StatusOK && string(r.BodyBytes()) != x.path {
+			t.Errorf("%s: %q", x.uri, r.BodyBytes())
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, AllowedPaths: []string{"api"}}); err == nil {
+		t.Error("relative allowed path accepted")
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.EscapedPath())
+	}))
+	defer s.Close()
+
+	rewrite := func(p string) string {
+		switch {
+		case p == "/escape":
+			return "/api/v2/../../secret"
+		case strings.HasPrefix(p, "/legacy/"):
+			return strings.TrimPrefix(p, "/legacy")
+		default:
+			return "/api/v2" + p
+		}
+	}
+
+	for _, x := range []struct {
+		config *Config
+		uri    string
+		status uint16
+		path   string
+	}{
+		{&Config{}, "/x", http.StatusOK, "/x"},
+		{&Config{}, "/x/", http.StatusOK, "/x/"},
+		{&Config{RewritePath: rewrite}, "/x", http.StatusOK, "/api/v2/x"},
+		{&Config{RewritePath: rewrite}, "/x/", http.StatusOK, "/api/v2/x/"},
+		{&Config{RewritePath: rewrite}, "/legacy/y", http.StatusOK, "/y"},
+		{&Config{RewritePath: rewrite, AllowedPaths: []string{"/api/v2"}}, "/x?q=1", http.StatusOK, "/api/v2/x"},
+		{&Config{RewritePath: rewrite, AllowedPaths: []string{"/api/v2"}}, "/../x", http.StatusOK, "/api/v2/x"},
+		{&Config{RewritePath: rewrite, AllowedPaths: []string{"/api/v2"}}, "/legacy/api/v2/y", http.StatusOK, "/api/v2/y"},
+		{&Config{RewritePath: rewrite, AllowedPaths: []string{"/api/v2"}}, "/legacy/secret", http.StatusForbidden, ""},
+		{&Config{RewritePath: rewrite, AllowedPaths: []string{"/api/v2"}}, "/legacy/../legacy/secret", http.StatusForbidden, ""},
+		{&Config{RewritePath: rewrite, AllowedPaths: []string{"/api/v2"}}, "/escape", http.StatusForbidden, ""},
+	} {
+		x.config.InlineBodyLimit = DefaultInlineBodyLimit
+		inst, c := startTestInstance(t, s, x.config)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(x.uri)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%s: %d", x.uri, r.StatusCode())
+		}
+		if x.status == http.StatusOK && string(r.BodyBytes()) != x.path {
+			t.Errorf("%s: %q", x.uri, r.BodyBytes())
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer s.Close()
+
+	authorize := func(method, path string, header http.Header) (bool, string) {
+		switch {
+		case header.Get("Idempotency-Key") != "" || header.Get(DefaultRequestIDHeader) != "":
+			return false, "service header"
+		case header.Get("X-Role") == "admin":
+			return true, ""
+		case method != http.MethodGet:
+			return false, "read only"
+		case strings.HasPrefix(path, "/private/"):
+			return false, ""
+		default:
+			return true, ""
+		}
+	}
+
+	for _, x := range []struct {
+		config  *Config
+		method  string
+		uri     string
+		role    string
+		status  uint16
+		message string
+	}{
+		{&Config{}, http.MethodGet, "/private/x", "", http.StatusOK, ""},
+		{&Config{Authorize: authorize}, http.MethodGet, "/x", "", http.StatusOK, ""},
+		{&Config{Authorize: authorize}, http.MethodGet, "/private/x", "", http.StatusForbidden, "request not authorized"},
+		{&Config{Authorize: authorize}, http.MethodGet, "/public/../private/x", "", http.StatusForbidden, "request not authorized"},
+		{&Config{Authorize: authorize}, http.MethodPost, "/x", "", http.StatusForbidden, "read only"},
+		{&Config{Authorize: authorize}, http.MethodPost, "/private/x", "admin", http.StatusOK, ""},
+		{&Config{Authorize: authorize, DryRun: true}, http.MethodPost, "/x", "", http.StatusForbidden, "read only"},
+		{&Config{Authorize: authorize, GenerateRequestIDs: true}, http.MethodGet, "/x", "", http.StatusOK, ""},
+	} {
+		x.config.InlineBodyLimit = DefaultInlineBodyLimit
+		inst, c := startTestInstance(t, s, x.config)
+
+		b := flatbuffers.NewBuilder(0)
+		var headers flatbuffers.UOffsetT
+		if x.role != "" {
+			headers = buildTestHeaders(b, "X-Role", x.role)
+		}
+		method := b.CreateString(x.method)
+		uri := b.CreateString(x.uri)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if headers != 0 {
+			flat.RequestAddHeaders(b, headers)
+		}
+		flat.RequestAddAutoIdempotencyKey(b, true)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%s %s: %d", x.method, x.uri, r.StatusCode())
+		}
+		if string(r.ErrorMessage()) != x.message {
+			t.Errorf("%s %s: %q", x.method, x.uri, r.ErrorMessage())
+		}
+		if x.status == http.StatusOK && string(r.BodyBytes()) != path.Clean(x.uri) {
+			t.Errorf("%s %s: %q", x.method, x.uri, r.BodyBytes())
+		}
+	}
+}
+
+func TestAllowedResponseContentTypes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := r.URL.Query().Get("type"); t != "" {
+			w.Header().Set("Content-Type", t)
+		} else {
+			w.Header()["Content-Type"] = nil // Don't sniff.
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "content")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:             DefaultInlineBodyLimit,
+		AllowedResponseContentTypes: []string{"application/json", "Text/*"},
+	})
+
+	for _, x := range []struct {
+		contentType string
+		allowed     bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"APPLICATION/JSON", true},
+		{"text/plain", true},
+		{"text/html; charset=iso-8859-1", true},
+		{"application/octet-stream", false},
+		{"application/x-msdownload", false},
+		{"application/jsonx", false},
+		{"textual/plain", false},
+		{"", false},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/?type=" + url.QueryEscape(x.contentType))
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if r.StatusCode() != http.StatusAccepted {
+			t.Errorf("%q: status %d", x.contentType, r.StatusCode())
+		}
+		if r.ContentBlocked() == x.allowed {
+			t.Errorf("%q: content blocked: %v", x.contentType, r.ContentBlocked())
+		}
+		body := "content"
+		if !x.allowed {
+			body = ""
+		}
+		if string(r.BodyBytes()) != body || r.BodyStreamId() >= 0 {
+			t.Errorf("%q: body %q, stream %d", x.contentType, r.BodyBytes(), r.BodyStreamId())
+		}
+	}
+
+	for _, pattern := range []string{"json", "*/*", "text/*; charset=utf-8", "/plain"} {
+		if _, err := New(&Config{Addr: s.URL, AllowedResponseContentTypes: []string{pattern}}); err == nil {
+			t.Errorf("invalid pattern accepted: %q", pattern)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		method   string
+		retries  int
+		status   uint16
+		attempts int
+	}{
+		{http.MethodGet, 0, http.StatusServiceUnavailable, 1},
+		{http.MethodGet, 1, http.StatusServiceUnavailable, 2},
+		{http.MethodGet, 2, http.StatusOK, 3},
+		{http.MethodPut, 5, http.StatusOK, 3},
+		{http.MethodPost, 5, http.StatusServiceUnavailable, 1},
+	} {
+		attempts = 0
+
+		inst, c := startTestInstance(t, s, &Config{
+			MaxRetries:   x.retries,
+			RetryBackoff: time.Millisecond,
+		})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(x.method)
+		uri := b.CreateString("/")
+		body := b.CreateByteVector([]byte("data"))
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		if x.method != http.MethodGet {
+			flat.RequestAddBody(b, body)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%s %d: status %d", x.method, x.retries, r.StatusCode())
+		}
+		if attempts != x.attempts {
+			t.Errorf("%s %d: %d attempts", x.method, x.retries, attempts)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var keys []string
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		MaxRetries:   5,
+		RetryBackoff: time.Millisecond,
+	})
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	for _, x := range []struct {
+		key      string
+		auto     bool
+		status   uint16
+		attempts int
+	}{
+		{"", false, http.StatusServiceUnavailable, 1},
+		{"abc", false, http.StatusOK, 3},
+		{"abc", true, http.StatusOK, 3},
+		{"", true, http.StatusOK, 3},
+		{"a\nb", false, http.StatusBadRequest, 0},
+	} {
+		keys = nil
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString("/")
+		body := b.CreateByteVector([]byte("data"))
+		key := b.CreateString(x.key)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddBody(b, body)
+		flat.RequestAddIdempotencyKey(b, key)
+		flat.RequestAddAutoIdempotencyKey(b, x.auto)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if r.StatusCode() != x.status {
+			t.Errorf("%q %v: status %d", x.key, x.auto, r.StatusCode())
+		}
+		if len(keys) != x.attempts {
+			t.Errorf("%q %v: %d attempts", x.key, x.auto, len(keys))
+			continue
+		}
+		for _, k := range keys {
+			switch {
+			case x.key != "":
+				if k != x.key {
+					t.Errorf("%q %v: key %q", x.key, x.auto, k)
+				}
+			case x.auto:
+				if k != keys[0] || !uuid.MatchString(k) {
+					t.Errorf("%q %v: key %q", x.key, x.auto, k)
+				}
+			default:
+				if k != "" {
+					t.Errorf("%q %v: key %q", x.key, x.auto, k)
+				}
+			}
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get(r.URL.Query().Get("header")))
+	}))
+	defer s.Close()
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	for _, x := range []struct {
+		header   string
+		generate bool
+		id       string
+		guest    string // Header specified by program.
+		status   uint16
+		echo     string // "*" means generated.
+	}{
+		{"", false, "", "", http.StatusOK, ""},
+		{"", false, "abc", "", http.StatusOK, "abc"},
+		{"", false, "", "def", http.StatusOK, "def"},
+		{"", true, "abc", "def", http.StatusOK, "abc"},
+		{"", true, "", "", http.StatusOK, "*"},
+		{"x-correlation-id", false, "abc", "", http.StatusOK, "abc"},
+		{"", false, "a\nb", "", http.StatusBadRequest, ""},
+	} {
+		inst, c := startTestInstance(t, s, &Config{
+			InlineBodyLimit:    DefaultInlineBodyLimit,
+			RequestIDHeader:    x.header,
+			GenerateRequestIDs: x.generate,
+		})
+
+		header := x.header
+		if header == "" {
+			header = DefaultRequestIDHeader
+		}
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/?header=" + header)
+		id := b.CreateString(x.id)
+		var headers flatbuffers.UOffsetT
+		if x.guest != "" {
+			headers = buildTestHeaders(b, header, x.guest)
+		}
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddRequestId(b, id)
+		if headers != 0 {
+			flat.RequestAddHeaders(b, headers)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+
+		if r.StatusCode() != x.status {
+			t.Errorf("%q: status %d", x.id, r.StatusCode())
+			continue
+		}
+		if x.status != http.StatusOK {
+			continue
+		}
+
+		echo := string(r.RequestId())
+		if x.echo == "*" {
+			if !uuid.MatchString(echo) {
+				t.Errorf("generated request id: %q", echo)
+			}
+		} else if echo != x.echo {
+			t.Errorf("%q: request id %q", x.id, echo)
+		}
+		if string(r.BodyBytes()) != echo {
+			t.Errorf("%q: backend received %q", x.id, r.BodyBytes())
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, RequestIDHeader: "Host"}); err == nil {
+		t.Error("Host accepted as request id header")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, x := range []struct {
+		base    time.Duration
+		attempt int
+		delay   time.Duration
+	}{
+		{0, 100, 0},
+		{time.Second, 1, time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 7, time.Minute},
+		{time.Second, 1000, time.Minute},
+		{time.Hour, 5, time.Hour},
+	} {
+		if d := retryDelay(x.base, x.attempt); d != x.delay {
+			t.Errorf("%v %d: %v", x.base, x.attempt, d)
+		}
+	}
+}
+
+func TestRetryStreamedRequest(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100)
+
+	var attempts int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("attempt %d: %d bytes", attempts, len(b))
+		}
+
+		if attempts < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		replayLimit int64
+		status      uint16
+		attempts    int
+	}{
+		{int64(len(content)), http.StatusOK, 2},
+		{int64(len(content)) - 1, http.StatusServiceUnavailable, 1},
+	} {
+		attempts = 0
+
+		inst, c := startTestInstance(t, s, &Config{
+			MaxRetries:        2,
+			MaxReplayBodySize: x.replayLimit,
+		})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPut)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddBodyStreamId(b, 7)
+		flat.RequestAddContentLength(b, int64(len(content)))
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		if p := <-c; p.Domain() != packet.DomainFlow {
+			t.Fatal(p.Domain())
+		}
+
+		d := packet.MakeData(testCode, 7, len(content))
+		copy(d.Data(), content)
+		if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+			t.Fatal(err)
+		}
+		if err := inst.Handle(context.Background(), c, packet.Buf(packet.MakeData(testCode, 7, 0))); err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			p := <-c
+			if p.Domain() != packet.DomainCall {
+				continue
+			}
+			r := flat.GetRootAsResponse(p, packet.HeaderSize)
+			if r.StatusCode() != x.status {
+				t.Errorf("limit %d: status %d", x.replayLimit, r.StatusCode())
+			}
+			break
+		}
+		if attempts != x.attempts {
+			t.Errorf("limit %d: %d attempts", x.replayLimit, attempts)
+		}
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	const n = 5
+
+	arrived := make(chan struct{}, n)
+	release := make(chan struct{})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: DefaultInlineBodyLimit})
+
+	paths := make(map[string]bool)
+
+	for i := 0; i < n; i++ {
+		path := fmt.Sprintf("/%d", i)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		paths[path] = true
+	}
+
+	for i := 0; i < n; i++ {
+		<-arrived
+	}
+	close(release)
+
+	for i := 0; i < n; i++ {
+		p := <-c
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		path := string(r.BodyBytes())
+		if !paths[path] {
+			t.Fatalf("%q", path)
+		}
+		delete(paths, path)
+	}
+}
+
+func TestShutdownCancelsRequests(t *testing.T) {
+	arrived := make(chan struct{})
+	canceled := make(chan struct{})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	<-arrived
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inst.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not canceled")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	select {
+	case p := <-c:
+		t.Errorf("packet sent during shutdown: %v", p)
+	default:
+	}
+}
+
+func TestResponseTrailers(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("0123456789"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer s.Close()
+
+	for _, inlineLimit := range []int64{DefaultInlineBodyLimit, 5} {
+		inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: inlineLimit})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		var trailers []flat.Header
+
+		if id := r.BodyStreamId(); id < 0 {
+			for i := 0; i < r.TrailersLength(); i++ {
+				var h flat.Header
+				r.Trailers(&h, i)
+				trailers = append(trailers, h)
+			}
+		} else {
+			for {
+				p := packet.DataBuf(<-c)
+				if p.DataLen() == 0 {
+					break
+				}
+				if p.Note() == streamNoteTrailers {
+					tr := flat.GetRootAsTrailers(p.Data(), 0)
+					for i := 0; i < tr.TrailersLength(); i++ {
+						var h flat.Header
+						tr.Trailers(&h, i)
+						trailers = append(trailers, h)
+					}
+				}
+			}
+		}
+
+		if len(trailers) != 1 || string(trailers[0].Name()) != "X-Checksum" || string(trailers[0].Value()) != "abc" {
+			t.Errorf("inline limit %d: %d trailers", inlineLimit, len(trailers))
+		}
+	}
+}
+
+func TestResponseTrailersSize(t *testing.T) {
+	names := []string{"X-A", "X-B", "X-C", "X-D"}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		trailer, _ := strconv.Atoi(r.URL.Query().Get("trailer"))
+		w.Header().Set("Trailer", strings.Join(names, ", "))
+		w.Write(bytes.Repeat([]byte("x"), size))
+		for _, name := range names {
+			w.Header().Set(name, strings.Repeat("t", trailer))
+		}
+	}))
+	defer s.Close()
+
+	// Trailers are limited by the read buffer size.
+	s.Client().Transport.(*http.Transport).ReadBufferSize = 128 * 1024
+
+	inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: testMaxSendSize})
+
+	call := func(size, trailer int) (body []byte, trailers []flat.Header, message string) {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(fmt.Sprintf("/?size=%d&trailer=%d", size, trailer))
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+		if len(p) > testMaxSendSize {
+			t.Fatalf("body size %d: packet size %d", size, len(p))
+		}
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.BodyStreamId() < 0 {
+			body = r.BodyBytes()
+			for i := 0; i < r.TrailersLength(); i++ {
+				var h flat.Header
+				r.Trailers(&h, i)
+				trailers = append(trailers, h)
+			}
+			return
+		}
+
+		for {
+			p := packet.DataBuf(<-c)
+			if len(p) > testMaxSendSize {
+				t.Fatalf("body size %d: data packet size %d", size, len(p))
+			}
+			if p.DataLen() == 0 {
+				break
+			}
+			if p.Note() == streamNoteTrailers {
+				tr := flat.GetRootAsTrailers(p.Data(), 0)
+				for i := 0; i < tr.TrailersLength(); i++ {
+					var h flat.Header
+					tr.Trailers(&h, i)
+					trailers = append(trailers, h)
+				}
+				message = string(tr.ErrorMessage())
+			} else {
+				body = append(body, p.Data()...)
+			}
+		}
+		return
+	}
+
+	// The body is streamed if the trailers don't fit next to it.
+	for size := testMaxSendSize - 10000; size < testMaxSendSize; size += 251 {
+		body, trailers, message := call(size, 2000)
+		if len(body) != size {
+			t.Errorf("body size %d: received %d", size, len(body))
+		}
+		if len(trailers) != len(names) || len(trailers[0].Value()) != 2000 || message != "" {
+			t.Errorf("body size %d: %d trailers: %q", size, len(trailers), message)
+		}
+	}
+
+	// Trailers which don't fit in a packet are omitted.
+	if body, trailers, message := call(100, 20000); len(body) != 100 || len(trailers) != 0 || message != "trailers too large" {
+		t.Errorf("%d bytes, %d trailers: %q", len(body), len(trailers), message)
+	}
+}
+
+func TestGetText(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			fmt.Fprint(w, "hellö")
+		case "/binary":
+			w.Write([]byte{0xff, 0xfe})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		inlineLimit int64
+		path        string
+		status      uint16
+		text        string
+		err         bool
+	}{
+		{DefaultInlineBodyLimit, "/text", http.StatusOK, "hellö", false},
+		{0, "/text", http.StatusOK, "hellö", false},
+		{DefaultInlineBodyLimit, "/binary", http.StatusOK, "", true},
+		{DefaultInlineBodyLimit, "/missing", http.StatusNotFound, "404 page not found\n", true},
+	} {
+		inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: x.inlineLimit})
+
+		b := flatbuffers.NewBuilder(0)
+		uri := b.CreateString(x.path)
+		flat.GetTextStart(b)
+		flat.GetTextAddUri(b, uri)
+		function := flat.GetTextEnd(b)
+		flat.CallStart(b)
+		flat.CallAddFunctionType(b, flat.FunctionGetText)
+		flat.CallAddFunction(b, function)
+		b.Finish(flat.CallEnd(b))
+
+		p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+		copy(p.Content(), b.FinishedBytes())
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsTextResponse(p, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%s: status %d", x.path, r.StatusCode())
+		}
+		if string(r.Text()) != x.text {
+			t.Errorf("%s: %q", x.path, r.Text())
+		}
+		if r.Error() != x.err {
+			t.Errorf("%s: error %v %q", x.path, r.Error(), r.ErrorMessage())
+		}
+	}
+}
+
+func TestFormPost(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Error(r.Method)
+		}
+		if s := r.Header.Get("Content-Type"); s != "application/x-www-form-urlencoded" {
+			t.Error(s)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if v := r.PostForm["a b&c"]; len(v) != 2 || v[0] != "ü=1" || v[1] != "+%" {
+			t.Errorf("%q", v)
+		}
+		fmt.Fprint(w, r.PostForm.Get("z"))
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	var fields []flatbuffers.UOffsetT
+	for _, kv := range [][2]string{{"z", "first"}, {"a b&c", "ü=1"}, {"a b&c", "+%"}} {
+		key := b.CreateString(kv[0])
+		value := b.CreateString(kv[1])
+		flat.FormFieldStart(b)
+		flat.FormFieldAddKey(b, key)
+		flat.FormFieldAddValue(b, value)
+		fields = append(fields, flat.FormFieldEnd(b))
+	}
+	flat.FormPostStartFieldsVector(b, len(fields))
+	for i := len(fields) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(fields[i])
+	}
+	fieldVector := b.EndVector(len(fields))
+	uri := b.CreateString("/submit")
+	flat.FormPostStart(b)
+	flat.FormPostAddUri(b, uri)
+	flat.FormPostAddFields(b, fieldVector)
+	function := flat.FormPostEnd(b)
+	flat.CallStart(b)
+	flat.CallAddFunctionType(b, flat.FunctionFormPost)
+	flat.CallAddFunction(b, function)
+	b.Finish(flat.CallEnd(b))
+
+	p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+	copy(p.Content(), b.FinishedBytes())
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+	if s := string(r.BodyBytes()); s != "first" {
+		t.Error(s)
+	}
+
+	call := flat.GetRootAsCall(b.FinishedBytes(), 0)
+	tab := new(flatbuffers.Table)
+	call.Function(tab)
+	var f flat.FormPost
+	f.Init(tab.Bytes, tab.Pos)
+	if s := encodeForm(f); s != "z=first&a+b%26c=%C3%BC%3D1&a+b%26c=%2B%25" {
+		t.Error(s)
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	contents := map[int32][]byte{
+		3: bytes.Repeat([]byte("3"), 1000),
+		5: []byte("five"),
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if v := r.MultipartForm.Value["field"]; len(v) != 1 || v[0] != "inline" {
+			t.Errorf("%q", v)
+		}
+
+		for name, x := range map[string]struct {
+			filename    string
+			contentType string
+			content     []byte
+		}{
+			"first":  {"a \"b\".txt", "text/plain", contents[3]},
+			"second": {"c.bin", DefaultContentType, contents[5]},
+		} {
+			files := r.MultipartForm.File[name]
+			if len(files) != 1 {
+				t.Fatal(name, len(files))
+			}
+			if files[0].Filename != x.filename {
+				t.Errorf("%s: %q", name, files[0].Filename)
+			}
+			if s := files[0].Header.Get("Content-Type"); s != x.contentType {
+				t.Errorf("%s: %q", name, s)
+			}
+			f, err := files[0].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(f)
+			f.Close()
+			if !bytes.Equal(data, x.content) {
+				t.Errorf("%s: %q", name, data)
+			}
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		known  bool
+		limit  int64
+		status int
+	}{
+		{true, 0, http.StatusCreated},
+		{false, 0, http.StatusCreated},
+		{true, 1200, http.StatusRequestEntityTooLarge},
+		{false, 1200, http.StatusRequestEntityTooLarge}, // Parts fit, but not the whole body.
+	} {
+		known := x.known
+		status := x.status
+		inst, c := startTestInstance(t, s, &Config{MaxRequestBodySize: x.limit})
+
+		b := flatbuffers.NewBuilder(0)
+		var parts []flatbuffers.UOffsetT
+		for _, x := range []struct {
+			name        string
+			filename    string
+			contentType string
+			id          int32
+		}{
+			{"field", "", "", -1},
+			{"first", `a "b".txt`, "text/plain", 3},
+			{"second", "c.bin", "", 5},
+		} {
+			name := b.CreateString(x.name)
+			var filename, contentType, body flatbuffers.UOffsetT
+			if x.filename != "" {
+				filename = b.CreateString(x.filename)
+			}
+			if x.contentType != "" {
+				contentType = b.CreateString(x.contentType)
+			}
+			if x.id < 0 {
+				body = b.CreateByteVector([]byte("inline"))
+			}
+			flat.PartStart(b)
+			flat.PartAddName(b, name)
+			if filename != 0 {
+				flat.PartAddFilename(b, filename)
+			}
+			if contentType != 0 {
+				flat.PartAddContentType(b, contentType)
+			}
+			if body != 0 {
+				flat.PartAddBody(b, body)
+			} else {
+				flat.PartAddBodyStreamId(b, x.id)
+				n := int64(len(contents[x.id]))
+				if !known {
+					n = -1
+				}
+				flat.PartAddContentLength(b, n)
+			}
+			parts = append(parts, flat.PartEnd(b))
+		}
+		flat.MultipartStartPartsVector(b, len(parts))
+		for i := len(parts) - 1; i >= 0; i-- {
+			b.PrependUOffsetT(parts[i])
+		}
+		partVector := b.EndVector(len(parts))
+		uri := b.CreateString("/upload")
+		flat.MultipartStart(b)
+		flat.MultipartAddUri(b, uri)
+		flat.MultipartAddParts(b, partVector)
+		function := flat.MultipartEnd(b)
+		flat.CallStart(b)
+		flat.CallAddFunctionType(b, flat.FunctionMultipart)
+		flat.CallAddFunction(b, function)
+		b.Finish(flat.CallEnd(b))
+
+		p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+		copy(p.Content(), b.FinishedBytes())
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := make(map[int32]bool)
+		for {
+			p := <-c
+			if p.Domain() == packet.DomainCall {
+				r := flat.GetRootAsResponse(p, packet.HeaderSize)
+				if int(r.StatusCode()) != status {
+					t.Error(known, r.StatusCode(), string(r.ErrorMessage()))
+				}
+				break
+			}
+
+			id, _ := packet.FlowBuf(p).Get(0)
+			if sent[id] {
+				continue
+			}
+			sent[id] = true
+
+			d := packet.MakeData(testCode, id, len(contents[id]))
+			copy(d.Data(), contents[id])
+			eof := packet.MakeData(testCode, id, 0)
+			for _, d := range []packet.Buf{packet.Buf(d), packet.Buf(eof)} {
+				if err := inst.Handle(context.Background(), c, d); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestAbortRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	abort := func(id int32) {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		flat.AbortRequestStart(b)
+		flat.AbortRequestAddStreamId(b, id)
+		function := flat.AbortRequestEnd(b)
+		flat.CallStart(b)
+		flat.CallAddFunctionType(b, flat.FunctionAbortRequest)
+		flat.CallAddFunction(b, function)
+		b.Finish(flat.CallEnd(b))
+
+		p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+		copy(p.Content(), b.FinishedBytes())
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unknown stream.
+	abort(100)
+	if r := flat.GetRootAsResponse(<-c, packet.HeaderSize); r.StatusCode() != http.StatusNotFound {
+		t.Error(r.StatusCode())
+	}
+
+	// Request with streamed body.
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodPost)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBodyStreamId(b, 7)
+	flat.RequestAddContentLength(b, -1)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-c; p.Domain() != packet.DomainFlow {
+		t.Fatal(p)
+	}
+
+	abort(7)
+
+	var acked, aborted bool
+	for !acked || !aborted {
+		p := <-c
+		if p.Domain() != packet.DomainCall {
+			continue
+		}
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.Aborted() {
+			aborted = true
+			if r.StatusCode() != http.StatusServiceUnavailable {
+				t.Error(r.StatusCode())
+			}
+		} else if r.StatusCode() == http.StatusNoContent {
+			acked = true
+		} else {
+			t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+		}
+	}
+
+	// Streamed response.
+	b = flatbuffers.NewBuilder(0)
+	method = b.CreateString(http.MethodGet)
+	uri = b.CreateString("/stream")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p = makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	id := r.BodyStreamId()
+	if id < 0 {
+		t.Fatal(id)
+	}
+	if p := packet.DataBuf(<-c); string(p.Data()) != "x" {
+		t.Fatalf("%q", p.Data())
+	}
+
+	abort(id)
+
+	acked = false
+	var ended bool
+	for !acked || !ended {
+		p := <-c
+		switch p.Domain() {
+		case packet.DomainCall:
+			if r := flat.GetRootAsResponse(p, packet.HeaderSize); r.StatusCode() != http.StatusNoContent {
+				t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+			}
+			acked = true
+
+		case packet.DomainData:
+			d := packet.DataBuf(p)
+			if d.ID() != id || d.DataLen() != 0 {
+				t.Fatal(d.ID(), d.DataLen())
+			}
+			if d.Note() != streamNoteAborted {
+				t.Error(d.Note())
+			}
+			ended = true
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	serverErr := make(chan error, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		rw.Write([]byte{0x80 | opPing, 1, 'p'})
+		rw.Flush()
+
+		// Echo frames until close.  Ping is answered by the service.
+		for {
+			var h [6]byte
+			if _, err := io.ReadFull(rw, h[:]); err != nil {
+				serverErr <- err
+				return
+			}
+			if h[1]&0x80 == 0 || h[1]&0x7f > maxControlPayload {
+				serverErr <- errInvalidFrame
+				return
+			}
+			payload := make([]byte, h[1]&0x7f)
+			if _, err := io.ReadFull(rw, payload); err != nil {
+				serverErr <- err
+				return
+			}
+			for i := range payload {
+				payload[i] ^= h[2+i&3]
+			}
+
+			if h[0]&0xf == opPong {
+				if string(payload) != "p" {
+					serverErr <- fmt.Errorf("pong: %q", payload)
+					return
+				}
+				continue
+			}
+
+			rw.Write(append([]byte{h[0], byte(len(payload))}, payload...))
+			rw.Flush()
+
+			if h[0]&0xf == opClose {
+				serverErr <- nil
+				return
+			}
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	b := flatbuffers.NewBuilder(0)
+	uri := b.CreateString("/ws")
+	flat.WebSocketStart(b)
+	flat.WebSocketAddUri(b, uri)
+	function := flat.WebSocketEnd(b)
+	flat.CallStart(b)
+	flat.CallAddFunctionType(b, flat.FunctionWebSocket)
+	flat.CallAddFunction(b, function)
+	b.Finish(flat.CallEnd(b))
+
+	p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+	copy(p.Content(), b.FinishedBytes())
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	if r.StatusCode() != http.StatusSwitchingProtocols {
+		t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	id := r.BodyStreamId()
+	if id < 0 {
+		t.Fatal(id)
+	}
+
+	// receive a frame, skipping flow packets.
+	receive := func() packet.DataBuf {
+		t.Helper()
+		for {
+			p := <-c
+			switch p.Domain() {
+			case packet.DomainFlow:
+				if fid, _ := packet.FlowBuf(p).Get(0); fid != id {
+					t.Fatal(fid)
+				}
+
+			case packet.DomainData:
+				d := packet.DataBuf(p)
+				if d.ID() != id {
+					t.Fatal(d.ID())
+				}
+				return d
+
+			default:
+				t.Fatal(p.Domain())
+			}
+		}
+	}
+
+	send := func(note int32, data string) {
+		t.Helper()
+		p := packet.MakeData(testCode, id, len(data))
+		p.SetNote(note)
+		copy(p.Data(), data)
+		if err := inst.Handle(context.Background(), c, packet.Buf(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(frameNote|frameNoteFin|opText, "hello")
+	if d := receive(); d.Note() != frameNote|frameNoteFin|opText || string(d.Data()) != "hello" {
+		t.Errorf("%#x %q", d.Note(), d.Data())
+	}
+
+	send(frameNote|frameNoteFin|opClose, "\x03\xe8")
+	if d := receive(); d.Note() != frameNote|frameNoteFin|opClose || string(d.Data()) != "\x03\xe8" {
+		t.Errorf("%#x %q", d.Note(), d.Data())
+	}
+	if d := receive(); d.Note() != 0 || d.DataLen() != 0 {
+		t.Errorf("%#x %q", d.Note(), d.Data())
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	serverErr := make(chan error, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Host != "example.net:443" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		io.WriteString(rw, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		rw.Flush()
+
+		// Echo until the program closes its side.
+		_, err = io.Copy(conn, rw)
+		serverErr <- err
+	}))
+	defer s.Close()
+
+	call := func(inst *instance, c chan packet.Buf, target string) *flat.Response {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		targetOff := b.CreateString(target)
+		flat.ConnectStart(b)
+		flat.ConnectAddTarget(b, targetOff)
+		function := flat.ConnectEnd(b)
+		flat.CallStart(b)
+		flat.CallAddFunctionType(b, flat.FunctionConnect)
+		flat.CallAddFunction(b, function)
+		b.Finish(flat.CallEnd(b))
+
+		p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+		copy(p.Content(), b.FinishedBytes())
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		return flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	}
+
+	inst, c := startTestInstance(t, s, &Config{})
+	if r := call(inst, c, "example.net:443"); r.StatusCode() != http.StatusMethodNotAllowed {
+		t.Error(r.StatusCode())
+	}
+
+	inst, c = startTestInstance(t, s, &Config{
+		AllowConnect:   true,
+		ConnectTargets: []string{"Example.net:443"},
+	})
+
+	for _, target := range []string{"example.net:80", "example.org:443"} {
+		if r := call(inst, c, target); r.StatusCode() != http.StatusForbidden {
+			t.Error(target, r.StatusCode())
+		}
+	}
+	for _, target := range []string{"example.net", "example.net:https", ":443"} {
+		if r := call(inst, c, target); r.StatusCode() != http.StatusBadRequest {
+			t.Error(target, r.StatusCode())
+		}
+	}
+
+	denied, deniedC := startTestInstance(t, s, &Config{
+		AllowConnect:   true,
+		ConnectTargets: []string{"example.net:443"},
+		Authorize: func(method, path string, header http.Header) (bool, string) {
+			return method != http.MethodConnect || path != "example.net:443", "no tunnels"
+		},
+	})
+	if r := call(denied, deniedC, "example.net:443"); r.StatusCode() != http.StatusForbidden || string(r.ErrorMessage()) != "no tunnels" {
+		t.Error(r.StatusCode(), string(r.ErrorMessage()))
+	}
+
+	r := call(inst, c, "example.net:443")
+	if r.StatusCode() != http.StatusOK {
+		t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	id := r.BodyStreamId()
+	if id < 0 {
+		t.Fatal(id)
+	}
+
+	var flow int32
+
+	// receive data, counting flow.
+	receive := func() packet.DataBuf {
+		t.Helper()
+		for {
+			p := <-c
+			switch p.Domain() {
+			case packet.DomainFlow:
+				fid, n := packet.FlowBuf(p).Get(0)
+				if fid != id {
+					t.Fatal(fid)
+				}
+				flow += n
+
+			case packet.DomainData:
+				d := packet.DataBuf(p)
+				if d.ID() != id {
+					t.Fatal(d.ID())
+				}
+				return d
+
+			default:
+				t.Fatal(p.Domain())
+			}
+		}
+	}
+
+	send := func(data string) {
+		t.Helper()
+		p := packet.MakeData(testCode, id, len(data))
+		copy(p.Data(), data)
+		if err := inst.Handle(context.Background(), c, packet.Buf(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("hello")
+	if d := receive(); string(d.Data()) != "hello" {
+		t.Errorf("%q", d.Data())
+	}
+
+	send("")
+	if d := receive(); d.Note() != 0 || d.DataLen() != 0 {
+		t.Errorf("%#x %q", d.Note(), d.Data())
+	}
+	if flow != uploadWindow+5 {
+		t.Error(flow)
+	}
+
+	if err := <-serverErr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRawRequest(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		fmt.Fprintf(w, "%s %s", r.URL.Path, data)
+	}))
+	defer s.Close()
+
+	host := s.Listener.Addr().String()
+
+	call := func(inst *instance, c chan packet.Buf, data string) (*flat.Response, string) {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		dataOff := b.CreateByteVector([]byte(data))
+		flat.RawRequestStart(b)
+		flat.RawRequestAddData(b, dataOff)
+		function := flat.RawRequestEnd(b)
+		flat.CallStart(b)
+		flat.CallAddFunctionType(b, flat.FunctionRawRequest)
+		flat.CallAddFunction(b, function)
+		b.Finish(flat.CallEnd(b))
+
+		p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+		copy(p.Content(), b.FinishedBytes())
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.BodyStreamId() < 0 {
+			return r, ""
+		}
+
+		var raw []byte
+		for {
+			d := packet.DataBuf(<-c)
+			if d.ID() != r.BodyStreamId() {
+				t.Fatal(d.ID())
+			}
+			if d.DataLen() == 0 {
+				return r, string(raw)
+			}
+			if d.Note() == 0 { // Not trailers.
+				raw = append(raw, d.Data()...)
+			}
+		}
+	}
+
+	inst, c := startTestInstance(t, s, &Config{})
+	if r, _ := call(inst, c, "GET /api HTTP/1.1\r\nHost: "+host+"\r\n\r\n"); r.StatusCode() != http.StatusNotImplemented {
+		t.Error(r.StatusCode())
+	}
+
+	inst, c = startTestInstance(t, s, &Config{
+		AllowRawRequests: true,
+		AllowedPaths:     []string{"/api"},
+		ProtectedHeaders: []string{"X-Forwarded-For"},
+	})
+
+	r, raw := call(inst, c, "POST /api/x HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 5\r\n\r\nhello")
+	if r.StatusCode() != http.StatusOK {
+		t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	if !strings.HasPrefix(raw, "HTTP/1.1 200 OK\r\n") || !strings.Contains(raw, "\r\nX-Method: POST\r\n") ||
+		!strings.HasSuffix(raw, "\r\n\r\n/api/x hello") {
+		t.Errorf("%q", raw)
+	}
+
+	for _, x := range []struct {
+		data   string
+		status uint16
+	}{
+		{"GET /api HTTP/1.1\r\nHost: example.net\r\n\r\n", http.StatusForbidden},
+		{"GET /api HTTP/1.1\r\n\r\n", http.StatusForbidden},
+		{"GET /secret HTTP/1.1\r\nHost: " + host + "\r\n\r\n", http.StatusForbidden},
+		{"GET /api/../secret HTTP/1.1\r\nHost: " + host + "\r\n\r\n", http.StatusForbidden},
+		{"GET /api HTTP/1.1\r\nHost: " + host + "\r\nX-Forwarded-For: 127.0.0.1\r\n\r\n", http.StatusForbidden},
+		{"GET /api HTTP/1.1\r\nHost: " + host + "\r\n\r\nGET /secret HTTP/1.1\r\nHost: " + host + "\r\n\r\n", http.StatusBadRequest},
+		{"POST /api HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"POST /api HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 5\r\n\r\nhi", http.StatusBadRequest},
+		{"GET http://" + host + "/api HTTP/1.1\r\nHost: " + host + "\r\n\r\n", http.StatusBadRequest},
+		{"GET /api HTTP/1.0\r\nHost: " + host + "\r\n\r\n", http.StatusBadRequest},
+		{"GET /api HTTP/1.1\r\nHost: " + host + "\r\nUpgrade: websocket\r\n\r\n", http.StatusBadRequest},
+		{"TRACE /api HTTP/1.1\r\nHost: " + host + "\r\n\r\n", http.StatusMethodNotAllowed},
+		{"GET /api\r\n\r\n", http.StatusBadRequest},
+	} {
+		if r, _ := call(inst, c, x.data); r.StatusCode() != x.status {
+			t.Errorf("%q: %d %s", x.data, r.StatusCode(), r.ErrorMessage())
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, AllowRawRequests: true, RewritePath: path.Clean}); err == nil {
+		t.Error("raw requests accepted with path rewriting")
+	}
+}
+
+func TestBuildRequestCall(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"), data)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: DefaultInlineBodyLimit})
+
+	p := BuildRequestCall(testCode, http.MethodPut, "/x", "application/octet-stream", []byte("hello"))
+	if !packet.IsValidCall(p, testCode) {
+		t.Fatal(p)
+	}
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+
+	status, contentType, body, err := ParseResponse(<-c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Error(status)
+	}
+	if contentType != "text/plain" {
+		t.Error(contentType)
+	}
+	if string(body) != "PUT /x application/octet-stream hello" {
+		t.Errorf("%q", body)
+	}
+
+	if _, _, _, err := ParseResponse(packet.Make(testCode, packet.DomainData, packet.HeaderSize+8)); err == nil {
+		t.Error("data packet parsed as response")
+	}
+}
+
+func TestUnsupportedFunction(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	for _, functionType := range []flat.Function{flat.FunctionNONE, 99} {
+		b := flatbuffers.NewBuilder(0)
+		b.StartObject(0)
+		function := b.EndObject()
+		flat.CallStart(b)
+		flat.CallAddFunctionType(b, functionType)
+		flat.CallAddFunction(b, function)
+		b.Finish(flat.CallEnd(b))
+
+		p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+		copy(p.Content(), b.FinishedBytes())
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		if len(p.Content()) == 0 {
+			t.Fatalf("function type %d: empty response", functionType)
+		}
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusNotImplemented {
+			t.Errorf("function type %d: status %d", functionType, r.StatusCode())
+		}
+		if string(r.ErrorMessage()) != "unsupported function" {
+			t.Errorf("function type %d: %q", functionType, r.ErrorMessage())
+		}
+	}
+}
+
+func TestMissingFunction(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{})
+
+	for _, functionType := range []flat.Function{flat.FunctionNONE, flat.FunctionRequest, flat.FunctionGetText, 99} {
+		for _, omitType := range []bool{false, true} {
+			b := flatbuffers.NewBuilder(0)
+			flat.CallStart(b)
+			if !omitType {
+				flat.CallAddFunctionType(b, functionType)
+			}
+			b.Finish(flat.CallEnd(b))
+
+			p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+			copy(p.Content(), b.FinishedBytes())
+
+			if err := inst.Handle(context.Background(), c, p); err != nil {
+				t.Fatal(err)
+			}
+			p = <-c
+
+			r := flat.GetRootAsResponse(p, packet.HeaderSize)
+			if r.StatusCode() != http.StatusBadRequest {
+				t.Errorf("function type %d: status %d", functionType, r.StatusCode())
+			}
+			if string(r.ErrorMessage()) != "malformed call" {
+				t.Errorf("function type %d: %q", functionType, r.ErrorMessage())
+			}
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RawQuery)
+	}))
+	defer s.Close()
+
+	queries := []string{
+		"a=1&a=2&b=3",
+		"b=3&a=2&a=1",
+		"z=%20+x&a=%2F&z=",
+		"a&a=&a=1;b",
+	}
+
+	for _, allowedPaths := range [][]string{nil, {"/"}} {
+		inst, c := startTestInstance(t, s, &Config{
+			InlineBodyLimit: DefaultInlineBodyLimit,
+			AllowedPaths:    allowedPaths,
+		})
+
+		for _, query := range queries {
+			b := flatbuffers.NewBuilder(0)
+			method := b.CreateString(http.MethodGet)
+			uri := b.CreateString("/path?" + query)
+			flat.RequestStart(b)
+			flat.RequestAddMethod(b, method)
+			flat.RequestAddUri(b, uri)
+			p := makeTestCall(t, b, flat.RequestEnd(b))
+
+			if err := inst.Handle(context.Background(), c, p); err != nil {
+				t.Fatal(err)
+			}
+			p = <-c
+
+			r := flat.GetRootAsResponse(p, packet.HeaderSize)
+			if string(r.BodyBytes()) != query {
+				t.Errorf("%q: %q", query, r.BodyBytes())
+			}
+
+			b = flatbuffers.NewBuilder(0)
+			uri = b.CreateString("/path?" + query)
+			flat.GetTextStart(b)
+			flat.GetTextAddUri(b, uri)
+			function := flat.GetTextEnd(b)
+			flat.CallStart(b)
+			flat.CallAddFunctionType(b, flat.FunctionGetText)
+			flat.CallAddFunction(b, function)
+			b.Finish(flat.CallEnd(b))
+
+			p = packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+			copy(p.Content(), b.FinishedBytes())
+
+			if err := inst.Handle(context.Background(), c, p); err != nil {
+				t.Fatal(err)
+			}
+			p = <-c
+
+			tr := flat.GetRootAsTextResponse(p, packet.HeaderSize)
+			if string(tr.Text()) != query {
+				t.Errorf("GetText %q: %q", query, tr.Text())
+			}
+		}
+	}
+}
+
+func TestHTTP2C(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	defer s.Close()
+
+	if _, err := New(&Config{Addr: "https://localhost", ForceHTTP2C: true}); err == nil {
+		t.Error("h2c accepted with https address")
+	}
+
+	local, err := New(&Config{
+		Addr:            s.URL,
+		ForceHTTP2C:     true,
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	if string(r.BodyBytes()) != "HTTP/2.0" {
+		t.Errorf("%q", r.BodyBytes())
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	events := []string{
+		"data: first\n\n",
+		"event: x\r\ndata: second\r\n\r\n",
+		": comment\ndata: third\n\n",
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		fmt.Fprint(w, events[0])
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, events[1]+events[2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{InlineBodyLimit: DefaultInlineBodyLimit})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	id := r.BodyStreamId()
+	if id < 0 {
+		t.Fatal(id)
+	}
+
+	for _, event := range events {
+		p := packet.DataBuf(<-c)
+		if p.ID() != id || string(p.Data()) != event {
+			t.Errorf("%q", p.Data())
+		}
+	}
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Final packet either got through or was included in the snapshot.
+	var final []packet.Buf
+	for len(c) > 0 {
+		final = append(final, <-c)
+	}
+
+	inst = newInstance(inst.local, service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	})
+	if err := inst.restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	final = append(final, inst.pendingUnsent...)
+
+	if len(final) != 1 {
+		t.Fatal(len(final))
+	}
+	if p := packet.DataBuf(final[0]); p.ID() != id || p.DataLen() != 0 {
+		t.Errorf("final packet: %v", p)
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Custom reason phrase can't be produced with net/http server.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				fmt.Fprint(conn, "HTTP/1.1 299 Very Fine\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			}()
+		}
+	}()
+
+	local, err := New(&Config{Addr: "http://" + l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, c := startTestLocalInstance(t, local)
+
+	for _, x := range []struct {
+		method string
+		status uint16
+		text   string
+	}{
+		{http.MethodGet, 299, "Very Fine"},
+		{"BREW", http.StatusMethodNotAllowed, "Method Not Allowed"},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(x.method)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Error(r.StatusCode(), string(r.ErrorMessage()))
+		}
+		if string(r.StatusText()) != x.text {
+			t.Errorf("%q", r.StatusText())
+		}
+	}
+}
+
+func TestRestartIdempotent(t *testing.T) {
+	for _, restart := range []bool{false, true} {
+		var (
+			arrived = make(chan struct{}, 2)
+			release = make(chan struct{})
+		)
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+			fmt.Fprint(w, "done")
+		}))
+		defer s.Close()
+
+		inst, c := startTestInstance(t, s, &Config{
+			InlineBodyLimit:     DefaultInlineBodyLimit,
+			NoRestartIdempotent: !restart,
+		})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		<-arrived
+
+		if !restart {
+			// Suspension waits for the request.
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				close(release)
+			}()
+		}
+
+		snapshot, err := inst.Suspend(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var replies []packet.Buf
+		for len(c) > 0 {
+			replies = append(replies, <-c)
+		}
+
+		inst = newInstance(inst.local, service.InstanceConfig{
+			Service: packet.Service{
+				MaxSendSize: testMaxSendSize,
+				Code:        testCode,
+			},
+		})
+		if err := inst.restore(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, inst.pendingUnsent...)
+
+		if restart {
+			if len(replies) != 0 || len(inst.pendingRequests) != 1 {
+				t.Fatalf("restart: %d replies, %d requests", len(replies), len(inst.pendingRequests))
+			}
+
+			close(release)
+
+			c = make(chan packet.Buf, 1)
+			if err := inst.Start(context.Background(), c, nil); err != nil {
+				t.Fatal(err)
+			}
+			<-arrived
+			replies = append(replies, <-c)
+		} else if len(inst.pendingRequests) != 0 {
+			t.Fatalf("%d requests", len(inst.pendingRequests))
+		}
+
+		if len(replies) != 1 {
+			t.Fatalf("restart %v: %d replies", restart, len(replies))
+		}
+		r := flat.GetRootAsResponse(replies[0], packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK || string(r.BodyBytes()) != "done" {
+			t.Errorf("restart %v: %d %q", restart, r.StatusCode(), r.BodyBytes())
+		}
+	}
+}
+
+type testRequestMetrics struct {
+	mu           sync.Mutex
+	observations []string
+}
+
+func (m *testRequestMetrics) ObserveRequest(method string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, fmt.Sprintf("%s %d", method, status))
+}
+
+func TestRestartObservation(t *testing.T) {
+	var (
+		arrived = make(chan struct{}, 2)
+		release = make(chan struct{})
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, "done")
+	}))
+	defer s.Close()
+
+	var (
+		log     bytes.Buffer
+		metrics testRequestMetrics
+	)
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		Logger:          slog.New(slog.NewTextHandler(&log, nil)),
+		Metrics:         &metrics,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	<-arrived
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst = newInstance(inst.local, service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	})
+	if err := inst.restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics.mu.Lock()
+	if n := len(metrics.observations); n != 0 {
+		t.Errorf("%d observations after suspension: %q", n, metrics.observations)
+	}
+	metrics.mu.Unlock()
+
+	close(release)
+
+	c = make(chan packet.Buf, 1)
+	if err := inst.Start(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-arrived
+	if r := flat.GetRootAsResponse(<-c, packet.HeaderSize); r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+
+	metrics.mu.Lock()
+	if len(metrics.observations) != 1 || metrics.observations[0] != "GET 200" {
+		t.Errorf("observations after resumption: %q", metrics.observations)
+	}
+	metrics.mu.Unlock()
+
+	if n := strings.Count(log.String(), "localhost request"); n != 1 {
+		t.Errorf("%d request log lines:\n%s", n, log.String())
+	}
+}
+
+func TestRestartDeadline(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	arrived := make(chan struct{}, 2)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		RequestTimeout: time.Minute,
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddTimeoutMs(b, uint32(timeout/time.Millisecond))
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	start := time.Now()
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	<-arrived
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst = newInstance(inst.local, service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	})
+	if err := inst.restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(inst.pendingRequests) != 1 {
+		t.Fatalf("%d requests", len(inst.pendingRequests))
+	}
+
+	deadline := inst.deadlines[&inst.pendingRequests[0][0]]
+	if deadline.Before(start.Add(timeout)) || deadline.After(time.Now().Add(timeout)) {
+		t.Errorf("deadline %v after start", deadline.Sub(start))
+	}
+
+	time.Sleep(time.Until(deadline))
+
+	c = make(chan packet.Buf, 1)
+	if err := inst.Start(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Shutdown(context.Background())
+
+	r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	if r.StatusCode() != http.StatusGatewayTimeout {
+		t.Error(r.StatusCode(), string(r.ErrorMessage()))
+	}
+	if len(arrived) != 0 {
+		t.Error("expired request was sent")
+	}
+}
+
+func TestBodyChecksums(t *testing.T) {
+	content := []byte("0123456789")
+	shaSum := sha256.Sum256(content)
+	md5Sum := md5.Sum(content)
+	goodSHA := base64.StdEncoding.EncodeToString(shaSum[:])
+	goodMD5 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	bad := base64.StdEncoding.EncodeToString([]byte("bad"))
+
+	for _, x := range []struct {
+		header string
+		value  string
+		ok     bool
+	}{
+		{"", "", true},
+		{"Digest", "SHA-256=" + goodSHA, true},
+		{"Digest", "md5=" + goodMD5 + ", sha-256=" + goodSHA, true},
+		{"Content-MD5", goodMD5, true},
+		{"Digest", "SHA-256=" + bad, false},
+		{"Content-MD5", bad, false},
+	} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if x.header != "" {
+				w.Header().Set(x.header, x.value)
+			}
+			w.Write(content)
+		}))
+
+		for _, inlineLimit := range []int64{DefaultInlineBodyLimit, 5} {
+			inst, c := startTestInstance(t, s, &Config{
+				InlineBodyLimit: inlineLimit,
+				BodyChecksums:   true,
+			})
+
+			b := flatbuffers.NewBuilder(0)
+			method := b.CreateString(http.MethodGet)
+			uri := b.CreateString("/")
+			flat.RequestStart(b)
+			flat.RequestAddMethod(b, method)
+			flat.RequestAddUri(b, uri)
+			p := makeTestCall(t, b, flat.RequestEnd(b))
+
+			if err := inst.Handle(context.Background(), c, p); err != nil {
+				t.Fatal(err)
+			}
+			p = <-c
+
+			r := flat.GetRootAsResponse(p, packet.HeaderSize)
+
+			var (
+				sum     []byte
+				message string
+			)
+			if id := r.BodyStreamId(); id < 0 {
+				if r.StatusCode() == http.StatusBadGateway {
+					message = string(r.ErrorMessage())
+				}
+				sum = r.BodySha256Bytes()
+			} else {
+				for {
+					p := packet.DataBuf(<-c)
+					if p.DataLen() == 0 {
+						break
+					}
+					if p.Note() == streamNoteTrailers {
+						tr := flat.GetRootAsTrailers(p.Data(), 0)
+						sum = tr.BodySha256Bytes()
+						message = string(tr.ErrorMessage())
+					}
+				}
+			}
+
+			if x.ok {
+				if message != "" || !bytes.Equal(sum, shaSum[:]) {
+					t.Errorf("%s %q, inline limit %d: %q %x", x.header, x.value, inlineLimit, message, sum)
+				}
+			} else if message != "checksum mismatch" {
+				t.Errorf("%s %q, inline limit %d: %q", x.header, x.value, inlineLimit, message)
+			}
+		}
+
+		s.Close()
+	}
+}
+
+func TestStaticHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for key, expect := range map[string]string{
+			"X-Gate-Tenant":   "t1",
+			"X-Forwarded-For": "127.0.0.1",
+			"X-Default":       "mine",
+			"X-Secret":        "",
+		} {
+			if s := strings.Join(r.Header[key], ","); s != expect {
+				t.Errorf("%s: %q", key, s)
+			}
+		}
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		StaticHeaders: http.Header{
+			"x-gate-tenant":   {"t1"},
+			"X-Forwarded-For": {"127.0.0.1"},
+			"X-Default":       {"static"},
+		},
+		ProtectedHeaders: []string{"X-Gate-Tenant", "x-secret"},
+	})
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	headers := buildTestHeaders(b, "X-Gate-Tenant", "evil", "X-Default", "mine", "X-Secret", "s")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddHeaders(b, headers)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	if r := flat.GetRootAsResponse(<-c, packet.HeaderSize); r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+
+	for _, config := range []*Config{
+		{Addr: s.URL, StaticHeaders: http.Header{"Bad Name": {"x"}}},
+		{Addr: s.URL, StaticHeaders: http.Header{"X-Good": {"bad\nvalue"}}},
+		{Addr: s.URL, StaticHeaders: http.Header{"Connection": {"close"}}},
+		{Addr: s.URL, ProtectedHeaders: []string{"Host"}},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("%v %v", config.StaticHeaders, config.ProtectedHeaders)
+		}
+	}
+}
+
+type testTraceKey struct{}
+
+type testTracer struct {
+	mu    sync.Mutex
+	ended []int
+}
+
+func (tr *testTracer) StartSpan(ctx context.Context, req *http.Request) (context.Context, Span) {
+	parent, _ := ctx.Value(testTraceKey{}).(string)
+	if parent == "" {
+		return ctx, nil
+	}
+	req.Header.Set("Traceparent", parent)
+	return context.WithValue(ctx, testTraceKey{}, "child"), tr
+}
+
+func (tr *testTracer) End(status int, err error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.ended = append(tr.ended, status)
+}
+
+func TestRequestLog(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprint(w, "body")
+	}))
+	defer s.Close()
+
+	var log bytes.Buffer
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		Logger:          slog.New(slog.NewJSONHandler(&log, nil)),
+	})
+
+	request := func() {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPut)
+		uri := b.CreateString("/path")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		<-c
+	}
+
+	entry := func() (m map[string]interface{}) {
+		t.Helper()
+
+		line, err := log.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(line, &m); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	host := strings.TrimPrefix(s.URL, "http://")
+
+	request()
+	m := entry()
+	for key, value := range map[string]interface{}{
+		"level":       "INFO",
+		"msg":         "localhost request",
+		"method":      http.MethodPut,
+		"path":        "/path",
+		"host":        host,
+		"status":      float64(http.StatusTeapot),
+		"body_length": float64(4),
+	} {
+		if m[key] != value {
+			t.Errorf("%s: %v", key, m[key])
+		}
+	}
+	if d, ok := m["duration"].(float64); !ok || d <= 0 {
+		t.Errorf("duration: %v", m["duration"])
+	}
+
+	// Transport failure.
+	s.Close()
+	request()
+	m = entry()
+	for key, value := range map[string]interface{}{
+		"level":  "ERROR",
+		"msg":    "localhost request failed",
+		"method": http.MethodPut,
+		"path":   "/path",
+		"host":   host,
+	} {
+		if m[key] != value {
+			t.Errorf("%s: %v", key, m[key])
+		}
+	}
+	if _, found := m["status"]; found {
+		t.Error("status:", m["status"])
+	}
+	if _, ok := m["duration"].(float64); !ok {
+		t.Errorf("duration: %v", m["duration"])
+	}
+	if e, _ := m["error"].(string); e == "" {
+		t.Errorf("error: %v", m["error"])
+	}
+
+	if log.Len() != 0 {
+		t.Errorf("unexpected log output: %s", log.Bytes())
+	}
+}
+
+func TestTracer(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Traceparent"))
+	}))
+	defer s.Close()
+
+	tracer := new(testTracer)
+	inst, c := startTestInstance(t, s, &Config{
+		Tracer:          tracer,
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+
+	for _, parent := range []string{"", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"} {
+		ctx := context.Background()
+		if parent != "" {
+			ctx = context.WithValue(ctx, testTraceKey{}, parent)
+		}
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(ctx, c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if string(r.BodyBytes()) != parent {
+			t.Errorf("%q", r.BodyBytes())
+		}
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.ended) != 1 || tracer.ended[0] != http.StatusOK {
+		t.Error(tracer.ended)
+	}
+}
+
+func TestCheckBackend(t *testing.T) {
+	var status int32 = http.StatusOK
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/healthz" {
+			t.Error(r.Method, r.URL)
+		}
+		if r.Header.Get("X-Static") != "yes" {
+			t.Error("static header missing")
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer s.Close()
+
+	local, err := New(&Config{
+		Addr:            s.URL,
+		HealthCheckPath: "/healthz",
+		StaticHeaders:   http.Header{"X-Static": {"yes"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := local.CheckBackend(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	if err := local.CheckBackend(context.Background()); err == nil {
+		t.Error("unavailable backend passed health check")
+	}
+
+	s.Close()
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := local.CheckBackend(context.Background()); err == nil {
+		t.Error("closed backend passed health check")
+	}
+
+	if _, err := New(&Config{Addr: s.URL, HealthCheckPath: "healthz"}); err == nil {
+		t.Error("relative health check path accepted")
+	}
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	local, err = New(&Config{Backends: map[string]string{"a": up.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.CheckBackend(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	local, err = New(&Config{Backends: map[string]string{"a": up.URL, "b": down.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.CheckBackend(context.Background()); err == nil || !strings.Contains(err.Error(), `"b"`) {
+		t.Error(err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header["User-Agent"])
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		config   string
+		expected string
+	}{
+		{"", "[" + DefaultUserAgent + "]"},
+		{"test/1.0", "[test/1.0]"},
+	} {
+		inst, c := startTestInstance(t, s, &Config{
+			InlineBodyLimit: DefaultInlineBodyLimit,
+			UserAgent:       x.config,
+		})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		headers := buildTestHeaders(b, "User-Agent", "guest", "user-agent", "guest2")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddHeaders(b, headers)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if string(r.BodyBytes()) != x.expected {
+			t.Errorf("%q", r.BodyBytes())
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	refuse := true
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := s.Listener.Addr().String()
+	s.Listener.Close()
+
+	local, err := New(&Config{
+		Addr:             "http://" + addr,
+		BreakerThreshold: 2,
+		BreakerCooldown:  100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// State is shared by instances.
+	inst1, c1 := startTestLocalInstance(t, local)
+	inst2, c2 := startTestLocalInstance(t, local)
+
+	request := func(inst *instance, c chan packet.Buf) string {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if refuse && r.StatusCode() != http.StatusServiceUnavailable {
+			t.Error(r.StatusCode())
+		}
+		return string(r.ErrorMessage())
+	}
+
+	for i, expect := range []string{"connection refused", "connection refused", "backend unavailable"} {
+		if msg := request(inst1, c1); msg != expect {
+			t.Errorf("request %d: %q", i, msg)
+		}
+	}
+	if msg := request(inst2, c2); msg != "backend unavailable" {
+		t.Errorf("other instance: %q", msg)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if msg := request(inst2, c2); msg != "connection refused" {
+		t.Errorf("probe: %q", msg)
+	}
+	if msg := request(inst1, c1); msg != "backend unavailable" {
+		t.Errorf("after probe: %q", msg)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+	refuse = false
+
+	time.Sleep(150 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if msg := request(inst1, c1); msg != "" {
+			t.Errorf("recovered request %d: %q", i, msg)
+		}
+	}
+}
+
+func TestCircuitBreakerProgramErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer s.Close()
+
+	local, err := New(&Config{
+		Addr:               s.URL,
+		BreakerThreshold:   2,
+		BreakerCooldown:    time.Minute,
+		MaxRequestBodySize: 10,
+		RequestTimeout:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.backends[""].client = s.Client()
+
+	inst1, c1 := startTestLocalInstance(t, local)
+	inst2, c2 := startTestLocalInstance(t, local)
+
+	request := func(inst *instance, c chan packet.Buf, path string, timeoutMs uint32, upload bool) *flat.Response {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddTimeoutMs(b, timeoutMs)
+		if upload {
+			flat.RequestAddBodyStreamId(b, 0)
+			flat.RequestAddContentLength(b, -1)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		if upload {
+			if p := <-c; p.Domain() != packet.DomainFlow {
+				t.Fatal(p.Domain())
+			}
+			d := packet.MakeData(testCode, 0, 11)
+			if err := inst.Handle(context.Background(), c, packet.Buf(d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for {
+			if p := <-c; p.Domain() == packet.DomainCall {
+				return flat.GetRootAsResponse(p, packet.HeaderSize)
+			}
+		}
+	}
+
+	// Timeouts requested by the program and oversized uploads don't open the
+	// circuit for other instances.
+	for i := 0; i < 3; i++ {
+		if r := request(inst1, c1, "/slow", 10, false); r.StatusCode() != http.StatusGatewayTimeout {
+			t.Errorf("program timeout %d: %d %q", i, r.StatusCode(), r.ErrorMessage())
+		}
+		if r := request(inst1, c1, "/", 0, true); r.StatusCode() != http.StatusRequestEntityTooLarge {
+			t.Errorf("upload %d: %d %q", i, r.StatusCode(), r.ErrorMessage())
+		}
+	}
+	if r := request(inst2, c2, "/", 0, false); r.StatusCode() != http.StatusOK {
+		t.Errorf("other instance: %d %q", r.StatusCode(), r.ErrorMessage())
+	}
+
+	// Configured timeout is a backend failure.
+	for i := 0; i < 2; i++ {
+		if r := request(inst1, c1, "/slow", 0, false); r.StatusCode() != http.StatusGatewayTimeout {
+			t.Errorf("configured timeout %d: %d %q", i, r.StatusCode(), r.ErrorMessage())
+		}
+	}
+	if r := request(inst2, c2, "/", 0, false); string(r.ErrorMessage()) != "backend unavailable" {
+		t.Errorf("other instance after timeouts: %d %q", r.StatusCode(), r.ErrorMessage())
+	}
+}
+
+func TestCache(t *testing.T) {
+	var hits sync.Map
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := hits.LoadOrStore(r.URL.Path, new(int32))
+		count := atomic.AddInt32(n.(*int32), 1)
+
+		switch r.URL.Path {
+		case "/fresh", "/other":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/stale":
+			w.Header().Set("Cache-Control", "max-age=0")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		}
+		fmt.Fprint(w, count)
+	}))
+	defer s.Close()
+
+	inst1, c1 := startTestInstance(t, s, &Config{
+		InlineBodyLimit:     DefaultInlineBodyLimit,
+		CacheSize:           2,
+		CacheRespectHeaders: true,
+	})
+
+	// Cache is shared by instances.
+	inst2, c2 := startTestLocalInstance(t, inst1.local)
+
+	request := func(inst *instance, c chan packet.Buf, method, path string) string {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		methodOffset := b.CreateString(method)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, methodOffset)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Error(method, path, r.StatusCode())
+		}
+		return string(r.BodyBytes())
+	}
+
+	for _, x := range []struct {
+		inst   *instance
+		c      chan packet.Buf
+		method string
+		path   string
+		body   string
+	}{
+		{inst1, c1, http.MethodGet, "/fresh", "1"},
+		{inst1, c1, http.MethodGet, "/fresh", "1"},
+		{inst2, c2, http.MethodGet, "/fresh", "1"},
+		{inst1, c1, http.MethodGet, "/expires", "1"},
+		{inst2, c2, http.MethodGet, "/expires", "1"},
+		{inst1, c1, http.MethodGet, "/stale", "1"},
+		{inst1, c1, http.MethodGet, "/stale", "2"},
+		{inst1, c1, http.MethodGet, "/nostore", "1"},
+		{inst1, c1, http.MethodGet, "/nostore", "2"},
+		{inst1, c1, http.MethodGet, "/plain", "1"},
+		{inst1, c1, http.MethodGet, "/plain", "2"},
+		{inst1, c1, http.MethodPost, "/fresh", "2"},
+		{inst1, c1, http.MethodGet, "/fresh", "3"},
+		{inst1, c1, http.MethodGet, "/fresh", "3"},
+	} {
+		if body := request(x.inst, x.c, x.method, x.path); body != x.body {
+			t.Errorf("%s %s: %q", x.method, x.path, body)
+		}
+	}
+
+	// Least recently used entry has been evicted.
+	request(inst1, c1, http.MethodGet, "/expires")
+	request(inst1, c1, http.MethodGet, "/other")
+	if body := request(inst1, c1, http.MethodGet, "/fresh"); body != "4" {
+		t.Errorf("evicted: %q", body)
+	}
+}
+
+func TestCacheIgnoringHeaders(t *testing.T) {
+	var hits sync.Map
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := hits.LoadOrStore(r.URL.Path, new(int32))
+		count := atomic.AddInt32(n.(*int32), 1)
+
+		switch r.URL.Path {
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/nocache":
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		fmt.Fprint(w, count)
+	}))
+	defer s.Close()
+
+	inst1, c1 := startTestInstance(t, s, &Config{
+		InlineBodyLimit: DefaultInlineBodyLimit,
+		CacheSize:       10,
+	})
+	inst2, c2 := startTestLocalInstance(t, inst1.local)
+
+	request := func(inst *instance, c chan packet.Buf, path string) string {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		return string(flat.GetRootAsResponse(<-c, packet.HeaderSize).BodyBytes())
+	}
+
+	for _, x := range []struct {
+		path  string
+		body1 string
+		body2 string
+	}{
+		{"/plain", "1", "1"},
+		{"/nocache", "1", "1"},
+		{"/nostore", "1", "2"},
+		{"/private", "1", "2"},
+	} {
+		if body := request(inst1, c1, x.path); body != x.body1 {
+			t.Errorf("%s: %q", x.path, body)
+		}
+		if body := request(inst2, c2, x.path); body != x.body2 {
+			t.Errorf("%s: other instance: %q", x.path, body)
+		}
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var (
+		version     int32 = 1
+		hits        int32
+		notModified int32
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(&hits, 1)
+		etag := fmt.Sprintf(`"v%d"`, atomic.LoadInt32(&version))
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "%s %d", etag, count)
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		InlineBodyLimit:     DefaultInlineBodyLimit,
+		CacheSize:           1,
+		CacheRespectHeaders: true,
+	})
+
+	get := func() string {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode())
+		}
+		return string(r.BodyBytes())
+	}
+
+	expire := func() {
+		cache := inst.local.cache
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		for _, elem := range cache.entries {
+			elem.Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+		}
+	}
+
+	for _, x := range []struct {
+		expire      bool
+		version     int32
+		body        string
+		hits        int32
+		notModified int32
+	}{
+		{false, 1, `"v1" 1`, 1, 0},
+		{false, 1, `"v1" 1`, 1, 0}, // Fresh.
+		{true, 1, `"v1" 1`, 2, 1},  // Stale but valid.
+		{false, 1, `"v1" 1`, 2, 1}, // Fresh again.
+		{true, 2, `"v2" 3`, 3, 1},  // Stale and changed.
+		{false, 2, `"v2" 3`, 3, 1}, // Fresh.
+	} {
+		if x.expire {
+			expire()
+		}
+		atomic.StoreInt32(&version, x.version)
+
+		if body := get(); body != x.body {
+			t.Errorf("%+v: %q", x, body)
+		}
+		if n := atomic.LoadInt32(&hits); n != x.hits {
+			t.Errorf("%+v: hits: %d", x, n)
+		}
+		if n := atomic.LoadInt32(&notModified); n != x.notModified {
+			t.Errorf("%+v: not modified: %d", x, n)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	request := func(inst *instance, c chan packet.Buf) *flat.Response {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		return flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		inst1, c1 := startTestInstance(t, s, &Config{
+			RequestsPerSecond: 1,
+			Burst:             2,
+			RateLimitMode:     RateLimitReject,
+		})
+
+		// Limit is shared by instances.
+		inst2, c2 := startTestLocalInstance(t, inst1.local)
+
+		for i := 0; i < 2; i++ {
+			if r := request(inst1, c1); r.StatusCode() != http.StatusOK {
+				t.Error(i, r.StatusCode())
+			}
+		}
+		r := request(inst2, c2)
+		if r.StatusCode() != http.StatusTooManyRequests {
+			t.Error(r.StatusCode())
+		}
+		if s := string(r.ErrorMessage()); s != "rate limit exceeded" {
+			t.Error(s)
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		inst, c := startTestInstance(t, s, &Config{
+			RequestsPerSecond: 20,
+		})
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if r := request(inst, c); r.StatusCode() != http.StatusOK {
+				t.Error(i, r.StatusCode())
+			}
+		}
+		if d := time.Since(start); d < 90*time.Millisecond {
+			t.Error(d)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		inst, c := startTestInstance(t, s, &Config{
+			RequestsPerSecond: 0.001,
+			RequestTimeout:    50 * time.Millisecond,
+		})
+
+		if r := request(inst, c); r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode())
+		}
+		if r := request(inst, c); r.StatusCode() != http.StatusGatewayTimeout {
+			t.Error(r.StatusCode())
+		}
+	})
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	const limit = 3
+
+	var (
+		active  int32
+		maxSeen int32
+		hold    = make(chan struct{})
+	)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxSeen)
+			if n <= m || atomic.CompareAndSwapInt32(&maxSeen, m, n) {
+				break
+			}
+		}
+
+		if r.URL.Path == "/hold" {
+			<-hold
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	defer s.Close()
+
+	request := func(inst *instance, c chan packet.Buf, path string) *flat.Response {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString(path)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Error(err)
+			return nil
+		}
+		return flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	}
+
+	t.Run("Wait", func(t *testing.T) {
+		inst, _ := startTestInstance(t, s, &Config{MaxConcurrentRequests: limit})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			inst, c := startTestLocalInstance(t, inst.local)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					if r := request(inst, c, "/"); r != nil && r.StatusCode() != http.StatusOK {
+						t.Error(r.StatusCode())
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := atomic.LoadInt32(&maxSeen); n < 1 || n > limit {
+			t.Error("max concurrent requests:", n)
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		inst, _ := startTestInstance(t, s, &Config{
+			MaxConcurrentRequests: 1,
+			OverloadMode:          OverloadReject,
+		})
+
+		inst1, c1 := startTestLocalInstance(t, inst.local)
+		inst2, c2 := startTestLocalInstance(t, inst.local)
+
+		held := make(chan *flat.Response, 1)
+		go func() {
+			held <- request(inst1, c1, "/hold")
+		}()
+		for atomic.LoadInt32(&active) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		r := request(inst2, c2, "/")
+		if r.StatusCode() != http.StatusServiceUnavailable {
+			t.Error(r.StatusCode())
+		}
+		if s := string(r.ErrorMessage()); s != "too many concurrent requests" {
+			t.Error(s)
+		}
+
+		close(hold)
+		if r := <-held; r == nil || r.StatusCode() != http.StatusOK {
+			t.Error("held request failed")
+		}
+		if r := request(inst2, c2, "/"); r.StatusCode() != http.StatusOK {
+			t.Error(r.StatusCode())
+		}
+	})
+}
+
+func TestMaxRequestsPerInstance(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	request := func(inst service.Instance, c chan packet.Buf) *flat.Response {
+		t.Helper()
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		return flat.GetRootAsResponse(<-c, packet.HeaderSize)
+	}
+
+	inst, c := startTestInstance(t, s, &Config{MaxRequestsPerInstance: 2})
+
+	if r := request(inst, c); r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+
+	snapshot, err := inst.Suspend(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	}
+	resumed, err := inst.local.CreateInstance(context.Background(), config, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Start(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := request(resumed, c); r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+	for i := 0; i < 2; i++ {
+		r := request(resumed, c)
+		if r.StatusCode() != http.StatusTooManyRequests {
+			t.Error(r.StatusCode())
+		}
+		if s := string(r.ErrorMessage()); s != "request budget exhausted" {
+			t.Error(s)
+		}
+	}
+
+	// Budget is not shared by instances.
+	other, c2 := startTestLocalInstance(t, inst.local)
+	if r := request(other, c2); r.StatusCode() != http.StatusOK {
+		t.Error(r.StatusCode())
+	}
+
+	if _, err := New(&Config{Addr: s.URL, MaxRequestsPerInstance: -1}); err == nil {
+		t.Error("negative max requests per instance accepted")
+	}
+}
+
+func TestAnswerOptionsLocally(t *testing.T) {
+	var forwarded bool
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	for _, local := range []bool{false, true} {
+		forwarded = false
+
+		inst, c := startTestInstance(t, s, &Config{
+			AllowedMethods:       []string{http.MethodOptions, http.MethodPost, http.MethodGet},
+			AnswerOptionsLocally: local,
+		})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodOptions)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if forwarded == local {
+			t.Errorf("local %v: forwarded %v", local, forwarded)
+		}
+
+		if local {
+			if r.StatusCode() != http.StatusNoContent {
+				t.Error(r.StatusCode())
+			}
+			if string(r.Allow()) != "GET, OPTIONS, POST" {
+				t.Errorf("%q", r.Allow())
+			}
+			if v := testResponseHeader(r).Get("Allow"); v != "GET, OPTIONS, POST" {
+				t.Errorf("%q", v)
+			}
+		} else {
+			if r.StatusCode() != http.StatusOK {
+				t.Error(r.StatusCode())
+			}
+			if len(r.Allow()) != 0 {
+				t.Errorf("%q", r.Allow())
+			}
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request was sent")
+	}))
+	defer s.Close()
+
+	inst, c := startTestInstance(t, s, &Config{
+		AllowedPaths: []string{"/api"},
+		DryRun:       true,
+	})
+
+	for _, x := range []struct {
+		uri    string
+		status uint16
+	}{
+		{"/api/test?x=1", http.StatusNoContent},
+		{"/other", http.StatusForbidden},
+	} {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString(x.uri)
+		body := b.CreateByteString([]byte("hello"))
+		headers := buildTestHeaders(b, "X-Test", "1")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddBody(b, body)
+		flat.RequestAddHeaders(b, headers)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != x.status {
+			t.Errorf("%s: status %d", x.uri, r.StatusCode())
+		}
+
+		d := r.DryRun(nil)
+		if x.status != http.StatusNoContent {
+			if d != nil {
+				t.Errorf("%s: dry run", x.uri)
+			}
+			continue
+		}
+		if d == nil {
+			t.Fatalf("%s: no dry run", x.uri)
+		}
+		if string(d.Method()) != http.MethodPost {
+			t.Errorf("method: %q", d.Method())
+		}
+		if string(d.Url()) != s.URL+x.uri {
+			t.Errorf("url: %q", d.Url())
+		}
+		if d.HeaderCount() != 2 { // X-Test and User-Agent.
+			t.Errorf("header count: %d", d.HeaderCount())
+		}
+		if d.ContentLength() != 5 {
+			t.Errorf("content length: %d", d.ContentLength())
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header["Content-Type"])
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		config   string
+		request  string
+		body     bool
+		expected string
+	}{
+		{"", "", true, "[" + DefaultContentType + "]"},
+		{"", "", false, "[]"},
+		{"", "text/plain", true, "[text/plain]"},
+		{"application/json", "", true, "[application/json]"},
+		{NoContentType, "", true, "[]"},
+		{NoContentType, "text/plain", true, "[text/plain]"},
+	} {
+		inst, c := startTestInstance(t, s, &Config{
+			InlineBodyLimit:    DefaultInlineBodyLimit,
+			DefaultContentType: x.config,
+		})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodPost)
+		uri := b.CreateString("/")
+		contentType := b.CreateString(x.request)
+		body := b.CreateByteVector([]byte("data"))
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		flat.RequestAddContentType(b, contentType)
+		if x.body {
+			flat.RequestAddBody(b, body)
+		}
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if string(r.BodyBytes()) != x.expected {
+			t.Errorf("%q %q %v: %q", x.config, x.request, x.body, r.BodyBytes())
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.String())
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"ftp://proxy.invalid", "http://"} {
+		u, err := url.Parse(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(&Config{Addr: "http://backend.invalid", Proxy: u}); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+
+	local, err := New(&Config{
+		Addr:            "http://backend.invalid",
+		Proxy:           proxyURL,
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/path?x")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if string(r.BodyBytes()) != "http://backend.invalid/path?x" {
+		t.Errorf("%d %q", r.StatusCode(), r.BodyBytes())
+	}
+}
+
+func TestHostOverrides(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer s.Close()
+
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []map[string]string{
+		{"": "127.0.0.1"},
+		{"backend.invalid": ""},
+		{"backend.invalid": "localhost"},
+		{"backend.invalid": "127.0.0.1:x"},
+		{"backend.invalid": "127.0.0.1:0"},
+	} {
+		if _, err := New(&Config{Addr: "http://backend.invalid", HostOverrides: bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+
+	for _, x := range []struct {
+		addr      string
+		overrides map[string]string
+		host      string
+	}{
+		{"http://backend.invalid:" + port, map[string]string{"backend.invalid": "127.0.0.1"}, "backend.invalid:" + port},
+		{"http://Backend.Invalid:" + port, map[string]string{"backend.invalid": "127.0.0.1"}, "Backend.Invalid:" + port},
+		{"http://backend.invalid", map[string]string{"backend.invalid": s.Listener.Addr().String()}, "backend.invalid"},
+		{s.URL, map[string]string{"backend.invalid": "192.0.2.1"}, s.Listener.Addr().String()},
+	} {
+		local, err := New(&Config{
+			Addr:            x.addr,
+			HostOverrides:   x.overrides,
+			InlineBodyLimit: DefaultInlineBodyLimit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK || string(r.BodyBytes()) != x.host {
+			t.Errorf("%s: %d %q %q", x.addr, r.StatusCode(), r.ErrorMessage(), r.BodyBytes())
+		}
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	for _, x := range []struct {
+		addr   string
+		method string
+		uri    string
+		status uint16
+		kind   flat.ErrorKind
+	}{
+		{s.URL, http.MethodGet, "/ok", http.StatusNotFound, flat.ErrorKindNone},
+		{s.URL, "GET /", "/ok", http.StatusBadRequest, flat.ErrorKindBadRequest},
+		{s.URL, http.MethodDelete, "/ok", http.StatusMethodNotAllowed, flat.ErrorKindBlocked},
+		{s.URL, http.MethodGet, "/secret", http.StatusForbidden, flat.ErrorKindBlocked},
+		{s.URL, http.MethodGet, "/slow", http.StatusGatewayTimeout, flat.ErrorKindTimeout},
+		{closed.URL, http.MethodGet, "/ok", http.StatusServiceUnavailable, flat.ErrorKindConnectionRefused},
+		{tlsServer.URL, http.MethodGet, "/ok", http.StatusBadGateway, flat.ErrorKindTLSError},
+	} {
+		local, err := New(&Config{
+			Addr:            x.addr,
+			AllowedMethods:  []string{http.MethodGet},
+			AllowedPaths:    []string{"/ok", "/slow"},
+			RequestTimeout:  500 * time.Millisecond,
+			InlineBodyLimit: DefaultInlineBodyLimit,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(x.method)
+		uri := b.CreateString(x.uri)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != x.status || r.ErrorKind() != x.kind {
+			t.Errorf("%s %s %s: %d %s %q", x.addr, x.method, x.uri, r.StatusCode(), flat.EnumNamesErrorKind[r.ErrorKind()], r.ErrorMessage())
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join(r.Header["X-Middleware"], ","))
+	})
+
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	middleware := func(name string) func(http.RoundTripper) http.RoundTripper {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return testRoundTripper(func(req *http.Request) (*http.Response, error) {
+				req = req.Clone(req.Context())
+				req.Header.Add("X-Middleware", name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+
+	if _, err := New(&Config{Addr: s.URL, Middlewares: []func(http.RoundTripper) http.RoundTripper{nil}}); err == nil {
+		t.Error("nil middleware accepted")
+	}
+
+	for _, x := range []struct {
+		addr     string
+		insecure bool
+	}{
+		{s.URL, false},
+		{tlsServer.URL, true}, // Transport configuration is retained.
+	} {
+		local, err := New(&Config{
+			Addr:               x.addr,
+			InsecureSkipVerify: x.insecure,
+			InlineBodyLimit:    DefaultInlineBodyLimit,
+			Middlewares: []func(http.RoundTripper) http.RoundTripper{
+				middleware("outer"),
+				middleware("inner"),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK || string(r.BodyBytes()) != "outer,inner" {
+			t.Errorf("%s: %d %q %q", x.addr, r.StatusCode(), r.ErrorMessage(), r.BodyBytes())
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	var (
+		waiting = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	before := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/wait" {
+			close(waiting)
+			<-release
+		}
+		fmt.Fprint(w, "a")
+	}))
+	defer before.Close()
+
+	after := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "b")
+	}))
+	defer after.Close()
+
+	config := Config{
+		Addr:                  before.URL,
+		InlineBodyLimit:       DefaultInlineBodyLimit,
+		MaxConcurrentRequests: 1,
+		OverloadMode:          OverloadReject,
+		RequestsPerSecond:     1000,
+		BreakerThreshold:      10,
+		BreakerCooldown:       time.Second,
+	}
+
+	local, err := New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+
+	request := func(uri string) {
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uriString := b.CreateString(uri)
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uriString)
+		if err := inst.Handle(context.Background(), c, makeTestCall(t, b, flat.RequestEnd(b))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	receive := func(expect string) {
+		t.Helper()
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK || string(r.BodyBytes()) != expect {
+			t.Errorf("%d %q %q", r.StatusCode(), r.ErrorMessage(), r.BodyBytes())
+		}
+	}
+
+	request("/")
+	receive("a")
+
+	request("/wait") // In progress during reconfiguration.
+	<-waiting
+
+	prev := local.current()
+
+	config.Addr = after.URL
+	if err := local.Reconfigure(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Reconfigure(Config{}); err == nil {
+		t.Error("invalid configuration accepted")
+	}
+
+	next := local.current()
+	if next.concurrency != prev.concurrency || next.limiter != prev.limiter {
+		t.Error("shared state was not carried over")
+	}
+	if next.backends[""].breaker == prev.backends[""].breaker {
+		t.Error("breaker of other address was carried over")
+	}
+
+	// The request in progress still holds the concurrency slot.
+	request("/")
+	if r := flat.GetRootAsResponse(<-c, packet.HeaderSize); r.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("%d %q", r.StatusCode(), r.ErrorMessage())
+	}
+
+	close(release)
+	receive("a")
+
+	request("/")
+	receive("b")
+
+	if err := local.Reconfigure(config); err != nil {
+		t.Fatal(err)
+	}
+	if local.current().backends[""].breaker != next.backends[""].breaker {
+		t.Error("breaker was not carried over")
+	}
+
+	config.MaxConcurrentRequests = 2
+	config.RequestsPerSecond = 2000
+	if err := local.Reconfigure(config); err != nil {
+		t.Fatal(err)
+	}
+	if local.current().concurrency == next.concurrency || local.current().limiter == next.limiter {
+		t.Error("changed state was carried over")
+	}
+
+	if err := local.CheckBackend(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localhost-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	s.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	for name, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: certDER},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+		caFile:   {Type: "CERTIFICATE", Bytes: s.Certificate().Raw},
+	} {
+		if err := ioutil.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, config := range []Config{
+		{ClientCertFile: certFile},
+		{ClientCertFile: certFile, ClientKeyFile: caFile},
+		{RootCAFile: keyFile},
+		{RootCAFile: filepath.Join(dir, "missing.pem")},
+	} {
+		config.Addr = s.URL
+		if _, err := New(&config); err == nil {
+			t.Errorf("%#v accepted", config)
+		}
+	}
+
+	local, err := New(&Config{
+		Addr:            s.URL,
+		ClientCertFile:  certFile,
+		ClientKeyFile:   keyFile,
+		RootCAFile:      caFile,
+		InlineBodyLimit: DefaultInlineBodyLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, c := startTestLocalInstance(t, local)
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateString("/")
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	p := makeTestCall(t, b, flat.RequestEnd(b))
+
+	if err := inst.Handle(context.Background(), c, p); err != nil {
+		t.Fatal(err)
+	}
+	p = <-c
+
+	r := flat.GetRootAsResponse(p, packet.HeaderSize)
+	if string(r.BodyBytes()) != "test client" {
+		t.Errorf("%d %q %q", r.StatusCode(), r.BodyBytes(), r.ErrorMessage())
+	}
+}
+
+func TestExposeRemoteAddr(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	for _, expose := range []bool{false, true} {
+		inst, c := startTestInstance(t, s, &Config{ExposeRemoteAddr: expose})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Fatal(r.StatusCode())
+		}
+
+		var addr string
+		if expose {
+			addr = s.Listener.Addr().String()
+		}
+		if s := string(r.RemoteAddr()); s != addr {
+			t.Errorf("%v: %q", expose, s)
+		}
+	}
+}
+
+func TestExposeTLSInfo(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, s := range []*httptest.Server{httptest.NewServer(handler), httptest.NewTLSServer(handler)} {
+		defer s.Close()
+
+		inst, c := startTestInstance(t, s, &Config{ExposeTLSInfo: true})
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+		if r.StatusCode() != http.StatusOK {
+			t.Fatal(r.StatusCode(), string(r.ErrorMessage()))
+		}
+
+		if s.TLS == nil {
+			if r.TlsPeerSha256Length() != 0 || len(r.TlsSubject()) != 0 {
+				t.Errorf("%x %q", r.TlsPeerSha256Bytes(), r.TlsSubject())
+			}
+			continue
+		}
+
+		sum := sha256.Sum256(s.Certificate().Raw)
+		if !bytes.Equal(r.TlsPeerSha256Bytes(), sum[:]) {
+			t.Errorf("%x", r.TlsPeerSha256Bytes())
+		}
+		if string(r.TlsSubject()) != s.Certificate().Subject.String() {
+			t.Errorf("%q", r.TlsSubject())
+		}
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	for _, insecure := range []bool{false, true} {
+		var log bytes.Buffer
+
+		local, err := New(&Config{
+			Addr:               s.URL,
+			InsecureSkipVerify: insecure,
+			Logger:             slog.New(slog.NewTextHandler(&log, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(log.String(), "level=WARN"); warned != insecure {
+			t.Errorf("insecure %v: warning logged: %v", insecure, warned)
+		}
+
+		inst, c := startTestLocalInstance(t, local)
+
+		b := flatbuffers.NewBuilder(0)
+		method := b.CreateString(http.MethodGet)
+		uri := b.CreateString("/")
+		flat.RequestStart(b)
+		flat.RequestAddMethod(b, method)
+		flat.RequestAddUri(b, uri)
+		p := makeTestCall(t, b, flat.RequestEnd(b))
+
+		if err := inst.Handle(context.Background(), c, p); err != nil {
+			t.Fatal(err)
+		}
+		p = <-c
+
+		r := flat.GetRootAsResponse(p, packet.HeaderSize)
+		if insecure && r.StatusCode() != http.StatusOK {
+			t.Errorf("insecure: %d %q", r.StatusCode(), r.ErrorMessage())
+		}
+		if !insecure && r.StatusCode() != http.StatusBadGateway {
+			t.Errorf("secure: %d", r.StatusCode())
+		}
+	}
+}
+
+func BenchmarkConcurrentRequests(b *testing.B) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer s.Close()
+
+	for _, x := range []struct {
+		name   string
+		config Config
+	}{
+		{"Default", Config{}},
+		{"Tuned", Config{MaxIdleConns: 100, MaxIdleConnsPerHost: 100, IdleConnTimeout: time.Minute}},
+	} {
+		b.Run(x.name, func(b *testing.B) {
+			config := x.config
+			config.Addr = s.URL
+			config.InlineBodyLimit = DefaultInlineBodyLimit
+			local, err := New(&config)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetParallelism(4)
+			b.RunParallel(func(pb *testing.PB) {
+				inst, c := startTestLocalInstance(b, local)
+				defer inst.Shutdown(context.Background())
+
+				for pb.Next() {
+					fb := flatbuffers.NewBuilder(0)
+					method := fb.CreateString(http.MethodGet)
+					uri := fb.CreateString("/")
+					flat.RequestStart(fb)
+					flat.RequestAddMethod(fb, method)
+					flat.RequestAddUri(fb, uri)
+					p := makeTestCall(b, fb, flat.RequestEnd(fb))
+
+					if err := inst.Handle(context.Background(), c, p); err != nil {
+						b.Fatal(err)
+					}
+					<-c
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkStreamChunkSize(b *testing.B) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<18) // 4 MiB
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer s.Close()
+
+	for _, chunkSize := range []int{1024, 4096, DefaultStreamChunkSize, 65536} {
+		b.Run(strconv.Itoa(chunkSize), func(b *testing.B) {
+			local, err := New(&Config{
+				Addr:            s.URL,
+				StreamChunkSize: chunkSize,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			inst, c := startTestLocalInstance(b, local)
+			defer inst.Shutdown(context.Background())
+
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				fb := flatbuffers.NewBuilder(0)
+				method := fb.CreateString(http.MethodGet)
+				uri := fb.CreateString("/")
+				flat.RequestStart(fb)
+				flat.RequestAddMethod(fb, method)
+				flat.RequestAddUri(fb, uri)
+				p := makeTestCall(b, fb, flat.RequestEnd(fb))
+
+				if err := inst.Handle(context.Background(), c, p); err != nil {
+					b.Fatal(err)
+				}
+
+				r := flat.GetRootAsResponse(<-c, packet.HeaderSize)
+				if r.BodyStreamId() < 0 {
+					b.Fatal("body was not streamed")
+				}
+
+				for {
+					d := packet.DataBuf(<-c)
+					if d.DataLen() == 0 {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func startTestInstance(t *testing.T, s *httptest.Server, config *Config) (*instance, chan packet.Buf) {
+	t.Helper()
+
+	config.Addr = s.URL
+	local, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.backends[""].client = s.Client()
+
+	return startTestLocalInstance(t, local)
+}
+
+func startTestLocalInstance(t testing.TB, local *Localhost) (*instance, chan packet.Buf) {
+	t.Helper()
+
+	inst := newInstance(local, service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: testMaxSendSize,
+			Code:        testCode,
+		},
+	})
+
+	c := make(chan packet.Buf, 1)
+	if err := inst.Start(context.Background(), c, nil); err != nil {
+		t.Fatal(err)
+	}
+	return inst, c
+}
+
+func makeTestCall(t testing.TB, b *flatbuffers.Builder, request flatbuffers.UOffsetT) packet.Buf {
+	t.Helper()
+
+	flat.CallStart(b)
+	flat.CallAddFunctionType(b, flat.FunctionRequest)
+	flat.CallAddFunction(b, request)
+	b.Finish(flat.CallEnd(b))
+
+	p := packet.Make(testCode, packet.DomainCall, packet.HeaderSize+len(b.FinishedBytes()))
+	copy(p.Content(), b.FinishedBytes())
+
+	if !packet.IsValidCall(p, testCode) {
+		t.Error(p)
+	}
+	return p
+}
+
+func buildTestHeaders(b *flatbuffers.Builder, nameValues ...string) flatbuffers.UOffsetT {
+	var headers []flatbuffers.UOffsetT
+	for i := 0; i < len(nameValues); i += 2 {
+		name := b.CreateString(nameValues[i])
+		value := b.CreateString(nameValues[i+1])
+		flat.HeaderStart(b)
+		flat.HeaderAddName(b, name)
+		flat.HeaderAddValue(b, value)
+		headers = append(headers, flat.HeaderEnd(b))
+	}
+
+	flat.RequestStartHeadersVector(b, len(headers))
+	for i := len(headers) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(headers[i])
+	}
+	return b.EndVector(len(headers))
+}
+
+func testResponseHeader(r *flat.Response) http.Header {
+	h := make(http.Header)
+
+	var header flat.Header
+	for i := 0; i < r.HeadersLength(); i++ {
+		r.Headers(&header, i)
+		h.Add(string(header.Name()), string(header.Value()))
+	}
+	return h
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package localhosttest runs the localhost service against a fake backend.
+// Calls are made and responses are decoded without assembling flatbuffers or
+// packets by hand.
+package localhosttest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gate.computer/gate/packet"
+	"gate.computer/gate/service"
+	"gate.computer/localhost"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// Service packet parameters used by the instance.
+const (
+	Code        packet.Code = 1
+	MaxSendSize             = 65536
+)
+
+// Timeout for receiving a packet from the instance.
+const Timeout = 10 * time.Second
+
+const noteTrailers = 2 // Data packet contains a Trailers table.
+
+// Instance of the localhost service which uses a test server as its default
+// backend.
+type Instance struct {
+	Server   *httptest.Server
+	Service  *localhost.Localhost
+	Instance service.Instance
+	Packets  chan packet.Buf // Sent by the instance.
+
+	t testing.TB
+}
+
+// New starts a test server with the handler, and an instance which uses it as
+// the default backend.  Config may be nil; its Addr is overridden.  The
+// instance and the server are shut down when the test ends.
+func New(t testing.TB, handler http.Handler, config *localhost.Config) *Instance {
+	t.Helper()
+
+	if config == nil {
+		config = new(localhost.Config)
+	}
+
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+
+	c := *config
+	c.Addr = s.URL
+	local, err := localhost.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst, err := local.CreateInstance(context.Background(), service.InstanceConfig{
+		Service: packet.Service{
+			MaxSendSize: MaxSendSize,
+			Code:        Code,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan packet.Buf, 1)
+	if err := inst.Start(context.Background(), packets, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		defer cancel()
+		if err := inst.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return &Instance{
+		Server:   s,
+		Service:  local,
+		Instance: inst,
+		Packets:  packets,
+		t:        t,
+	}
+}
+
+// Call a function.  The function table must have been ended in b.
+func (inst *Instance) Call(b *flatbuffers.Builder, functionType flat.Function, function flatbuffers.UOffsetT) {
+	inst.t.Helper()
+
+	flat.CallStart(b)
+	flat.CallAddFunctionType(b, functionType)
+	flat.CallAddFunction(b, function)
+	b.Finish(flat.CallEnd(b))
+
+	p := packet.MakeCall(Code, len(b.FinishedBytes()))
+	copy(p.Content(), b.FinishedBytes())
+	inst.Send(p)
+}
+
+// Send a packet to the instance.
+func (inst *Instance) Send(p packet.Buf) {
+	inst.t.Helper()
+
+	if err := inst.Instance.Handle(context.Background(), inst.Packets, p); err != nil {
+		inst.t.Fatal(err)
+	}
+}
+
+// Receive the next packet sent by the instance.
+func (inst *Instance) Receive() packet.Buf {
+	inst.t.Helper()
+
+	timer := time.NewTimer(Timeout)
+	defer timer.Stop()
+
+	select {
+	case p := <-inst.Packets:
+		return p
+
+	case <-timer.C:
+		inst.t.Fatal("localhosttest: timeout while receiving packet")
+		return nil
+	}
+}
+
+// Response receives the next packet, which must be a call response.
+func (inst *Instance) Response() *flat.Response {
+	inst.t.Helper()
+
+	p := inst.Receive()
+	if p.Domain() != packet.DomainCall {
+		inst.t.Fatalf("localhosttest: received %v packet instead of response", p.Domain())
+	}
+	return flat.GetRootAsResponse(p, packet.HeaderSize)
+}
+
+// Request calls the Request function without body and receives its response.
+// Headers are specified as name-value pairs.
+func (inst *Instance) Request(method, uri string, nameValues ...string) *flat.Response {
+	inst.t.Helper()
+
+	b := flatbuffers.NewBuilder(0)
+	methodOffset := b.CreateString(method)
+	uriOffset := b.CreateString(uri)
+	var headers flatbuffers.UOffsetT
+	if len(nameValues) > 0 {
+		headers = BuildHeaders(b, nameValues...)
+	}
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, methodOffset)
+	flat.RequestAddUri(b, uriOffset)
+	if headers != 0 {
+		flat.RequestAddHeaders(b, headers)
+	}
+	inst.Call(b, flat.FunctionRequest, flat.RequestEnd(b))
+
+	return inst.Response()
+}
+
+// Body of a response.  If the body is streamed, its data packets are received
+// until the final packet.  Other packets are not expected in the meantime.
+func (inst *Instance) Body(r *flat.Response) []byte {
+	inst.t.Helper()
+
+	id := r.BodyStreamId()
+	if id < 0 {
+		return r.BodyBytes()
+	}
+
+	var body []byte
+	for {
+		p := inst.Receive()
+		if p.Domain() != packet.DomainData {
+			inst.t.Fatalf("localhosttest: received %v packet instead of data", p.Domain())
+		}
+		d := packet.DataBuf(p)
+		if d.ID() != id {
+			inst.t.Fatalf("localhosttest: received data for stream %d instead of %d", d.ID(), id)
+		}
+		if d.DataLen() == 0 {
+			return body
+		}
+		if d.Note() != noteTrailers {
+			body = append(body, d.Data()...)
+		}
+	}
+}
+
+// AssertStatus of a response.
+func (inst *Instance) AssertStatus(r *flat.Response, status int) {
+	inst.t.Helper()
+
+	if int(r.StatusCode()) != status {
+		inst.t.Errorf("status: %d (%s) instead of %d", r.StatusCode(), r.ErrorMessage(), status)
+	}
+}
+
+// AssertBody of a response.  A streamed body is received.
+func (inst *Instance) AssertBody(r *flat.Response, body string) {
+	inst.t.Helper()
+
+	if b := inst.Body(r); !bytes.Equal(b, []byte(body)) {
+		inst.t.Errorf("body: %q instead of %q", b, body)
+	}
+}
+
+// AssertHeader value of a response.  Empty value means that the header must
+// not be present.
+func (inst *Instance) AssertHeader(r *flat.Response, name, value string) {
+	inst.t.Helper()
+
+	if v := Header(r).Get(name); v != value {
+		inst.t.Errorf("header %s: %q instead of %q", name, v, value)
+	}
+}
+
+// Header of a response.
+func Header(r *flat.Response) http.Header {
+	h := make(http.Header)
+
+	var header flat.Header
+	for i := 0; i < r.HeadersLength(); i++ {
+		r.Headers(&header, i)
+		h.Add(string(header.Name()), string(header.Value()))
+	}
+	return h
+}
+
+// BuildHeaders creates a header vector from name-value pairs.
+func BuildHeaders(b *flatbuffers.Builder, nameValues ...string) flatbuffers.UOffsetT {
+	var headers []flatbuffers.UOffsetT
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		name := b.CreateString(nameValues[i])
+		value := b.CreateString(nameValues[i+1])
+		flat.HeaderStart(b)
+		flat.HeaderAddName(b, name)
+		flat.HeaderAddValue(b, value)
+		headers = append(headers, flat.HeaderEnd(b))
+	}
+
+	flat.RequestStartHeadersVector(b, len(headers))
+	for i := len(headers) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(headers[i])
+	}
+	return b.EndVector(len(headers))
+}
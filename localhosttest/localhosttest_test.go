@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhosttest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"gate.computer/localhost"
+)
+
+func TestInstance(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Echo", r.Header.Get("X-Test"))
+		io.WriteString(w, "hello")
+	})
+
+	for _, limit := range []int64{0, localhost.DefaultInlineBodyLimit} {
+		inst := New(t, handler, &localhost.Config{InlineBodyLimit: limit})
+
+		r := inst.Request(http.MethodGet, "/", "X-Test", "foo")
+		inst.AssertStatus(r, http.StatusOK)
+		inst.AssertHeader(r, "X-Echo", "foo")
+		inst.AssertBody(r, "hello")
+
+		if streamed := r.BodyStreamId() >= 0; streamed != (limit == 0) {
+			t.Errorf("inline body limit %d: streamed: %v", limit, streamed)
+		}
+	}
+}
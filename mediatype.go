@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"mime"
+	"strings"
+)
+
+// isMediaTypePattern checks if p is a lower-case media type without
+// parameters, or a type followed by "/*".
+func isMediaTypePattern(p string) bool {
+	i := strings.IndexByte(p, '/')
+	if i < 0 || p != strings.ToLower(p) || p[:i] == "*" {
+		return false
+	}
+	if p[i+1:] == "*" {
+		return isToken(p[:i])
+	}
+	return isToken(p[:i]) && isToken(p[i+1:])
+}
+
+// mediaTypeAllowed checks if the media type of a Content-Type header value
+// matches one of the patterns.  Missing or malformed value is not allowed.
+func mediaTypeAllowed(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range patterns {
+		if p == mediaType {
+			return true
+		}
+		if prefix := strings.TrimSuffix(p, "*"); len(prefix) < len(p) && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
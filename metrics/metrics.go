@@ -0,0 +1,210 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics implements localhost.Metrics and localhost.SuspendMetrics.
+// The collected metrics are served in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are request duration histogram bucket upper bounds in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative.
+	sum    float64
+	count  uint64
+}
+
+// suspension counters of suspend or resume events.
+type suspension struct {
+	count     uint64
+	requests  uint64
+	unsent    uint64
+	snapshots uint64 // Bytes.
+}
+
+// Collector of localhost_requests_total counter,
+// localhost_request_duration_seconds histogram, and localhost_suspensions_total,
+// localhost_suspended_packets_total and localhost_snapshot_bytes_total
+// counters.
+type Collector struct {
+	buckets []float64
+
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+	suspended suspension
+	resumed   suspension
+}
+
+// New collector.  DefaultBuckets are used if buckets is nil.
+func New(buckets []float64) *Collector {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	return &Collector{
+		buckets:   buckets,
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// ObserveRequest implements localhost.Metrics.
+func (c *Collector) ObserveRequest(method string, status int, d time.Duration) {
+	seconds := d.Seconds()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requests[requestKey{method, status}]++
+
+	h := c.durations[method]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		c.durations[method] = h
+	}
+	for i, bound := range c.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// ObserveSuspend implements localhost.SuspendMetrics.
+func (c *Collector) ObserveSuspend(requests, unsent, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.suspended.observe(requests, unsent, size)
+}
+
+// ObserveResume implements localhost.SuspendMetrics.
+func (c *Collector) ObserveResume(requests, unsent, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.resumed.observe(requests, unsent, size)
+}
+
+func (s *suspension) observe(requests, unsent, size int) {
+	s.count++
+	s.requests += uint64(requests)
+	s.unsent += uint64(unsent)
+	s.snapshots += uint64(size)
+}
+
+// WriteTo writes the metrics in text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	b := bufio.NewWriter(cw)
+
+	keys := make([]requestKey, 0, len(c.requests))
+	for k := range c.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	fmt.Fprintln(b, "# HELP localhost_requests_total Backend requests made by the localhost service.")
+	fmt.Fprintln(b, "# TYPE localhost_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(b, "localhost_requests_total{method=%q,status=\"%d\"} %d\n", k.method, k.status, c.requests[k])
+	}
+
+	methods := make([]string, 0, len(c.durations))
+	for method := range c.durations {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintln(b, "# HELP localhost_request_duration_seconds Backend request durations.")
+	fmt.Fprintln(b, "# TYPE localhost_request_duration_seconds histogram")
+	for _, method := range methods {
+		h := c.durations[method]
+
+		var cumulative uint64
+		for i, bound := range c.buckets {
+			cumulative += h.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(b, "localhost_request_duration_seconds_bucket{method=%q,le=%q} %d\n", method, le, cumulative)
+		}
+		fmt.Fprintf(b, "localhost_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(b, "localhost_request_duration_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(b, "localhost_request_duration_seconds_count{method=%q} %d\n", method, h.count)
+	}
+
+	events := []struct {
+		name string
+		s    *suspension
+	}{
+		{"suspend", &c.suspended},
+		{"resume", &c.resumed},
+	}
+
+	fmt.Fprintln(b, "# HELP localhost_suspensions_total Instance suspensions and resumptions.")
+	fmt.Fprintln(b, "# TYPE localhost_suspensions_total counter")
+	for _, e := range events {
+		fmt.Fprintf(b, "localhost_suspensions_total{event=%q} %d\n", e.name, e.s.count)
+	}
+
+	fmt.Fprintln(b, "# HELP localhost_suspended_packets_total Pending incoming calls and buffered outgoing packets in snapshots.")
+	fmt.Fprintln(b, "# TYPE localhost_suspended_packets_total counter")
+	for _, e := range events {
+		fmt.Fprintf(b, "localhost_suspended_packets_total{event=%q,direction=\"incoming\"} %d\n", e.name, e.s.requests)
+		fmt.Fprintf(b, "localhost_suspended_packets_total{event=%q,direction=\"outgoing\"} %d\n", e.name, e.s.unsent)
+	}
+
+	fmt.Fprintln(b, "# HELP localhost_snapshot_bytes_total Size of instance snapshots.")
+	fmt.Fprintln(b, "# TYPE localhost_snapshot_bytes_total counter")
+	for _, e := range events {
+		fmt.Fprintf(b, "localhost_snapshot_bytes_total{event=%q} %d\n", e.name, e.s.snapshots)
+	}
+
+	err := b.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics in text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	return
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"gate.computer/localhost"
+)
+
+var (
+	_ localhost.Metrics        = new(Collector)
+	_ localhost.SuspendMetrics = new(Collector)
+)
+
+func TestCollector(t *testing.T) {
+	c := New([]float64{0.1, 1})
+	c.ObserveRequest("GET", 200, 50*time.Millisecond)
+	c.ObserveRequest("GET", 200, 500*time.Millisecond)
+	c.ObserveRequest("GET", 0, 5*time.Second)
+
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`localhost_requests_total{method="GET",status="0"} 1`,
+		`localhost_requests_total{method="GET",status="200"} 2`,
+		`localhost_request_duration_seconds_bucket{method="GET",le="0.1"} 1`,
+		`localhost_request_duration_seconds_bucket{method="GET",le="1"} 2`,
+		`localhost_request_duration_seconds_bucket{method="GET",le="+Inf"} 3`,
+		`localhost_request_duration_seconds_count{method="GET"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing: %s", line)
+		}
+	}
+}
+
+func TestCollectorSuspension(t *testing.T) {
+	c := New(nil)
+	c.ObserveSuspend(2, 5, 1000)
+	c.ObserveSuspend(0, 1, 100)
+	c.ObserveResume(2, 5, 1000)
+
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`localhost_suspensions_total{event="suspend"} 2`,
+		`localhost_suspensions_total{event="resume"} 1`,
+		`localhost_suspended_packets_total{event="suspend",direction="incoming"} 2`,
+		`localhost_suspended_packets_total{event="suspend",direction="outgoing"} 6`,
+		`localhost_suspended_packets_total{event="resume",direction="outgoing"} 5`,
+		`localhost_snapshot_bytes_total{event="suspend"} 1100`,
+		`localhost_snapshot_bytes_total{event="resume"} 1000`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing: %s", line)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// multipartStreamIDs of parts with streamed bodies.
+func multipartStreamIDs(call flat.Multipart) (ids []int32) {
+	var part flat.Part
+	for i := 0; i < call.PartsLength(); i++ {
+		call.Parts(&part, i)
+		if id := part.BodyStreamId(); id >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// handleMultipart is implemented in terms of handleRequest.  The uploads of
+// streamed parts are keyed by stream id.
+func handleMultipart(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	jar *cookieJar, call flat.Multipart, uploads map[int32]*upload,
+) ([]byte, *stream) {
+	var (
+		buf      bytes.Buffer
+		w        = multipart.NewWriter(&buf)
+		readers  []io.Reader
+		body     = new(multipartBody)
+		length   int64 // Negative if unknown.
+		streamID int32 = -1
+	)
+
+	// flush multipart framing which has been written to buf.
+	flush := func() {
+		data := append([]byte(nil), buf.Bytes()...)
+		buf.Reset()
+		readers = append(readers, bytes.NewReader(data))
+		body.inline += int64(len(data))
+		if length >= 0 {
+			length += int64(len(data))
+		}
+	}
+
+	var part flat.Part
+	for i := 0; i < call.PartsLength(); i++ {
+		call.Parts(&part, i)
+
+		disposition := `form-data; name="` + quoteEscaper.Replace(string(part.Name())) + `"`
+		contentType := string(part.ContentType())
+		if filename := part.Filename(); len(filename) > 0 {
+			disposition += `; filename="` + quoteEscaper.Replace(string(filename)) + `"`
+			if contentType == "" {
+				contentType = DefaultContentType
+			}
+		}
+		if !isHeaderValue(disposition) || !isHeaderValue(contentType) {
+			return buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusBadRequest, "invalid part"), nil
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", disposition)
+		if contentType != "" {
+			h.Set("Content-Type", contentType)
+		}
+		w.CreatePart(h) // Writing to buffer doesn't fail.
+		flush()
+
+		if id := part.BodyStreamId(); id >= 0 {
+			u := uploads[id]
+			if u == nil || part.BodyLength() > 0 || part.ContentLength() == 0 || part.ContentLength() < -1 {
+				return buildErrorResponse(flatbuffers.NewBuilder(0), http.StatusBadRequest, "invalid body stream"), nil
+			}
+			delete(uploads, id) // Stream may not be used by multiple parts.
+
+			readers = append(readers, u)
+			body.uploads = append(body.uploads, u)
+			if n := part.ContentLength(); n < 0 {
+				length = -1
+			} else if length >= 0 {
+				length += n
+			}
+			if streamID < 0 {
+				streamID = id
+			}
+		} else {
+			data := part.BodyBytes()
+			readers = append(readers, bytes.NewReader(data))
+			body.inline += int64(len(data))
+			if length >= 0 {
+				length += int64(len(data))
+			}
+		}
+	}
+
+	w.Close()
+	flush()
+
+	var data []byte
+	if streamID < 0 {
+		data, _ = ioutil.ReadAll(io.MultiReader(readers...)) // In memory.
+	} else {
+		body.Reader = io.MultiReader(readers...)
+	}
+
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodPost)
+	uri := b.CreateByteString(call.Uri())
+	backend := b.CreateByteString(call.Backend())
+	contentType := b.CreateString(w.FormDataContentType())
+	var inline flatbuffers.UOffsetT
+	if len(data) > 0 {
+		inline = b.CreateByteVector(data)
+	}
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBackend(b, backend)
+	flat.RequestAddContentType(b, contentType)
+	if inline != 0 {
+		flat.RequestAddBody(b, inline)
+	}
+	if streamID >= 0 {
+		flat.RequestAddBodyStreamId(b, streamID)
+		flat.RequestAddContentLength(b, length)
+	}
+	b.Finish(flat.RequestEnd(b))
+
+	var reqBody requestBody
+	if streamID >= 0 {
+		reqBody = body
+	}
+	return handleRequest(ctx, local, config, streams, jar, *flat.GetRootAsRequest(b.FinishedBytes(), 0), reqBody)
+}
+
+// multipartBody reads the framing and the parts in order.
+type multipartBody struct {
+	io.Reader
+	uploads []*upload
+	inline  int64 // Size of framing and non-streamed parts.
+}
+
+// start the uploads.  The limit applies to the whole body.
+func (m *multipartBody) start(limit int64) {
+	if limit <= 0 {
+		for _, u := range m.uploads {
+			u.start(0)
+		}
+		return
+	}
+
+	budget := limit - m.inline
+	for _, u := range m.uploads {
+		u.startShared(&budget)
+	}
+}
+
+func (m *multipartBody) Close() error {
+	for _, u := range m.uploads {
+		u.Close()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type restartKey struct{}
+
+// withRestartState returns a context which carries the handling state of a
+// restartable request, so that a failure caused by its restart isn't observed.
+func withRestartState(ctx context.Context, state *int32) context.Context {
+	return context.WithValue(ctx, restartKey{}, state)
+}
+
+// isRestarting reports if the request is being restarted due to suspension.  It
+// will be observed after resumption.
+func isRestarting(ctx context.Context) bool {
+	state, ok := ctx.Value(restartKey{}).(*int32)
+	return ok && atomic.LoadInt32(state) == 2
+}
+
+// doTraced sends the request with the given context, within a span if tracing
+// is enabled.
+func (l *Localhost) doTraced(ctx context.Context, client *http.Client, req *http.Request,
+) (*http.Response, error) {
+	var span Span
+	if l.tracer != nil {
+		ctx, span = l.tracer.StartSpan(ctx, req)
+	}
+
+	res, err := l.do(ctx, client, req.WithContext(ctx))
+
+	if span != nil {
+		var status int
+		if res != nil {
+			status = res.StatusCode
+		}
+		span.End(status, err)
+	}
+	return res, err
+}
+
+// observeResponse by logging and updating metrics, if enabled.  Body length
+// is -1 if unknown.
+func (l *Localhost) observeResponse(ctx context.Context, req *http.Request, status int, d time.Duration, bodyLen int64,
+) {
+	if l.metrics != nil {
+		l.metrics.ObserveRequest(req.Method, status, d)
+	}
+
+	if l.logger == nil {
+		return
+	}
+
+	l.logger.LogAttrs(ctx, slog.LevelInfo, "localhost request",
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("host", req.URL.Host),
+		slog.Int("status", status),
+		slog.Duration("duration", d),
+		slog.Int64("body_length", bodyLen),
+	)
+}
+
+// observeError by logging and updating metrics, if enabled.  Requests which
+// are being restarted are not observed.
+func (l *Localhost) observeError(ctx context.Context, req *http.Request, d time.Duration, err error) {
+	if isRestarting(ctx) {
+		return
+	}
+
+	if l.metrics != nil {
+		l.metrics.ObserveRequest(req.Method, 0, d)
+	}
+
+	if l.logger == nil {
+		return
+	}
+
+	l.logger.LogAttrs(ctx, slog.LevelError, "localhost request failed",
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("host", req.URL.Host),
+		slog.Duration("duration", d),
+		slog.Any("error", err),
+	)
+}
+
+// observeLengthMismatch by logging, if enabled.  Body length is -1 if it is
+// unknown.
+func (l *Localhost) observeLengthMismatch(ctx context.Context, req *http.Request, declared []string, bodyLen int64,
+) {
+	if l.logger == nil {
+		return
+	}
+
+	l.logger.LogAttrs(ctx, slog.LevelWarn, "localhost request content length mismatch",
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("host", req.URL.Host),
+		slog.Any("declared", declared),
+		slog.Int64("body_length", bodyLen),
+	)
+}
+
+// observeSuspend by logging and updating metrics, if enabled.
+func (l *Localhost) observeSuspend(ctx context.Context, requests, unsent, size int) {
+	if m, ok := l.metrics.(SuspendMetrics); ok {
+		m.ObserveSuspend(requests, unsent, size)
+	}
+
+	if l.logger == nil {
+		return
+	}
+
+	l.logger.LogAttrs(ctx, slog.LevelInfo, "localhost instance suspended",
+		slog.Int("requests", requests),
+		slog.Int("unsent", unsent),
+		slog.Int("snapshot_size", size),
+	)
+}
+
+// observeResume by logging and updating metrics, if enabled.
+func (l *Localhost) observeResume(ctx context.Context, requests, unsent, size int) {
+	if m, ok := l.metrics.(SuspendMetrics); ok {
+		m.ObserveResume(requests, unsent, size)
+	}
+
+	if l.logger == nil {
+		return
+	}
+
+	l.logger.LogAttrs(ctx, slog.LevelInfo, "localhost instance resumed",
+		slog.Int("requests", requests),
+		slog.Int("unsent", unsent),
+		slog.Int("snapshot_size", size),
+	)
+}
+
+// observeRetry by logging, if enabled.  Response is nil if the attempt failed
+// without one.
+func (l *Localhost) observeRetry(ctx context.Context, req *http.Request, attempt int, res *http.Response, err error,
+) {
+	if l.logger == nil {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("host", req.URL.Host),
+		slog.Int("attempt", attempt),
+	}
+	if res != nil {
+		attrs = append(attrs, slog.Int("status", res.StatusCode))
+	} else {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+
+	l.logger.LogAttrs(ctx, slog.LevelDebug, "localhost request retry", attrs...)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"errors"
+)
+
+// OverloadMode determines what happens to a request when the maximum number
+// of concurrent requests has been reached.
+type OverloadMode int
+
+const (
+	OverloadWait   OverloadMode = iota // Wait until another request finishes.
+	OverloadReject                     // Respond with status 503.
+)
+
+var errOverloaded = errors.New("localhost: too many concurrent requests")
+
+// semaphore limits the number of concurrent backend requests made by all
+// instances.
+type semaphore struct {
+	slots  chan struct{}
+	reject bool
+}
+
+func newSemaphore(n int, mode OverloadMode) *semaphore {
+	return &semaphore{
+		slots:  make(chan struct{}, n),
+		reject: mode == OverloadReject,
+	}
+}
+
+func (s *semaphore) sameSettings(other *semaphore) bool {
+	return cap(s.slots) == cap(other.slots) && s.reject == other.reject
+}
+
+// acquire a slot.  Depending on mode, errOverloaded is returned immediately or
+// the context's error after cancellation.
+func (s *semaphore) acquire(ctx context.Context) error {
+	if s.reject {
+		select {
+		case s.slots <- struct{}{}:
+			return nil
+		default:
+			return errOverloaded
+		}
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *semaphore) release() {
+	<-s.slots
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"path"
+	"strings"
+)
+
+// cleanPath resolves dot segments and duplicate slashes.  The result is
+// absolute, and retains a trailing slash.
+func cleanPath(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// pathAllowed checks if a clean path is one of the allowed paths or below one.
+func pathAllowed(p string, allowed []string) bool {
+	for _, prefix := range allowed {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if len(p) == len(prefix) || strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RateLimitMode determines what happens to a request when the rate limit has
+// been reached.
+type RateLimitMode int
+
+const (
+	RateLimitWait   RateLimitMode = iota // Wait until the request is allowed.
+	RateLimitReject                      // Respond with status 429.
+)
+
+var errRateLimited = errors.New("localhost: rate limit exceeded")
+
+// rateLimiter is a token bucket.  The request rate limiter is shared by all
+// instances; response streams have their own byte rate limiters.
+type rateLimiter struct {
+	rate   float64 // Tokens per second.
+	burst  float64
+	reject bool
+
+	mu     sync.Mutex
+	tokens float64 // Negative when requests are waiting.
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, mode RateLimitMode) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		reject: mode == RateLimitReject,
+		tokens: float64(burst),
+	}
+}
+
+func (r *rateLimiter) sameSettings(other *rateLimiter) bool {
+	return r.rate == other.rate && r.burst == other.burst && r.reject == other.reject
+}
+
+// take a token.  Depending on mode, errRateLimited is returned immediately or
+// the context's error after cancellation.
+func (l *rateLimiter) take(ctx context.Context) error {
+	delay, ok := l.reserve(time.Now(), 1)
+	if !ok {
+		return errRateLimited
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++ // Return the reservation.
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// reserve n tokens.  The tokens may be reserved in advance, in which case the
+// time until they become available is returned.
+func (l *rateLimiter) reserve(now time.Time, n float64) (delay time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens >= n {
+		l.tokens -= n
+		return 0, true
+	}
+	if l.reject {
+		return 0, false
+	}
+
+	l.tokens -= n
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
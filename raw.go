@@ -0,0 +1,277 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// handleRawRequest writes a request message verbatim to a new connection to
+// the backend.  The response message is streamed as it is received.
+func handleRawRequest(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	call flat.RawRequest,
+) (_ []byte, st *stream) {
+	b := flatbuffers.NewBuilder(0)
+
+	if !local.rawRequests {
+		return buildErrorResponse(b, http.StatusNotImplemented, "raw requests not enabled"), nil
+	}
+
+	backend := local.backends[string(call.Backend())]
+	if backend == nil {
+		return buildErrorResponse(b, http.StatusBadRequest, "unknown backend"), nil
+	}
+
+	data := call.DataBytes()
+	if limit := local.maxRequestBody; limit > 0 && int64(len(data)) > limit {
+		return buildErrorResponse(b, http.StatusRequestEntityTooLarge, "request body too large"), nil
+	}
+
+	req, status, message := parseRawRequest(local, backend, data)
+	if req == nil {
+		return buildErrorResponse(b, status, message), nil
+	}
+	if errRes := authorizeRequest(b, local, req); errRes != nil {
+		return errRes, nil
+	}
+
+	if local.dryRun {
+		return buildDryRunResponse(b, req, req.ContentLength), nil
+	}
+
+	var cancel context.CancelFunc
+	if local.requestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, local.requestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer func() {
+		if st == nil {
+			cancel()
+		}
+	}()
+
+	if local.limiter != nil {
+		if err := local.limiter.take(ctx); err != nil {
+			return buildTransportErrorResponse(ctx, b, err), nil
+		}
+	}
+
+	if err := takeBudget(ctx); err != nil {
+		return buildTransportErrorResponse(ctx, b, err), nil
+	}
+
+	start := time.Now()
+
+	if backend.breaker != nil && !backend.breaker.allow(start) {
+		return buildErrorResponse(b, http.StatusServiceUnavailable, "backend unavailable"), nil
+	}
+
+	body, res, err := sendRawRequest(ctx, backend, req, data)
+	if backend.breaker != nil {
+		backend.breaker.done(time.Now(), err, false)
+	}
+	if err != nil {
+		local.observeError(ctx, req, time.Since(start), err)
+		return buildTransportErrorResponse(ctx, b, err), nil
+	}
+	local.observeResponse(ctx, req, res.StatusCode, time.Since(start), -1)
+
+	st = &stream{
+		id:     streams.newID(),
+		body:   body,
+		cancel: cancel,
+		start:  start,
+	}
+	if local.bytesPerSecond > 0 {
+		st.throttle = newRateLimiter(local.bytesPerSecond, streamChunkSize(local, config), RateLimitWait)
+	}
+
+	statusText := b.CreateString(responseStatusText(res))
+
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, uint16(res.StatusCode))
+	flat.ResponseAddStatusText(b, statusText)
+	flat.ResponseAddTtfbMs(b, milliseconds(time.Since(start)))
+	flat.ResponseAddBodyStreamId(b, st.id)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes(), st
+}
+
+// parseRawRequest checks that a request message is complete and conforms to
+// the configuration.  The message must not contain anything which could be
+// interpreted differently by the backend, such as another request.
+func parseRawRequest(local *Localhost, backend *backend, data []byte,
+) (req *http.Request, status uint16, message string) {
+	status = http.StatusBadRequest
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, status, "invalid request"
+	}
+
+	// Transfer-Encoding overrides Content-Length without an error.
+	tr := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	tr.ReadLine()
+	if h, err := tr.ReadMIMEHeader(); err != nil || (h["Content-Length"] != nil && h["Transfer-Encoding"] != nil) {
+		return nil, status, "invalid request"
+	}
+
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		return nil, status, "invalid request body"
+	}
+	if _, err := r.Peek(1); err != io.EOF {
+		return nil, status, "trailing data"
+	}
+
+	if req.ProtoMajor != 1 || req.ProtoMinor != 1 {
+		return nil, status, "unsupported protocol"
+	}
+	if !strings.HasPrefix(req.RequestURI, "/") {
+		return nil, status, "invalid URI"
+	}
+	if req.Header.Get("Upgrade") != "" {
+		return nil, status, "upgrade not allowed"
+	}
+	if local.maxReqHeaders > 0 && headerCount(req.Header) > local.maxReqHeaders {
+		return nil, status, "too many headers"
+	}
+
+	if _, ok := local.methods[req.Method]; !ok || req.Method == http.MethodConnect {
+		return nil, http.StatusMethodNotAllowed, "method not allowed"
+	}
+
+	status = http.StatusForbidden
+
+	host := backend.host
+	if local.overrideHost != "" {
+		host = local.overrideHost
+	}
+	if !strings.EqualFold(req.Host, host) {
+		return nil, status, "host not allowed"
+	}
+
+	if local.allowedPaths != nil || local.authorize != nil {
+		// The backend must not resolve the path differently.
+		if p := req.URL.Path; cleanPath(p) != p || (local.allowedPaths != nil && !pathAllowed(p, local.allowedPaths)) {
+			return nil, status, "path not allowed"
+		}
+	}
+
+	for key := range req.Header {
+		if _, found := local.protectedHeaders[key]; found {
+			return nil, status, "header not allowed"
+		}
+	}
+	if (local.basicAuth != nil || local.bearerToken != "") && req.Header["Authorization"] != nil {
+		return nil, status, "header not allowed"
+	}
+
+	return req, 0, ""
+}
+
+// sendRawRequest writes the request message and reads the response header.
+// Informational responses are skipped.  The returned body yields the raw
+// response message, including the header.
+func sendRawRequest(ctx context.Context, backend *backend, req *http.Request, data []byte,
+) (*rawResponse, *http.Response, error) {
+	conn, err := backend.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := &rawResponse{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	// The connection is closed if the context is done before the response
+	// has been streamed.
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-body.done:
+		}
+	}()
+
+	if _, err := conn.Write(data); err != nil {
+		body.Close()
+		return nil, nil, contextError(ctx, err)
+	}
+
+	r := bufio.NewReader(io.TeeReader(conn, &body.buf))
+	for {
+		res, err := http.ReadResponse(r, req)
+		if err != nil {
+			body.Close()
+			return nil, nil, contextError(ctx, err)
+		}
+		if res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+
+		body.res = res.Body
+		return body, res, nil
+	}
+}
+
+// contextError returns the context's error if it's done.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// rawResponse yields the data which has been read from the connection.
+// Reading the parsed response body makes more data available.
+type rawResponse struct {
+	conn net.Conn
+	res  io.Reader // Parsed body.
+	buf  bytes.Buffer
+	eof  bool
+	done chan struct{}
+	once sync.Once
+}
+
+func (r *rawResponse) Read(b []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		_, err := r.res.Read(b) // Scratch space; data is copied to buf.
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	return r.buf.Read(b)
+}
+
+func (r *rawResponse) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return r.conn.Close()
+}
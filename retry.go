@@ -0,0 +1,221 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxRetryBackoff limits the doubling of RetryBackoff.
+const maxRetryBackoff = time.Minute
+
+var errReplayBodyTooLarge = errors.New("localhost: request body too large to replay")
+
+var idempotentMethods = map[string]struct{}{
+	http.MethodGet:     {},
+	http.MethodHead:    {},
+	http.MethodPut:     {},
+	http.MethodDelete:  {},
+	http.MethodOptions: {},
+}
+
+// randomUUID generates a version 4 UUID for an idempotency key.
+func randomUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// do the request, retrying transient failures as configured.
+func (l *Localhost) do(ctx context.Context, client *http.Client, req *http.Request,
+) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := l.doAttempt(client, req)
+		if attempt > l.maxRetries || !retryable(req, res, err) {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+
+		l.observeRetry(ctx, req, attempt, res, err)
+
+		if d := retryDelay(l.retryBackoff, attempt); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// retryDelay after the failed attempt.  The base delay is doubled for each
+// subsequent attempt, up to maxRetryBackoff.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+		if d > maxRetryBackoff {
+			d = maxRetryBackoff
+		}
+	}
+	return d
+}
+
+// doAttempt sends the request once, while holding a concurrency slot if the
+// number of concurrent requests is limited.  The attempt is charged to the
+// instance's budget.
+func (l *Localhost) doAttempt(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := takeBudget(req.Context()); err != nil {
+		return nil, err
+	}
+
+	if l.concurrency != nil {
+		if err := l.concurrency.acquire(req.Context()); err != nil {
+			return nil, err
+		}
+		defer l.concurrency.release()
+	}
+
+	return client.Do(req)
+}
+
+// retryable checks if an attempt failed transiently, and if the request can
+// be repeated.
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	body := req.Body
+	if c, ok := body.(*uploadCounter); ok {
+		body = c.ReadCloser
+	}
+	if r, ok := body.(*replayReader); ok && !r.buf.replayable() {
+		return false
+	}
+
+	if err != nil {
+		if !transientError(err) {
+			return false
+		}
+		if notSent(err) {
+			return true
+		}
+	} else if res.StatusCode != http.StatusBadGateway && res.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+
+	// Backend is expected to deduplicate requests with the same key.
+	if req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+
+	_, idempotent := idempotentMethods[req.Method]
+	return idempotent
+}
+
+func transientError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// notSent checks if the request failed before it could be sent.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// replayBuffer records a streamed request body up to a limit, so that it can
+// be sent again.
+type replayBuffer struct {
+	r     io.Reader
+	limit int64
+
+	mu       sync.Mutex
+	data     []byte // Discarded if limit is exceeded.
+	total    int64  // Read from r.
+	exceeded bool
+}
+
+func (buf *replayBuffer) replayable() bool {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	return !buf.exceeded
+}
+
+// reader of the body from the beginning.  Readers of previous attempts may
+// still be in use by the transport; data read by them is recorded.
+func (buf *replayBuffer) reader() io.ReadCloser {
+	return &replayReader{buf: buf}
+}
+
+type replayReader struct {
+	buf *replayBuffer
+	off int64
+}
+
+func (r *replayReader) Read(b []byte) (int, error) {
+	buf := r.buf
+
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	if r.off < buf.total {
+		if buf.exceeded {
+			return 0, errReplayBodyTooLarge
+		}
+		n := copy(b, buf.data[r.off:])
+		r.off += int64(n)
+		return n, nil
+	}
+
+	n, err := buf.r.Read(b)
+	if n > 0 {
+		buf.total += int64(n)
+		r.off += int64(n)
+		if !buf.exceeded {
+			if buf.total > buf.limit {
+				buf.exceeded = true
+				buf.data = nil
+			} else {
+				buf.data = append(buf.data, b[:n]...)
+			}
+		}
+	}
+	return n, err
+}
+
+// Close doesn't close the underlying body; the upload is closed by its
+// handler.
+func (r *replayReader) Close() error {
+	return nil
+}
@@ -8,9 +8,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"gate.computer/gate/service"
@@ -21,88 +26,961 @@ const (
 	serviceRevision = "0"
 )
 
+// DefaultUserAgent is used if Config.UserAgent is empty.
+const DefaultUserAgent = "gate-localhost/" + serviceRevision
+
+// DefaultContentType is used if Config.DefaultContentType is empty.
+const DefaultContentType = "application/octet-stream"
+
+// NoContentType can be specified as Config.DefaultContentType to leave the
+// Content-Type header out.
+const NoContentType = "-"
+
+// DefaultRequestIDHeader is used if Config.RequestIDHeader is empty.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// DefaultInlineBodyLimit is a reasonable value for Config.InlineBodyLimit.
+const DefaultInlineBodyLimit = 32768
+
+// DefaultStreamChunkSize is used if Config.StreamChunkSize is zero.  Larger
+// chunks have less per-packet overhead (see BenchmarkStreamChunkSize), but
+// they delay other streams and responses of the same instance.
+const DefaultStreamChunkSize = 16384
+
+var defaultAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
 type Config struct {
+	// Addr of the default backend.
 	Addr string
+
+	// Backends maps names to addresses.  Programs select a backend by name;
+	// the default backend is used if the name is empty.
+	Backends map[string]string
+
+	// ForceHTTP2C makes requests to http and unix backends using cleartext
+	// HTTP/2 with prior knowledge.  It cannot be used with https backends.
+	ForceHTTP2C bool
+
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout tune the
+	// connection pools of backend clients.  Zero values leave the defaults
+	// of http.DefaultTransport (or unix socket transport) in place.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// ExpectContinueTimeout is the time to wait for a backend's 100 Continue
+	// response when a program requests it, before sending the body anyway.
+	// Zero leaves the default (one second) in place.
+	ExpectContinueTimeout time.Duration
+
+	// Proxy for http and https backends.  If nil, proxy is determined by
+	// environment variables (see http.ProxyFromEnvironment).
+	Proxy *url.URL
+
+	// HostOverrides maps backend host names to IP addresses, optionally with
+	// port, which are dialed instead of resolving the names.  Other names are
+	// resolved normally.  Host headers and TLS server names are not affected.
+	HostOverrides map[string]string
+
+	// Middlewares wrap the transport of backend requests, e.g. to sign them.
+	// The first one is the outermost.  They don't see WebSocket handshakes,
+	// tunnels or raw requests, which use connections directly.
+	Middlewares []func(http.RoundTripper) http.RoundTripper
+
+	// ClientCertFile and ClientKeyFile specify a certificate which is
+	// presented to https backends.  RootCAFile replaces the system's
+	// certificate authorities when verifying https backends.  The files are
+	// in PEM format.
+	ClientCertFile string
+	ClientKeyFile  string
+	RootCAFile     string
+
+	// InsecureSkipVerify disables verification of https backends'
+	// certificates.  It is meant for development.
+	InsecureSkipVerify bool
+
+	// ExposeTLSInfo includes the SHA-256 fingerprint and the subject of an
+	// https backend's certificate in responses.
+	ExposeTLSInfo bool
+
+	// ExposeRemoteAddr includes the remote address of the connection which
+	// was used for a request in its response.  It is not known for cached
+	// responses.
+	ExposeRemoteAddr bool
+
+	// InlineBodyLimit is the maximum size of a response body which is
+	// included in the response packet; larger bodies are streamed.  Zero
+	// disables inlining: all non-empty bodies are streamed.
+	InlineBodyLimit int64
+
+	// AllowedMethods which programs may use.  If nil, GET, HEAD, POST, PUT,
+	// PATCH, DELETE and OPTIONS are allowed.
+	AllowedMethods []string
+
+	// AnswerOptionsLocally makes the service respond to OPTIONS requests
+	// with the allowed methods instead of forwarding them to the backend.
+	AnswerOptionsLocally bool
+
+	// DryRun makes the service validate requests without sending them.
+	// Responses have status 204 and describe the requests which would have
+	// been sent.
+	DryRun bool
+
+	// AllowedPaths restricts requests to the listed paths and their
+	// subpaths.  Dot segments are resolved before the check, and the
+	// resolved path is sent to the backend.  If nil, all paths are allowed.
+	AllowedPaths []string
+
+	// RewritePath is called with the resolved path of each request.  The
+	// returned path is resolved again and sent to the backend instead.
+	// AllowedPaths are checked after rewriting.
+	RewritePath func(path string) string
+
+	// Authorize is called for each request after its URL has been resolved
+	// and checked, before anything is sent to the backend (also in dry-run
+	// mode).  The path is cleaned.  The header is a copy of the one specified
+	// by the program, without the headers added by the service.  A denied
+	// request is answered with status 403 and the reason as error message.
+	// For CONNECT requests the path is the host:port target.  If nil, all
+	// requests are allowed.  It may be called concurrently.
+	Authorize func(method, path string, header http.Header) (allow bool, reason string)
+
+	// AllowedResponseContentTypes restricts the response bodies which are
+	// passed to programs.  A pattern is a media type such as
+	// "application/json", or a type followed by "/*" such as "text/*".  The
+	// body of a response with another content type is replaced with an empty
+	// one, and the ContentBlocked flag is set.  If nil, all content types
+	// are allowed.
+	AllowedResponseContentTypes []string
+
+	// AllowedSchemes which programs may specify per request instead of the
+	// backend's scheme ("http" or "https").  The backend's host is used with
+	// any scheme.
+	AllowedSchemes []string
+
+	// AllowConnect enables tunneling via the backend using the CONNECT
+	// method.  Programs may connect only to the ConnectTargets ("host:port"),
+	// which must not be empty if tunneling is enabled.
+	AllowConnect   bool
+	ConnectTargets []string
+
+	// AllowRawRequests lets programs send complete HTTP/1.1 request messages
+	// which are written to backend connections without modification.  The
+	// service checks the method, path, Host header and ProtectedHeaders, and
+	// rejects ambiguous messages, but it doesn't add static headers,
+	// credentials or request ids, and it doesn't follow redirects, retry,
+	// cache or limit concurrency.  The backend sees whatever else the program
+	// wants it to see, so it should be prepared to handle arbitrary requests
+	// from programs.  Not supported with RewritePath.
+	AllowRawRequests bool
+
+	// EnableCookies makes each instance keep the cookies set by backends,
+	// and send them with subsequent requests.  The cookies are included in
+	// instance snapshots.  Programs may clear them.
+	EnableCookies bool
+
+	// MaxRedirects is the number of redirects which are followed.  If zero,
+	// redirect responses are returned to the program.  Followed redirects
+	// are listed in the response's redirect chain.
+	MaxRedirects int
+
+	// FollowExternalRedirects allows redirects to other hosts to be followed.
+	FollowExternalRedirects bool
+
+	// DefaultContentType is used for request bodies if the program doesn't
+	// specify one.  If empty, DefaultContentType is used.
+	DefaultContentType string
+
+	// UserAgent replaces any User-Agent header specified by the program.  If
+	// empty, DefaultUserAgent is used.
+	UserAgent string
+
+	// RequestIDHeader carries the request id specified by a program.  If
+	// empty, DefaultRequestIDHeader is used.  The id is returned in the
+	// response.
+	RequestIDHeader string
+
+	// GenerateRequestIDs makes the service generate a random request id if
+	// a program doesn't specify one.
+	GenerateRequestIDs bool
+
+	// AllowGuestHost makes the host of a request URI specified by a program
+	// the Host header of the backend request.  Otherwise OverrideHost is used,
+	// or the backend's host if it's empty.  The host is also used when a
+	// program doesn't specify one.
+	AllowGuestHost bool
+	OverrideHost   string
+
+	// StaticHeaders are added to all requests.  Programs may override them,
+	// except for the names listed in ProtectedHeaders: programs can't specify
+	// those headers at all.  User-Agent and authorization are configured
+	// separately.
+	StaticHeaders    http.Header
+	ProtectedHeaders []string
+
+	// BasicAuth or BearerToken credentials are added to requests, replacing
+	// any authorization specified by the program.
+	BasicAuth   *BasicAuth
+	BearerToken string
+
+	// DecompressResponses transparently decodes gzip and deflate encoded
+	// response bodies.  Content-Encoding and Content-Length headers are
+	// removed from such responses.
+	DecompressResponses bool
+
+	// ForwardClientEncoding disables the transparent compression of the HTTP
+	// client: Accept-Encoding is sent only if the program specifies it, and
+	// response bodies are passed to the program as they are encoded, with
+	// the Content-Encoding header.  If DecompressResponses is also set, gzip
+	// and deflate bodies are still decoded by the service.
+	ForwardClientEncoding bool
+
+	// TranscodeToUTF8 converts textual response bodies to UTF-8 based on the
+	// charset parameter of Content-Type or a byte order mark.  The charset
+	// parameter is updated.  Body checksums are of the converted body.
+	TranscodeToUTF8 bool
+
+	// BodyChecksums computes SHA-256 of response bodies for programs, and
+	// verifies Digest and Content-MD5 headers sent by backends.
+	BodyChecksums bool
+
+	// ParseErrorBodies makes the service extract an error message from a
+	// JSON body of a non-2xx response.  The message is returned in the
+	// error_message field along with the body.  Streamed bodies are not
+	// parsed.
+	ParseErrorBodies bool
+
+	// ErrorMessagePath is a dot-separated path to a string field of a JSON
+	// error body, such as "error.detail".  If empty, "message", "error" and
+	// "error.message" are tried.
+	ErrorMessagePath string
+
+	// MaxResponseBodySize limits the size of response bodies, including
+	// streamed ones.  Longer bodies are truncated.  Zero means no limit.
+	MaxResponseBodySize int64
+
+	// MaxResponseHeaderBytes limits the total size of response header names
+	// and values which are forwarded to programs.  Headers are forwarded in
+	// order of name until the limit is reached, but Content-Type is always
+	// included.  Zero means no limit.
+	MaxResponseHeaderBytes int64
+
+	// MaxResponseHeaders limits the number of response header values which
+	// are forwarded to programs in the same way as MaxResponseHeaderBytes.
+	// Zero means no limit.
+	MaxResponseHeaders int
+
+	// MaxRequestHeaders limits the number of header values which programs
+	// may specify per request.  Requests with more are rejected with status
+	// 400.  Zero means no limit.
+	MaxRequestHeaders int
+
+	// MaxRequestBodySize limits the size of request bodies, including
+	// streamed ones.  Zero means no limit.
+	MaxRequestBodySize int64
+
+	// CompressRequestMinSize is the smallest request body which is
+	// compressed when a program asks for compression; smaller bodies are sent
+	// as is.  Up to this many bytes of a streamed body of unknown length are
+	// received before the request is sent, unless the program expects 100
+	// Continue.  Zero means that all bodies are compressed.
+	CompressRequestMinSize int
+
+	// MaxRetries is the number of times a request is retried after a
+	// transient failure (connection error, or 502 or 503 response).  Only
+	// idempotent requests and requests with an Idempotency-Key header are
+	// retried, unless the failed attempt was never sent.  The same key is
+	// sent in every attempt.  Requests with streamed bodies are retried only
+	// if the body fits in MaxReplayBodySize.
+	MaxRetries int
+
+	// MaxReplayBodySize is the amount of streamed request body data which is
+	// buffered so that the request can be retried.  If a body is longer, the
+	// request is not retried.  Zero means that requests with streamed bodies
+	// are not retried.
+	MaxReplayBodySize int64
+
+	// RetryBackoff is the delay before the first retry.  It is doubled for
+	// each subsequent retry, up to a minute.
+	RetryBackoff time.Duration
+
+	// BreakerThreshold is the number of consecutive transport failures
+	// after which requests to a backend fail immediately for the
+	// BreakerCooldown period.  A single request is then let through to
+	// probe the backend.  Failures are counted within BreakerWindow (zero
+	// means no limit).  Zero threshold disables the circuit breaker.
+	BreakerThreshold int
+	BreakerWindow    time.Duration
+	BreakerCooldown  time.Duration
+
+	// CacheSize is the number of GET responses which are cached by the
+	// service.  Only responses with declared length not exceeding
+	// InlineBodyLimit are cached.  If CacheRespectHeaders is set, caching
+	// and freshness is determined by Cache-Control and Expires headers;
+	// otherwise responses stay in the cache until they are evicted or
+	// invalidated by an unsafe request.  Responses with Cache-Control no-store
+	// or private are never cached.  Stale responses with an ETag are
+	// revalidated with If-None-Match, and served again if the backend
+	// responds with 304.  Zero size disables caching.
+	CacheSize           int
+	CacheRespectHeaders bool
+
+	// MaxBytesPerSecond limits the transfer rate of each streamed response
+	// body.  Zero means no limit.
+	MaxBytesPerSecond float64
+
+	// RequestsPerSecond limits the rate of backend requests made by all
+	// instances together.  Burst is the number of requests which may be made
+	// at once (at least 1).  RateLimitMode determines if requests exceeding
+	// the rate wait or are rejected.  Zero rate means no limit.
+	RequestsPerSecond float64
+	Burst             int
+	RateLimitMode     RateLimitMode
+
+	// MaxConcurrentRequests limits the number of backend requests which are
+	// in progress at the same time in all instances together.  A request is
+	// in progress until its response header has been received.  OverloadMode
+	// determines if requests exceeding the limit wait or are rejected.  Zero
+	// means no limit.
+	MaxConcurrentRequests int
+	OverloadMode          OverloadMode
+
+	// MaxRequestsPerInstance limits the number of backend requests which an
+	// instance may make during its lifetime, including retries.  The count
+	// is retained across suspension.  Requests exceeding the limit are
+	// rejected with status 429.  Zero means no limit.
+	MaxRequestsPerInstance int
+
+	// RequestTimeout limits the duration of each request, including the
+	// transfer of a streamed response body.  Programs may specify shorter
+	// timeouts.  Zero means no limit.
+	RequestTimeout time.Duration
+
+	// StreamChunkSize limits the size of the data packets used to stream
+	// response bodies which don't fit in the response packet.  It's further
+	// limited by the maximum packet size of each instance.  If zero,
+	// DefaultStreamChunkSize is used.
+	StreamChunkSize int
+
+	// StreamKeepAliveInterval enables keep-alive packets on streamed response
+	// bodies.  A flow packet with zero increment is sent for the stream
+	// whenever no data has been received from the backend during the
+	// interval.  Zero means no keep-alive packets.
+	StreamKeepAliveInterval time.Duration
+
+	// HealthCheckPath is requested by CheckBackend.  If empty, "/" is used.
+	HealthCheckPath string
+
+	// HealthCheckTimeout limits the duration of CheckBackend.  If zero, 5
+	// seconds is used.
+	HealthCheckTimeout time.Duration
+
+	// NoRestartIdempotent disables restarting of GET and HEAD requests.  By
+	// default suspension cancels such requests which are in progress, and
+	// they are restarted when the instance is resumed.  With this option
+	// suspension waits for all requests to finish.
+	NoRestartIdempotent bool
+
+	// ShutdownGracePeriod limits the time an instance shutdown waits for
+	// canceled requests to unwind.  Zero means no limit.
+	ShutdownGracePeriod time.Duration
+
+	// SpillDir is a directory where the rest of a response body is written
+	// when an instance is suspended while it is being streamed, instead of
+	// buffering it in the snapshot.  The snapshot refers to the file, which
+	// is removed after the body has been streamed following resumption, or
+	// when the instance is shut down.  A body whose file is missing ends
+	// with a trailers error message.  Empty means no spilling.
+	SpillDir string
+
+	// Logger receives a record of each backend request.  Nil disables
+	// logging.
+	Logger *slog.Logger
+
+	// Metrics is optional.
+	Metrics Metrics
+
+	// Tracer is optional.
+	Tracer Tracer
+}
+
+type BasicAuth struct {
+	User     string
+	Password string
+}
+
+// Metrics receives an observation of each completed backend request.  Status
+// is zero if the request failed without a response.  Requests are observed
+// when they are handled, so requests whose responses are carried over a
+// suspension are not observed again after resumption.  See also
+// SuspendMetrics.
+type Metrics interface {
+	ObserveRequest(method string, status int, d time.Duration)
+}
+
+// SuspendMetrics may be implemented by Metrics to receive an observation of
+// each instance suspension and resumption.  Requests is the number of incoming
+// calls which were pending, unsent is the number of outgoing packets which
+// were buffered (including response body data), and size is the length of the
+// snapshot.
+type SuspendMetrics interface {
+	ObserveSuspend(requests, unsent, size int)
+	ObserveResume(requests, unsent, size int)
+}
+
+// Tracer starts a span for each backend request.  It can be implemented using
+// OpenTelemetry: if trace.SpanContextFromContext(ctx) is valid, start a child
+// span and inject the W3C trace context (traceparent and tracestate headers)
+// into the request header using propagation.TraceContext.
+type Tracer interface {
+	// StartSpan for a request which is about to be sent.  The request's
+	// header may be modified.  The returned context is used for the request.
+	// Span is nil if the request is not traced.
+	StartSpan(ctx context.Context, req *http.Request) (context.Context, Span)
+}
+
+// Span of a backend request.
+type Span interface {
+	// End the span after the response header has been received.  Status is
+	// zero if the request failed without a response.
+	End(status int, err error)
 }
 
 func New(config *Config) (l *Localhost, err error) {
-	if config.Addr == "" {
+	if config.Addr == "" && len(config.Backends) == 0 {
 		err = errors.New("localhost service: no address")
 		return
 	}
-
-	u, err := url.Parse(config.Addr)
-	if err != nil {
+	if config.MaxIdleConns < 0 || config.MaxIdleConnsPerHost < 0 || config.IdleConnTimeout < 0 {
+		err = errors.New("localhost service: negative idle connection limit")
 		return
 	}
-	if !u.IsAbs() {
-		err = fmt.Errorf("localhost service: address is relative: %s", u)
+	if config.ExpectContinueTimeout < 0 {
+		err = fmt.Errorf("localhost service: negative expect continue timeout: %v", config.ExpectContinueTimeout)
 		return
 	}
-
-	switch u.Scheme {
-	case "http", "https":
+	if u := config.Proxy; u != nil {
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			err = fmt.Errorf("localhost service: proxy has unsupported scheme: %s", u)
+			return
+		}
 		if u.Hostname() == "" {
-			err = fmt.Errorf("localhost service: HTTP address has no host: %s", u)
+			err = fmt.Errorf("localhost service: proxy address has no host: %s", u)
 			return
 		}
-		if u.Path != "" && u.Path != "/" {
-			err = fmt.Errorf("localhost service: HTTP address with path is not supported: %s", u)
+	}
+	if config.InlineBodyLimit < 0 {
+		err = fmt.Errorf("localhost service: negative inline body limit: %d", config.InlineBodyLimit)
+		return
+	}
+	if config.MaxRetries < 0 {
+		err = fmt.Errorf("localhost service: negative max retries: %d", config.MaxRetries)
+		return
+	}
+	if config.MaxReplayBodySize < 0 {
+		err = fmt.Errorf("localhost service: negative max replay body size: %d", config.MaxReplayBodySize)
+		return
+	}
+	if config.RetryBackoff < 0 {
+		err = fmt.Errorf("localhost service: negative retry backoff: %v", config.RetryBackoff)
+		return
+	}
+	if config.MaxResponseBodySize < 0 {
+		err = fmt.Errorf("localhost service: negative max response body size: %d", config.MaxResponseBodySize)
+		return
+	}
+	if config.MaxResponseHeaderBytes < 0 {
+		err = fmt.Errorf("localhost service: negative max response header bytes: %d", config.MaxResponseHeaderBytes)
+		return
+	}
+	if config.MaxResponseHeaders < 0 {
+		err = fmt.Errorf("localhost service: negative max response headers: %d", config.MaxResponseHeaders)
+		return
+	}
+	if config.MaxRequestHeaders < 0 {
+		err = fmt.Errorf("localhost service: negative max request headers: %d", config.MaxRequestHeaders)
+		return
+	}
+	if config.MaxRequestBodySize < 0 {
+		err = fmt.Errorf("localhost service: negative max request body size: %d", config.MaxRequestBodySize)
+		return
+	}
+	if config.CompressRequestMinSize < 0 {
+		err = fmt.Errorf("localhost service: negative compress request min size: %d", config.CompressRequestMinSize)
+		return
+	}
+	healthCheckPath := config.HealthCheckPath
+	if healthCheckPath == "" {
+		healthCheckPath = "/"
+	}
+	if !strings.HasPrefix(healthCheckPath, "/") {
+		err = fmt.Errorf("localhost service: health check path is not absolute: %q", healthCheckPath)
+		return
+	}
+	healthCheckTimeout := config.HealthCheckTimeout
+	if healthCheckTimeout == 0 {
+		healthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if healthCheckTimeout < 0 {
+		err = fmt.Errorf("localhost service: negative health check timeout: %v", healthCheckTimeout)
+		return
+	}
+	errorMessagePaths := defaultErrorMessagePaths
+	if config.ErrorMessagePath != "" {
+		path, ok := parseErrorMessagePath(config.ErrorMessagePath)
+		if !ok {
+			err = fmt.Errorf("localhost service: invalid error message path: %q", config.ErrorMessagePath)
 			return
 		}
+		errorMessagePaths = [][]string{path}
+	}
+	if config.StreamChunkSize < 0 {
+		err = fmt.Errorf("localhost service: negative stream chunk size: %d", config.StreamChunkSize)
+		return
+	}
+	if config.StreamKeepAliveInterval < 0 {
+		err = fmt.Errorf("localhost service: negative stream keep-alive interval: %v", config.StreamKeepAliveInterval)
+		return
+	}
+	if config.MaxRedirects < 0 {
+		err = fmt.Errorf("localhost service: negative max redirects: %d", config.MaxRedirects)
+		return
+	}
+	contentType := config.DefaultContentType
+	switch contentType {
+	case "":
+		contentType = DefaultContentType
+	case NoContentType:
+		contentType = ""
+	}
+	if !isHeaderValue(contentType) {
+		err = fmt.Errorf("localhost service: invalid default content type: %q", contentType)
+		return
+	}
 
-		l = &Localhost{
-			scheme: u.Scheme,
-			host:   u.Host,
-			client: http.DefaultClient,
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	if !isHeaderValue(userAgent) {
+		err = fmt.Errorf("localhost service: invalid user agent: %q", userAgent)
+		return
+	}
+
+	if h := config.OverrideHost; h != "" {
+		if u, e := url.Parse("http://" + h + "/"); e != nil || u.Host != h || u.Path != "/" {
+			err = fmt.Errorf("localhost service: invalid override host: %q", h)
+			return
 		}
+	}
+
+	staticHeaders, protectedHeaders, err := newStaticHeaders(config.StaticHeaders, config.ProtectedHeaders)
+	if err != nil {
+		err = fmt.Errorf("localhost service: %v", err)
+		return
+	}
 
-	case "unix":
-		if u.Host != "" {
-			err = fmt.Errorf("localhost service: unix address with host is not supported: %s", u)
+	requestIDHeader := DefaultRequestIDHeader
+	if config.RequestIDHeader != "" {
+		if requestIDHeader, err = staticHeaderKey(config.RequestIDHeader); err != nil {
+			err = fmt.Errorf("localhost service: request id header: %v", err)
 			return
 		}
-		if u.Path == "" {
-			err = fmt.Errorf("localhost service: unix address has no path: %s", u)
+	}
+
+	if config.BasicAuth != nil && config.BearerToken != "" {
+		err = errors.New("localhost service: both basic auth and bearer token specified")
+		return
+	}
+	if !isHeaderValue(config.BearerToken) {
+		err = errors.New("localhost service: invalid bearer token")
+		return
+	}
+
+	allowedMethods := config.AllowedMethods
+	if allowedMethods == nil {
+		allowedMethods = defaultAllowedMethods
+	}
+	methods := make(map[string]struct{}, len(allowedMethods))
+	for _, method := range allowedMethods {
+		if !isToken(method) {
+			err = fmt.Errorf("localhost service: invalid method: %q", method)
 			return
 		}
+		methods[method] = struct{}{}
+	}
+
+	var allowList []string
+	for method := range methods {
+		allowList = append(allowList, method)
+	}
+	sort.Strings(allowList)
+	allow := strings.Join(allowList, ", ")
 
-		dialer := net.Dialer{
-			Timeout:   30 * time.Second, // Same as http.DefaultTransport (Go 1.12).
-			KeepAlive: 30 * time.Second, //
+	for _, p := range config.AllowedPaths {
+		if !strings.HasPrefix(p, "/") {
+			err = fmt.Errorf("localhost service: allowed path is not absolute: %q", p)
+			return
 		}
+	}
 
-		client := &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return dialer.DialContext(ctx, "unix", u.Path)
-				},
-				DisableCompression:    true,
-				MaxIdleConns:          1,
-				MaxIdleConnsPerHost:   1,
-				IdleConnTimeout:       1,
-				ExpectContinueTimeout: time.Second, // Same as http.DefaultTransport (Go 1.12).
-			},
+	var allowedContentTypes []string
+	if config.AllowedResponseContentTypes != nil {
+		allowedContentTypes = make([]string, 0, len(config.AllowedResponseContentTypes))
+		for _, p := range config.AllowedResponseContentTypes {
+			p = strings.ToLower(p)
+			if !isMediaTypePattern(p) {
+				err = fmt.Errorf("localhost service: invalid content type pattern: %q", p)
+				return
+			}
+			allowedContentTypes = append(allowedContentTypes, p)
 		}
+	}
 
-		l = &Localhost{
-			scheme: "http",
-			host:   "localhost",
-			client: client,
+	if config.AllowRawRequests && config.RewritePath != nil {
+		err = errors.New("localhost service: raw requests are not supported with path rewriting")
+		return
+	}
+
+	var connectTargets map[string]struct{}
+	if config.AllowConnect {
+		if len(config.ConnectTargets) == 0 {
+			err = errors.New("localhost service: no connect targets")
+			return
 		}
+		connectTargets = make(map[string]struct{}, len(config.ConnectTargets))
+		for _, s := range config.ConnectTargets {
+			target, ok := parseConnectTarget(s)
+			if !ok {
+				err = fmt.Errorf("localhost service: invalid connect target: %q", s)
+				return
+			}
+			connectTargets[target] = struct{}{}
+		}
+	}
 
+	allowedSchemes := make(map[string]struct{}, len(config.AllowedSchemes))
+	for _, s := range config.AllowedSchemes {
+		switch s {
+		case "http":
+		case "https":
+			if config.ForceHTTP2C {
+				err = errors.New("localhost service: h2c is not supported with https scheme")
+				return
+			}
+		default:
+			err = fmt.Errorf("localhost service: unsupported scheme: %q", s)
+			return
+		}
+		allowedSchemes[s] = struct{}{}
+	}
+
+	if config.BreakerThreshold < 0 {
+		err = fmt.Errorf("localhost service: negative breaker threshold: %d", config.BreakerThreshold)
+		return
+	}
+	if config.BreakerWindow < 0 {
+		err = fmt.Errorf("localhost service: negative breaker window: %v", config.BreakerWindow)
+		return
+	}
+	if config.BreakerThreshold > 0 && config.BreakerCooldown <= 0 {
+		err = fmt.Errorf("localhost service: breaker cooldown must be positive: %v", config.BreakerCooldown)
+		return
+	}
+
+	if config.CacheSize < 0 {
+		err = fmt.Errorf("localhost service: negative cache size: %d", config.CacheSize)
+		return
+	}
+
+	if config.MaxBytesPerSecond < 0 {
+		err = fmt.Errorf("localhost service: negative max bytes per second: %v", config.MaxBytesPerSecond)
+		return
+	}
+	if config.RequestsPerSecond < 0 {
+		err = fmt.Errorf("localhost service: negative requests per second: %v", config.RequestsPerSecond)
+		return
+	}
+	if config.Burst < 0 {
+		err = fmt.Errorf("localhost service: negative burst: %d", config.Burst)
+		return
+	}
+	switch config.RateLimitMode {
+	case RateLimitWait, RateLimitReject:
 	default:
-		err = fmt.Errorf("localhost service: address has unsupported scheme: %s", u)
+		err = fmt.Errorf("localhost service: invalid rate limit mode: %d", config.RateLimitMode)
 		return
 	}
+	if config.MaxRequestsPerInstance < 0 || config.MaxRequestsPerInstance > math.MaxInt32 {
+		err = fmt.Errorf("localhost service: max requests per instance out of range: %d", config.MaxRequestsPerInstance)
+		return
+	}
+	if config.MaxConcurrentRequests < 0 {
+		err = fmt.Errorf("localhost service: negative max concurrent requests: %d", config.MaxConcurrentRequests)
+		return
+	}
+	switch config.OverloadMode {
+	case OverloadWait, OverloadReject:
+	default:
+		err = fmt.Errorf("localhost service: invalid overload mode: %d", config.OverloadMode)
+		return
+	}
+	if config.SpillDir != "" {
+		var info os.FileInfo
+		if info, err = os.Stat(config.SpillDir); err != nil {
+			err = fmt.Errorf("localhost service: spill directory: %v", err)
+			return
+		}
+		if !info.IsDir() {
+			err = fmt.Errorf("localhost service: spill directory is not a directory: %s", config.SpillDir)
+			return
+		}
+	}
+
+	for _, m := range config.Middlewares {
+		if m == nil {
+			err = errors.New("localhost service: nil middleware")
+			return
+		}
+	}
+	if err = checkHostOverrides(config.HostOverrides); err != nil {
+		err = fmt.Errorf("localhost service: %v", err)
+		return
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		err = fmt.Errorf("localhost service: %v", err)
+		return
+	}
+	if config.InsecureSkipVerify {
+		logger := config.Logger
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Warn("localhost service: TLS certificate verification is disabled (InsecureSkipVerify)")
+	}
+
+	backends := make(map[string]*backend)
+
+	if config.Addr != "" {
+		if backends[""], err = newBackend(config.Addr, config, tlsConfig); err != nil {
+			err = fmt.Errorf("localhost service: %v", err)
+			return
+		}
+	}
+
+	for name, addr := range config.Backends {
+		if name == "" {
+			err = errors.New("localhost service: backend has no name")
+			return
+		}
+		if backends[name], err = newBackend(addr, config, tlsConfig); err != nil {
+			err = fmt.Errorf("localhost service: backend %s: %v", name, err)
+			return
+		}
+	}
+
+	if config.BreakerThreshold > 0 {
+		for _, b := range backends {
+			b.breaker = &breaker{
+				threshold: config.BreakerThreshold,
+				window:    config.BreakerWindow,
+				cooldown:  config.BreakerCooldown,
+			}
+		}
+	}
+
+	var cache *responseCache
+	if config.CacheSize > 0 {
+		cache = newResponseCache(config.CacheSize, config.CacheRespectHeaders)
+	}
 
+	var limiter *rateLimiter
+	if config.RequestsPerSecond > 0 {
+		limiter = newRateLimiter(config.RequestsPerSecond, config.Burst, config.RateLimitMode)
+	}
+
+	var concurrency *semaphore
+	if config.MaxConcurrentRequests > 0 {
+		concurrency = newSemaphore(config.MaxConcurrentRequests, config.OverloadMode)
+	}
+
+	l = &Localhost{
+		backends:          backends,
+		methods:           methods,
+		allow:             allow,
+		answerOptions:     config.AnswerOptionsLocally,
+		dryRun:            config.DryRun,
+		allowedPaths:      config.AllowedPaths,
+		rewritePath:       config.RewritePath,
+		authorize:         config.Authorize,
+		allowedSchemes:    allowedSchemes,
+		allowedTypes:      allowedContentTypes,
+		connectTargets:    connectTargets,
+		rawRequests:       config.AllowRawRequests,
+		inlineBodyLimit:   config.InlineBodyLimit,
+		decompress:        config.DecompressResponses,
+		transcode:         config.TranscodeToUTF8,
+		exposeTLSInfo:     config.ExposeTLSInfo,
+		exposeRemoteAddr:  config.ExposeRemoteAddr,
+		checksums:         config.BodyChecksums,
+		parseErrors:       config.ParseErrorBodies,
+		errorPaths:        errorMessagePaths,
+		maxResponseBody:   config.MaxResponseBodySize,
+		maxResponseHeader: config.MaxResponseHeaderBytes,
+		maxResHeaders:     config.MaxResponseHeaders,
+		maxReqHeaders:     config.MaxRequestHeaders,
+		maxRequestBody:    config.MaxRequestBodySize,
+		compressMinSize:   config.CompressRequestMinSize,
+		cookies:           config.EnableCookies,
+		maxRedirects:      config.MaxRedirects,
+		extRedirects:      config.FollowExternalRedirects,
+		basicAuth:         config.BasicAuth,
+		bearerToken:       config.BearerToken,
+		userAgent:         userAgent,
+		requestIDHeader:   requestIDHeader,
+		generateIDs:       config.GenerateRequestIDs,
+		guestHost:         config.AllowGuestHost,
+		overrideHost:      config.OverrideHost,
+		staticHeaders:     staticHeaders,
+		protectedHeaders:  protectedHeaders,
+		contentType:       contentType,
+		maxRetries:        config.MaxRetries,
+		maxReplayBody:     config.MaxReplayBodySize,
+		retryBackoff:      config.RetryBackoff,
+		cache:             cache,
+		limiter:           limiter,
+		concurrency:       concurrency,
+		instanceRequests:  config.MaxRequestsPerInstance,
+		bytesPerSecond:    config.MaxBytesPerSecond,
+		requestTimeout:    config.RequestTimeout,
+		streamChunkSize:   config.StreamChunkSize,
+		streamKeepAlive:   config.StreamKeepAliveInterval,
+		healthPath:        healthCheckPath,
+		healthTimeout:     healthCheckTimeout,
+		shutdownGrace:     config.ShutdownGracePeriod,
+		restartIdempotent: !config.NoRestartIdempotent,
+		spillDir:          config.SpillDir,
+		logger:            config.Logger,
+		metrics:           config.Metrics,
+		tracer:            config.Tracer,
+	}
+	l.live = new(atomic.Value)
+	l.live.Store(l)
 	return
 }
 
+// Reconfigure replaces the configuration after validating it.  Existing
+// instances use the new configuration for subsequent requests; requests which
+// are in progress finish with the old one.  The rate limiter, concurrency limit
+// and circuit breakers are carried over if their settings are unchanged (and
+// the backend's address for a breaker); the response cache is not.  Settings
+// which are used when an instance is created (EnableCookies and
+// MaxRequestsPerInstance) don't affect existing instances.
+func (l *Localhost) Reconfigure(config Config) error {
+	next, err := New(&config)
+	if err != nil {
+		return err
+	}
+
+	prev := l.current()
+
+	if next.limiter != nil && prev.limiter != nil && next.limiter.sameSettings(prev.limiter) {
+		next.limiter = prev.limiter
+	}
+	if next.concurrency != nil && prev.concurrency != nil && next.concurrency.sameSettings(prev.concurrency) {
+		next.concurrency = prev.concurrency
+	}
+	for name, b := range next.backends {
+		if old := prev.backends[name]; old != nil && b.breaker != nil && old.breaker != nil &&
+			b.scheme == old.scheme && b.host == old.host && b.breaker.sameSettings(old.breaker) {
+			b.breaker = old.breaker
+		}
+	}
+
+	next.live = l.live
+	l.live.Store(next)
+	return nil
+}
+
+// current configuration.
+func (l *Localhost) current() *Localhost {
+	return l.live.Load().(*Localhost)
+}
+
 type Localhost struct {
-	scheme string
-	host   string
-	client *http.Client
+	live *atomic.Value // Current *Localhost, shared by reconfigured ones.
+
+	backends map[string]*backend // Default backend has empty name.
+
+	methods           map[string]struct{}
+	allow             string // Comma-separated methods.
+	answerOptions     bool
+	dryRun            bool
+	allowedPaths      []string // Nil means all.
+	rewritePath       func(string) string
+	authorize         func(string, string, http.Header) (bool, string)
+	allowedSchemes    map[string]struct{}
+	connectTargets    map[string]struct{}
+	rawRequests       bool
+	allowedTypes      []string // Response content type patterns.  Nil means all.
+	inlineBodyLimit   int64
+	decompress        bool
+	transcode         bool
+	exposeTLSInfo     bool
+	exposeRemoteAddr  bool
+	checksums         bool
+	parseErrors       bool
+	errorPaths        [][]string
+	maxResponseBody   int64
+	maxResponseHeader int64
+	maxResHeaders     int
+	maxReqHeaders     int
+	maxRequestBody    int64
+	compressMinSize   int
+	cookies           bool
+	maxRedirects      int
+	extRedirects      bool
+	basicAuth         *BasicAuth
+	bearerToken       string
+	userAgent         string
+	requestIDHeader   string
+	generateIDs       bool
+	guestHost         bool
+	overrideHost      string // Empty means backend's host.
+	staticHeaders     http.Header
+	protectedHeaders  map[string]struct{}
+	contentType       string // Default for request bodies.
+	maxRetries        int
+	maxReplayBody     int64
+	retryBackoff      time.Duration
+	cache             *responseCache // Nil means no caching.
+	limiter           *rateLimiter   // Nil means no limit.
+	concurrency       *semaphore     // Nil means no limit.
+	instanceRequests  int            // Zero means no limit.
+	bytesPerSecond    float64        // Zero means no limit.
+	requestTimeout    time.Duration
+	streamChunkSize   int
+	streamKeepAlive   time.Duration
+	healthPath        string
+	healthTimeout     time.Duration
+	shutdownGrace     time.Duration
+	restartIdempotent bool
+	spillDir          string // Empty means no spilling.
+	logger            *slog.Logger
+	metrics           Metrics
+	tracer            Tracer
 }
 
 func (*Localhost) Service() service.Service {
@@ -122,6 +1000,9 @@ func (l *Localhost) CreateInstance(ctx context.Context, config service.InstanceC
 	if err := inst.restore(snapshot); err != nil {
 		return nil, err
 	}
+	if len(snapshot) > 0 {
+		l.current().observeResume(ctx, len(inst.pendingRequests), len(inst.pendingUnsent), len(snapshot))
+	}
 
 	return inst, nil
 }
@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+const spillPrefix = "localhost-spill-"
+
+// spillBody writes the rest of the body to a file in the spill directory, and
+// sends a spill reference instead of data packets.  False is returned if the
+// file could not be created; the body can still be sent as data packets.
+func (s *stream) spillBody(code packet.Code, c chan<- handled) (spilled bool, err error) {
+	f, err := ioutil.TempFile(s.spillDir, spillPrefix)
+	if err != nil {
+		return false, nil
+	}
+
+	_, err = io.Copy(f, s.body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = io.EOF
+	}
+
+	c <- handled{res: makeSpillPacket(code, s.id, filepath.Base(f.Name()), 0)}
+	return true, err
+}
+
+// makeSpillPacket refers to a spill file and the offset where streaming
+// continues.  Spill references are only stored in snapshots.
+func makeSpillPacket(code packet.Code, id int32, name string, offset int64) packet.Buf {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(offset))
+
+	p := packet.MakeData(code, id, n+len(name))
+	copy(p.Data(), buf[:n])
+	copy(p.Data()[n:], name)
+	p.SetNote(streamNoteSpilled)
+	return packet.Buf(p)
+}
+
+// parseSpillPacket validates the file name so that a snapshot cannot refer to
+// arbitrary files.
+func parseSpillPacket(p packet.DataBuf) (name string, offset int64, ok bool) {
+	x, n := binary.Uvarint(p.Data())
+	if n <= 0 || x > math.MaxInt64 {
+		return
+	}
+
+	name = string(p.Data()[n:])
+	if !strings.HasPrefix(name, spillPrefix) || name != filepath.Base(name) {
+		return "", 0, false
+	}
+
+	return name, int64(x), true
+}
+
+func isSpillPacket(p packet.Buf) bool {
+	return p.Domain() == packet.DomainData && packet.DataBuf(p).Note() == streamNoteSpilled
+}
+
+// removeSpills which are referenced by unsent packets.
+func removeSpills(dir string, unsent []packet.Buf) {
+	for _, p := range unsent {
+		if isSpillPacket(p) {
+			if name, _, ok := parseSpillPacket(packet.DataBuf(p)); ok {
+				removeSpill(dir, name)
+			}
+		}
+	}
+}
+
+func removeSpill(dir, name string) {
+	if dir != "" {
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+func openSpill(dir, name string) (*os.File, error) {
+	if dir == "" {
+		return nil, errors.New("localhost: spill directory is not configured")
+	}
+	return os.Open(filepath.Join(dir, name))
+}
+
+// spilled response body which is streamed from a file after resumption.
+type spilled struct {
+	id     int32
+	name   string
+	offset int64
+	tail   []packet.Buf // Subsequent packets of the stream.
+}
+
+// takeSpills removes spill references and the subsequent packets of their
+// streams from unsent packets.  The references must have been validated.
+func takeSpills(unsent []packet.Buf) (rest []packet.Buf, spills []*spilled) {
+	streams := make(map[int32]*spilled)
+
+	for _, p := range unsent {
+		if p.Domain() == packet.DomainData {
+			id := packet.DataBuf(p).ID()
+			if sp := streams[id]; sp != nil {
+				sp.tail = append(sp.tail, p)
+				continue
+			}
+			if isSpillPacket(p) {
+				name, offset, _ := parseSpillPacket(packet.DataBuf(p))
+				sp := &spilled{id: id, name: name, offset: offset}
+				streams[id] = sp
+				spills = append(spills, sp)
+				continue
+			}
+		}
+		rest = append(rest, p)
+	}
+
+	return
+}
+
+// send the file contents as data packets, followed by the tail.  If the
+// instance is suspended or shut down before the end, a new spill reference is
+// sent in place of the rest of the data.  The file is removed when it's no
+// longer referenced.  If the file cannot be read, the stream ends with a
+// trailers error message.
+func (sp *spilled) send(ctx context.Context, suspend <-chan struct{}, aborter *abortable, dir string,
+	config packet.Service, chunkSize int, c chan<- handled,
+) {
+	f, err := openSpill(dir, sp.name)
+	if err == nil {
+		defer f.Close()
+		_, err = f.Seek(sp.offset, io.SeekStart)
+	}
+
+	var sent chan struct{} // Of the previous chunk.
+	for err == nil {
+		select {
+		case <-suspend:
+			sp.keep(config, c)
+			return
+
+		case <-ctx.Done():
+			if aborter.aborted() {
+				removeSpill(dir, sp.name)
+				eof := packet.MakeData(config.Code, sp.id, 0)
+				eof.SetNote(streamNoteAborted)
+				c <- handled{res: packet.Buf(eof)}
+			} else {
+				sp.keep(config, c)
+			}
+			return
+
+		default:
+		}
+
+		p := packet.MakeData(config.Code, sp.id, chunkSize)
+
+		var n int
+		n, err = f.Read(p.Data())
+		if n > 0 {
+			if sent != nil {
+				select {
+				case <-sent:
+				case <-ctx.Done():
+					err = nil // Chunk is sent after resumption.
+					continue
+				}
+			}
+
+			sent = make(chan struct{})
+			c <- handled{res: packet.Buf(p[:packet.DataHeaderSize+n]), sent: sent}
+			sp.offset += int64(n)
+		}
+	}
+
+	removeSpill(dir, sp.name)
+
+	if err == io.EOF {
+		for _, p := range sp.tail {
+			c <- handled{res: p}
+		}
+		return
+	}
+
+	b := flatbuffers.NewBuilder(0)
+	errorMessage := b.CreateString("spilled body is unavailable")
+	flat.TrailersStart(b)
+	flat.TrailersAddErrorMessage(b, errorMessage)
+	b.Finish(flat.TrailersEnd(b))
+
+	p := packet.MakeData(config.Code, sp.id, len(b.FinishedBytes()))
+	copy(p.Data(), b.FinishedBytes())
+	p.SetNote(streamNoteTrailers)
+	c <- handled{res: packet.Buf(p)}
+	c <- handled{res: packet.Buf(packet.MakeData(config.Code, sp.id, 0))}
+}
+
+// keep the rest of the file for the snapshot.
+func (sp *spilled) keep(config packet.Service, c chan<- handled) {
+	c <- handled{res: makeSpillPacket(config.Code, sp.id, sp.name, sp.offset)}
+	for _, p := range sp.tail {
+		c <- handled{res: p}
+	}
+}
@@ -0,0 +1,633 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// Data packet notes of response body streams.
+const (
+	streamNoteTruncated = 1 // Final packet: body was cut by MaxResponseBodySize.
+	streamNoteTrailers  = 2 // Trailers table precedes the final packet.
+	streamNoteAborted   = 3 // Final packet: stream was aborted by the program.
+
+	streamNoteSpilled = -1 // Rest of body is in a spill file.  Only in snapshots.
+)
+
+const uploadWindow = 65536 // Flow granted to program per upload.
+
+var (
+	errUploadAborted       = errors.New("localhost: upload aborted")
+	errRequestBodyTooLarge = errors.New("localhost: request body too large")
+)
+
+type streams struct {
+	nextID int32 // Atomic.
+
+	mu      sync.Mutex
+	uploads map[int32]*upload
+	aborts  map[int32]*abortable
+	sockets map[int32]duplex
+}
+
+func (ss *streams) newID() int32 {
+	return atomic.AddInt32(&ss.nextID, 1) - 1
+}
+
+// registerUpload for a request packet.  The request's handler may claim it by
+// calling upload.  False is returned if the id is already in use.
+func (ss *streams) registerUpload(id int32, req packet.Buf, config packet.Service, flow chan<- handled) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if _, found := ss.uploads[id]; found {
+		return false
+	}
+
+	if ss.uploads == nil {
+		ss.uploads = make(map[int32]*upload)
+	}
+	u := &upload{
+		id:   id,
+		req:  req,
+		code: config.Code,
+		flow: flow,
+	}
+	u.cond.L = &u.mu
+	ss.uploads[id] = u
+	return true
+}
+
+// upload which was registered for the request packet, or nil.
+func (ss *streams) upload(id int32, req packet.Buf) *upload {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if u := ss.uploads[id]; u != nil && &u.req[0] == &req[0] {
+		return u
+	}
+	return nil
+}
+
+func (ss *streams) unregisterUpload(u *upload) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.uploads[u.id] == u {
+		delete(ss.uploads, u.id)
+	}
+}
+
+// registerAbort makes the request abortable via the stream id.
+func (ss *streams) registerAbort(id int32, a *abortable) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.aborts == nil {
+		ss.aborts = make(map[int32]*abortable)
+	}
+	ss.aborts[id] = a
+}
+
+func (ss *streams) unregisterAbort(id int32, a *abortable) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.aborts[id] == a {
+		delete(ss.aborts, id)
+	}
+}
+
+// abort the request which uses the stream id.  False is returned if the id is
+// not in use.
+func (ss *streams) abort(id int32) bool {
+	ss.mu.Lock()
+	a := ss.aborts[id]
+	ss.mu.Unlock()
+
+	if a == nil {
+		return false
+	}
+	a.abort()
+	return true
+}
+
+func (ss *streams) registerSocket(id int32, so duplex) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.sockets == nil {
+		ss.sockets = make(map[int32]duplex)
+	}
+	ss.sockets[id] = so
+}
+
+func (ss *streams) unregisterSocket(id int32, so duplex) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.sockets[id] == so {
+		delete(ss.sockets, id)
+	}
+}
+
+// receive data for an upload or a connection.  Data for unknown streams is
+// discarded.
+func (ss *streams) receive(p packet.DataBuf) {
+	ss.mu.Lock()
+	u := ss.uploads[p.ID()]
+	so := ss.sockets[p.ID()]
+	ss.mu.Unlock()
+
+	if u != nil {
+		u.receive(p.Data())
+	} else if so != nil {
+		so.receive(p)
+	}
+}
+
+// abortUploads which are in progress.
+func (ss *streams) abortUploads() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, u := range ss.uploads {
+		u.abort()
+	}
+}
+
+// requestBody is streamed from the program.
+type requestBody interface {
+	io.ReadCloser
+
+	// start receiving.  Receiving more data than limit causes an error.
+	start(limit int64)
+}
+
+// deferredBody starts receiving on first read.
+type deferredBody struct {
+	requestBody
+	limit int64
+	once  sync.Once
+}
+
+func (d *deferredBody) Read(b []byte) (int, error) {
+	d.once.Do(func() {
+		d.requestBody.start(d.limit)
+	})
+	return d.requestBody.Read(b)
+}
+
+// upload of request body data from the program.
+type upload struct {
+	id   int32
+	req  packet.Buf
+	code packet.Code
+	flow chan<- handled
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	received [][]byte
+	total    int64
+	limit    int64  // Zero means no limit.
+	budget   *int64 // Shared with other uploads.  Atomic.  Optional.
+	eof      bool
+	closed   bool
+	err      error
+}
+
+// start by granting initial flow to the program.  Receiving more data than
+// limit causes an error.
+func (u *upload) start(limit int64) {
+	u.mu.Lock()
+	u.limit = limit
+	u.mu.Unlock()
+
+	u.grant(uploadWindow)
+}
+
+// startShared is like start, but the uploads which share the budget may
+// receive at most that many bytes in total.
+func (u *upload) startShared(budget *int64) {
+	u.mu.Lock()
+	u.budget = budget
+	u.mu.Unlock()
+
+	u.grant(uploadWindow)
+}
+
+func (u *upload) grant(increment int) {
+	u.flow <- handled{res: packet.Buf(packet.MakeFlow(u.code, u.id, int32(increment)))}
+}
+
+func (u *upload) receive(data []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.eof || u.closed || u.err != nil {
+		return
+	}
+
+	if len(data) == 0 {
+		u.eof = true
+	} else {
+		u.total += int64(len(data))
+		if u.limit > 0 && u.total > u.limit || u.budget != nil && atomic.AddInt64(u.budget, -int64(len(data))) < 0 {
+			u.err = errRequestBodyTooLarge
+			u.received = nil
+		} else {
+			u.received = append(u.received, data)
+		}
+	}
+	u.cond.Signal()
+}
+
+func (u *upload) abort() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.err == nil {
+		u.err = errUploadAborted
+	}
+	u.cond.Signal()
+}
+
+// abortOnCancel aborts the upload when ctx is done, until stop is called.
+// HTTP transport waits for body write to finish even after cancellation, so
+// it needs to be unblocked.
+func (u *upload) abortOnCancel(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, u.abort)
+}
+
+func (u *upload) Read(b []byte) (n int, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for len(u.received) == 0 && !u.eof && u.err == nil && !u.closed {
+		u.cond.Wait()
+	}
+
+	switch {
+	case u.closed:
+		return 0, io.ErrClosedPipe
+
+	case u.err != nil:
+		return 0, u.err
+
+	case len(u.received) == 0:
+		return 0, io.EOF
+	}
+
+	n = copy(b, u.received[0])
+	if n < len(u.received[0]) {
+		u.received[0] = u.received[0][n:]
+	} else {
+		u.received = u.received[1:]
+	}
+
+	if !u.eof {
+		u.grant(n) // Sender loop doesn't block for long.
+	}
+	return
+}
+
+// Close must be called by the handler before it returns.
+func (u *upload) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	u.received = nil
+	u.cond.Signal()
+	return nil
+}
+
+// abortable request.
+type abortable struct {
+	cancel context.CancelFunc
+	flag   int32 // Atomic.
+}
+
+func (a *abortable) abort() {
+	atomic.StoreInt32(&a.flag, 1)
+	a.cancel()
+}
+
+func (a *abortable) aborted() bool {
+	return atomic.LoadInt32(&a.flag) != 0
+}
+
+// stream of response body data.
+type stream struct {
+	id      int32
+	body    io.ReadCloser
+	limiter *bodyLimiter       // Optional.
+	sum     *checksum          // Optional.
+	trailer *http.Header       // Populated at end of body.  Optional.
+	events  bool               // Server-sent events and WebSockets may not end on their own.
+	cancel  context.CancelFunc // Optional.
+	start   time.Time          // When the request was sent.
+	aborter *abortable         // Optional.
+	socket  duplex             // Body is a WebSocket or tunnel connection.  Optional.
+
+	throttle   *rateLimiter    // Bytes per second.  Optional.
+	unthrottle <-chan struct{} // Throttling ends when closed.
+
+	spill    <-chan struct{} // Spilling begins when closed.  Optional.
+	spillDir string
+
+	keepAlive time.Duration // Optional.
+}
+
+// duplex connection which is bridged to a stream.
+type duplex interface {
+	// run until the connection is closed.
+	run(config packet.Service, id int32, chunkSize int, c chan<- handled)
+
+	// receive a data packet from the program.
+	receive(p packet.DataBuf)
+}
+
+// send the body as data packets, terminated by an empty data packet.  The
+// body is closed and the request context is canceled.
+func (s *stream) send(ctx context.Context, config packet.Service, chunkSize int, c chan<- handled) {
+	defer s.close()
+
+	if s.socket != nil {
+		s.socket.run(config, s.id, chunkSize, c)
+	} else {
+		s.sendBody(ctx, config, chunkSize, c)
+	}
+
+	eof := packet.MakeData(config.Code, s.id, 0)
+	if s.aborter != nil && s.aborter.aborted() {
+		eof.SetNote(streamNoteAborted)
+	} else if s.limiter != nil && s.limiter.truncated {
+		eof.SetNote(streamNoteTruncated)
+	}
+	c <- handled{res: packet.Buf(eof)}
+}
+
+// sendBody as data packets.  If the whole body was read, a trailers packet is
+// sent after the data.
+//
+// Backpressure: a chunk is handed over only after the previous chunk has been
+// sent, so at most two chunks of a body are buffered while the program isn't
+// receiving.  (Suspension releases the wait; the rest of the body is buffered
+// for the snapshot.)  The wait is interrupted by context cancellation.
+//
+// Throttling delays reading of the next chunk until the previous one fits in
+// the byte rate.  It ends when the instance is suspended.
+//
+// If spilling is enabled, suspension causes the rest of the body to be written
+// to a file instead.
+func (s *stream) sendBody(ctx context.Context, config packet.Service, chunkSize int, c chan<- handled) {
+	var (
+		err  error
+		sent chan struct{} // Of the previous chunk.
+	)
+
+	var received chan struct{} // Data has been read since the last check.
+	if s.keepAlive > 0 {
+		received = make(chan struct{}, 1)
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		defer func() {
+			close(done)
+			<-stopped // Keep-alive must not follow the final packets.
+		}()
+		go func() {
+			defer close(stopped)
+			s.keepStreamAlive(config.Code, received, done, c)
+		}()
+	}
+
+	for err == nil {
+		if s.spill != nil {
+			select {
+			case <-s.spill:
+				var spilled bool
+				if spilled, err = s.spillBody(config.Code, c); !spilled {
+					s.spill = nil
+				}
+				continue
+			default:
+			}
+		}
+
+		p := packet.MakeData(config.Code, s.id, chunkSize)
+
+		var n int
+		n, err = s.body.Read(p.Data())
+		if n > 0 {
+			if received != nil {
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+			}
+
+			if sent != nil {
+				select {
+				case <-sent:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			sent = make(chan struct{})
+			c <- handled{res: packet.Buf(p[:packet.DataHeaderSize+n]), sent: sent}
+
+			if s.throttle != nil {
+				if !s.wait(ctx, n) {
+					return
+				}
+			}
+		}
+	}
+
+	if err == io.EOF {
+		duration := milliseconds(time.Since(s.start))
+
+		var sha256 []byte
+		var message string
+		if s.sum != nil {
+			sha256 = s.sum.sum()
+			if s.limiter == nil || !s.limiter.truncated {
+				if s.sum.verify() != nil {
+					message = "checksum mismatch"
+				}
+			}
+		}
+
+		data := buildStreamTrailers(s.trailer, sha256, message, duration)
+		if len(data) > config.MaxSendSize-packet.DataHeaderSize {
+			if message == "" {
+				message = "trailers too large"
+			}
+			data = buildStreamTrailers(nil, sha256, message, duration)
+		}
+
+		p := packet.MakeData(config.Code, s.id, len(data))
+		copy(p.Data(), data)
+		p.SetNote(streamNoteTrailers)
+		c <- handled{res: packet.Buf(p)}
+	}
+}
+
+// buildStreamTrailers table.  Trailer header is optional.
+func buildStreamTrailers(trailer *http.Header, sha256 []byte, message string, duration uint32) []byte {
+	b := flatbuffers.NewBuilder(0)
+
+	var trailers, bodySHA256, errorMessage flatbuffers.UOffsetT
+	if trailer != nil {
+		trailers = buildTrailers(b, *trailer)
+	}
+	if sha256 != nil {
+		bodySHA256 = b.CreateByteVector(sha256)
+	}
+	if message != "" {
+		errorMessage = b.CreateString(message)
+	}
+
+	flat.TrailersStart(b)
+	if trailers != 0 {
+		flat.TrailersAddTrailers(b, trailers)
+	}
+	if bodySHA256 != 0 {
+		flat.TrailersAddBodySha256(b, bodySHA256)
+	}
+	if errorMessage != 0 {
+		flat.TrailersAddErrorMessage(b, errorMessage)
+	}
+	flat.TrailersAddDurationMs(b, duration)
+	b.Finish(flat.TrailersEnd(b))
+	return b.FinishedBytes()
+}
+
+// keepStreamAlive sends a flow packet with zero increment whenever nothing has
+// been received during the keep-alive interval.
+func (s *stream) keepStreamAlive(code packet.Code, received <-chan struct{}, done <-chan struct{}, c chan<- handled) {
+	timer := time.NewTimer(s.keepAlive)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-received:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+		case <-timer.C:
+			select {
+			case c <- handled{res: packet.Buf(packet.MakeFlow(code, s.id, 0))}:
+			case <-done:
+				return
+			}
+
+		case <-done:
+			return
+		}
+
+		timer.Reset(s.keepAlive)
+	}
+}
+
+// close the body and cancel the request context.
+func (s *stream) close() {
+	s.body.Close()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// wait until n bytes fit in the throttled rate.  False is returned if the
+// context was canceled.
+func (s *stream) wait(ctx context.Context, n int) bool {
+	delay, _ := s.throttle.reserve(time.Now(), float64(n))
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.unthrottle:
+		s.throttle = nil
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// streamChunkSize returns the configured chunk size, limited by the maximum
+// packet size.
+func streamChunkSize(local *Localhost, config packet.Service) int {
+	n := local.streamChunkSize
+	if n == 0 {
+		n = DefaultStreamChunkSize
+	}
+	if max := config.MaxSendSize - packet.DataHeaderSize; n > max {
+		n = max
+	}
+	return n
+}
+
+// bodyLimiter reads at most n bytes.  It notes if there was more.
+type bodyLimiter struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (l *bodyLimiter) Read(b []byte) (n int, err error) {
+	if l.n <= 0 {
+		var x [1]byte
+		if _, err := io.ReadFull(l.r, x[:]); err == nil {
+			l.truncated = true
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > l.n {
+		b = b[:l.n]
+	}
+	n, err = l.r.Read(b)
+	l.n -= int64(n)
+	return
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// uploadCounter counts request body bytes read by the transport.
+type uploadCounter struct {
+	io.ReadCloser
+	n int64 // Atomic.
+}
+
+func (c *uploadCounter) Read(b []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// handleGetText is implemented in terms of handleRequest.  A streamed response
+// body is read into the text response if it fits in the packet.
+func handleGetText(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	jar *cookieJar, call flat.GetText,
+) []byte {
+	b := flatbuffers.NewBuilder(0)
+	method := b.CreateString(http.MethodGet)
+	uri := b.CreateByteString(call.Uri())
+	backend := b.CreateByteString(call.Backend())
+	flat.RequestStart(b)
+	flat.RequestAddMethod(b, method)
+	flat.RequestAddUri(b, uri)
+	flat.RequestAddBackend(b, backend)
+	b.Finish(flat.RequestEnd(b))
+
+	data, st := handleRequest(ctx, local, config, streams, jar, *flat.GetRootAsRequest(b.FinishedBytes(), 0), nil)
+	res := flat.GetRootAsResponse(data, 0)
+
+	status := res.StatusCode()
+	text := res.BodyBytes()
+	message := string(res.ErrorMessage())
+	kind := res.ErrorKind()
+	if res.ContentBlocked() {
+		message = "content type not allowed"
+		kind = flat.ErrorKindBlocked
+	}
+
+	if st != nil {
+		max := config.MaxSendSize - packet.HeaderSize - maxFlatResponseSize
+
+		var err error
+		text, err = ioutil.ReadAll(io.LimitReader(st.body, int64(max)+1))
+		st.close()
+
+		switch {
+		case err != nil:
+			status, message, kind = transportError(ctx, err)
+			text = nil
+
+		case len(text) > max:
+			message = "response too large"
+			kind = flat.ErrorKindTooLarge
+			text = nil
+		}
+	}
+
+	if message == "" && !utf8.Valid(text) {
+		message = "invalid UTF-8"
+		kind = flat.ErrorKindBackendError
+		text = nil
+	}
+
+	b = flatbuffers.NewBuilder(0)
+
+	var textOffset, messageOffset flatbuffers.UOffsetT
+	if len(text) > 0 {
+		textOffset = b.CreateByteString(text)
+	}
+	if message != "" {
+		messageOffset = b.CreateString(message)
+	}
+
+	flat.TextResponseStart(b)
+	flat.TextResponseAddStatusCode(b, status)
+	if textOffset != 0 {
+		flat.TextResponseAddText(b, textOffset)
+	}
+	if message != "" || status < 200 || status > 299 {
+		flat.TextResponseAddError(b, true)
+	}
+	if messageOffset != 0 {
+		flat.TextResponseAddErrorMessage(b, messageOffset)
+	}
+	if kind != flat.ErrorKindNone {
+		flat.TextResponseAddErrorKind(b, kind)
+	}
+	b.Finish(flat.TextResponseEnd(b))
+	return b.FinishedBytes()
+}
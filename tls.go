@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSConfig for backend connections.  Nil is returned if the default
+// configuration suffices.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	if config.ClientCertFile == "" && config.ClientKeyFile == "" && config.RootCAFile == "" &&
+		!config.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+			return nil, errors.New("client certificate and key files must be specified together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.RootCAFile != "" {
+		data, err := ioutil.ReadFile(config.RootCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", config.RootCAFile)
+		}
+	}
+
+	return c, nil
+}
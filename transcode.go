@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+var byteOrderMarks = []struct {
+	bom     []byte
+	charset string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, "utf-8"},
+	{[]byte{0xfe, 0xff}, "utf-16be"},
+	{[]byte{0xff, 0xfe}, "utf-16le"},
+}
+
+// isTextual media type.  Event streams are always UTF-8.
+func isTextual(mediaType string) bool {
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/ecmascript":
+		return true
+	}
+
+	return false
+}
+
+// transcodeResponse converts a textual response body to UTF-8.  The charset is
+// determined by the Content-Type header or a byte order mark.  The charset
+// parameter of Content-Type is updated.  If the body was modified,
+// Content-Length is removed and true is returned.
+func transcodeResponse(res *http.Response) (modified bool) {
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !isTextual(mediaType) {
+		return
+	}
+
+	body := res.Body
+	r := bufio.NewReader(body)
+	res.Body = readCloser{r, body}
+
+	charset := params["charset"]
+	if charset == "" {
+		prefix, _ := r.Peek(3)
+		for _, x := range byteOrderMarks {
+			if bytes.HasPrefix(prefix, x.bom) {
+				r.Discard(len(x.bom))
+				charset = x.charset
+				modified = true
+				break
+			}
+		}
+		if charset == "" {
+			return
+		}
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return // Unknown charset is passed through.
+	}
+	if name, _ := htmlindex.Name(enc); name != "utf-8" {
+		res.Body = readCloser{transform.NewReader(r, enc.NewDecoder()), body}
+		modified = true
+	}
+	if modified {
+		res.ContentLength = -1
+		res.Header.Del("Content-Length")
+	}
+
+	params["charset"] = "utf-8"
+	res.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	return
+}
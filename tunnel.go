@@ -0,0 +1,298 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+// parseConnectTarget validates and normalizes a host:port pair.
+func parseConnectTarget(s string) (string, bool) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil || host == "" {
+		return "", false
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), true
+}
+
+// handleConnect opens a tunnel via the backend.  The connection is used by the
+// returned stream; it's not subject to RequestTimeout.
+func handleConnect(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	call flat.Connect,
+) ([]byte, *stream) {
+	b := flatbuffers.NewBuilder(0)
+
+	if local.connectTargets == nil {
+		return buildErrorResponse(b, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+
+	backend := local.backends[string(call.Backend())]
+	if backend == nil {
+		return buildErrorResponse(b, http.StatusBadRequest, "unknown backend"), nil
+	}
+
+	target, ok := parseConnectTarget(string(call.Target()))
+	if !ok {
+		return buildErrorResponse(b, http.StatusBadRequest, "invalid target"), nil
+	}
+	if _, ok := local.connectTargets[target]; !ok {
+		return buildErrorResponse(b, http.StatusForbidden, "target not allowed"), nil
+	}
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+
+	if errRes := authorizeRequest(b, local, req); errRes != nil {
+		return errRes, nil
+	}
+
+	applyServiceHeaders(local, req)
+
+	if local.dryRun {
+		return buildDryRunResponse(b, req, 0), nil
+	}
+
+	if local.limiter != nil {
+		if err := local.limiter.take(ctx); err != nil {
+			return buildTransportErrorResponse(ctx, b, err), nil
+		}
+	}
+
+	if err := takeBudget(ctx); err != nil {
+		return buildTransportErrorResponse(ctx, b, err), nil
+	}
+
+	start := time.Now()
+
+	if backend.breaker != nil && !backend.breaker.allow(start) {
+		return buildErrorResponse(b, http.StatusServiceUnavailable, "backend unavailable"), nil
+	}
+
+	conn, r, res, err := connect(ctx, backend, req)
+	if backend.breaker != nil {
+		backend.breaker.done(time.Now(), err, false)
+	}
+	if err != nil {
+		local.observeError(ctx, req, time.Since(start), err)
+		return buildTransportErrorResponse(ctx, b, err), nil
+	}
+	local.observeResponse(ctx, req, res.StatusCode, time.Since(start), -1)
+
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return buildErrorKindResponse(b, uint16(res.StatusCode), flat.ErrorKindBackendError, "connect failed"), nil
+	}
+
+	s := &stream{
+		id:     streams.newID(),
+		body:   conn,
+		events: true,
+		start:  start,
+		socket: &tunnel{
+			ctx:     ctx,
+			streams: streams,
+			conn:    conn,
+			r:       r,
+		},
+	}
+
+	statusText := b.CreateString(responseStatusText(res))
+
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, uint16(res.StatusCode))
+	flat.ResponseAddStatusText(b, statusText)
+	flat.ResponseAddTtfbMs(b, milliseconds(time.Since(start)))
+	flat.ResponseAddBodyStreamId(b, s.id)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes(), s
+}
+
+// connect sends a CONNECT request to the backend.  The returned reader
+// contains data received after the response header.
+func connect(ctx context.Context, backend *backend, req *http.Request,
+) (conn net.Conn, r *bufio.Reader, res *http.Response, err error) {
+	conn, err = backend.dial(ctx)
+	if err != nil {
+		return
+	}
+
+	// Interrupt the handshake if the context is canceled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	if err = req.Write(conn); err == nil {
+		r = bufio.NewReader(conn)
+		if res, err = http.ReadResponse(r, req); err == nil {
+			res.Body.Close() // Successful response has no body.
+		}
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return
+}
+
+// tunnel is a raw connection used by a stream.
+type tunnel struct {
+	ctx     context.Context // The connection is closed when done.
+	streams *streams
+	conn    net.Conn
+	r       io.Reader // Buffered conn.
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	queue   [][]byte // To be written.
+	closing bool     // Program has closed its side.
+	ending  bool     // Writer exits when the queue is empty.
+}
+
+// run until the backend closes its side of the connection.  Data received
+// from the backend is sent to the program, and vice versa.
+func (tu *tunnel) run(config packet.Service, id int32, chunkSize int, c chan<- handled) {
+	tu.cond.L = &tu.mu
+	tu.streams.registerSocket(id, tu)
+	defer tu.streams.unregisterSocket(id, tu)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		tu.write(config.Code, id, c)
+	}()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-tu.ctx.Done():
+			tu.conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	c <- handled{res: packet.Buf(packet.MakeFlow(config.Code, id, uploadWindow))}
+
+	err := tu.read(config.Code, id, chunkSize, c)
+
+	tu.mu.Lock()
+	tu.ending = true
+	if err != nil {
+		tu.queue = nil
+	}
+	tu.cond.Signal()
+	tu.mu.Unlock()
+
+	<-written
+}
+
+// read from the backend until EOF or an error.  A chunk is handed over after
+// the previous one has been sent.
+func (tu *tunnel) read(code packet.Code, id int32, chunkSize int, c chan<- handled) error {
+	var sent chan struct{} // Of the previous chunk.
+
+	for {
+		p := packet.MakeData(code, id, chunkSize)
+		n, err := tu.r.Read(p.Data())
+		if n > 0 {
+			if sent != nil {
+				select {
+				case <-sent:
+				case <-tu.ctx.Done():
+					return tu.ctx.Err()
+				}
+			}
+
+			sent = make(chan struct{})
+			c <- handled{res: packet.Buf(p[:packet.DataHeaderSize+n]), sent: sent}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write queued data to the backend.  Flow is granted to the program after its
+// data has been written.  The write side of the connection is closed after
+// the program has closed its side.
+func (tu *tunnel) write(code packet.Code, id int32, c chan<- handled) {
+	for {
+		tu.mu.Lock()
+		for len(tu.queue) == 0 && !tu.closing && !tu.ending {
+			tu.cond.Wait()
+		}
+		if len(tu.queue) == 0 {
+			closing := tu.closing && !tu.ending
+			tu.mu.Unlock()
+
+			if closing {
+				if cw, ok := tu.conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+			}
+			return
+		}
+		data := tu.queue[0]
+		tu.queue = tu.queue[1:]
+		tu.mu.Unlock()
+
+		if _, err := tu.conn.Write(data); err != nil {
+			tu.conn.Close() // Interrupt reader.
+			return
+		}
+
+		c <- handled{res: packet.Buf(packet.MakeFlow(code, id, int32(len(data))))}
+	}
+}
+
+// receive data from the program.  An empty packet closes the program's side.
+func (tu *tunnel) receive(p packet.DataBuf) {
+	tu.mu.Lock()
+	defer tu.mu.Unlock()
+
+	if tu.closing || tu.ending {
+		return
+	}
+	if p.DataLen() == 0 {
+		tu.closing = true
+	} else {
+		tu.queue = append(tu.queue, p.Data())
+	}
+	tu.cond.Signal()
+}
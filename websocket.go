@@ -0,0 +1,442 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localhost
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"gate.computer/gate/packet"
+	"gate.computer/localhost/flat"
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Data packet notes of WebSocket streams.  The low bits are the opcode.
+const (
+	frameNote    = 0x100 // Data packet is a frame.
+	frameNoteFin = 0x080 // Final fragment of a message.
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const maxControlPayload = 125
+
+var (
+	errInvalidFrame     = errors.New("localhost: invalid websocket frame")
+	errInvalidHandshake = errors.New("localhost: invalid websocket handshake")
+)
+
+// Handshake headers which are controlled by the service.
+var websocketHeaders = []string{
+	"Sec-WebSocket-Accept",
+	"Sec-WebSocket-Extensions",
+	"Sec-WebSocket-Key",
+	"Sec-WebSocket-Version",
+}
+
+// handleWebSocket performs the opening handshake.  The connection is used by
+// the returned stream; it's not subject to RequestTimeout.
+func handleWebSocket(ctx context.Context, local *Localhost, config packet.Service, streams *streams,
+	jar *cookieJar, call flat.WebSocket,
+) ([]byte, *stream) {
+	b := flatbuffers.NewBuilder(0)
+
+	req := http.Request{
+		Method: http.MethodGet,
+	}
+	if _, ok := local.methods[req.Method]; !ok {
+		return buildErrorResponse(b, http.StatusMethodNotAllowed, "method not allowed"), nil
+	}
+
+	backend, errRes := resolveTarget(b, local, &req, call.Backend(), call.Uri())
+	if errRes != nil {
+		return errRes, nil
+	}
+
+	if local.maxReqHeaders > 0 && call.HeadersLength() > local.maxReqHeaders {
+		return buildErrorResponse(b, http.StatusBadRequest, "too many headers"), nil
+	}
+	header, ok := requestHeader(&call)
+	if !ok {
+		return buildErrorResponse(b, http.StatusBadRequest, "invalid header"), nil
+	}
+	for _, key := range websocketHeaders {
+		header.Del(key)
+	}
+	req.Header = header
+	if errRes := authorizeRequest(b, local, &req); errRes != nil {
+		return errRes, nil
+	}
+	applyServiceHeaders(local, &req)
+
+	if local.dryRun {
+		return buildDryRunResponse(b, &req, 0), nil
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return buildErrorResponse(b, http.StatusInternalServerError, "random source failed"), nil
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	client := backend.redirectClient(0, false)
+	if jar != nil {
+		client.Jar = jar
+	}
+
+	if local.limiter != nil {
+		if err := local.limiter.take(ctx); err != nil {
+			return buildTransportErrorResponse(ctx, b, err), nil
+		}
+	}
+
+	start := time.Now()
+
+	if backend.breaker != nil && !backend.breaker.allow(start) {
+		return buildErrorResponse(b, http.StatusServiceUnavailable, "backend unavailable"), nil
+	}
+
+	res, err := local.do(ctx, client, req.WithContext(ctx))
+	if backend.breaker != nil {
+		backend.breaker.done(time.Now(), err, false)
+	}
+	if err != nil {
+		local.observeError(ctx, &req, time.Since(start), err)
+		return buildTransportErrorResponse(ctx, b, err), nil
+	}
+	ttfb := milliseconds(time.Since(start))
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body.Close()
+		local.observeResponse(ctx, &req, res.StatusCode, time.Since(start), -1)
+		return buildErrorKindResponse(b, uint16(res.StatusCode), flat.ErrorKindBackendError, "websocket handshake failed"), nil
+	}
+
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok || res.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) || res.Header.Get("Sec-WebSocket-Extensions") != "" {
+		res.Body.Close()
+		local.observeError(ctx, &req, time.Since(start), errInvalidHandshake)
+		return buildErrorResponse(b, http.StatusBadGateway, "invalid websocket handshake"), nil
+	}
+	local.observeResponse(ctx, &req, res.StatusCode, time.Since(start), -1)
+
+	s := &stream{
+		id:     streams.newID(),
+		body:   conn,
+		events: true,
+		start:  start,
+		socket: &socket{
+			ctx:     ctx,
+			streams: streams,
+			conn:    conn,
+		},
+	}
+
+	head := buildResponseHead(b, local, &req, res, ttfb)
+
+	flat.ResponseStart(b)
+	flat.ResponseAddStatusCode(b, uint16(res.StatusCode))
+	head.add(b)
+	flat.ResponseAddBodyStreamId(b, s.id)
+	b.Finish(flat.ResponseEnd(b))
+	return b.FinishedBytes(), s
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type frame struct {
+	op      byte
+	fin     bool
+	payload []byte
+}
+
+// socket is a WebSocket connection used by a stream.
+type socket struct {
+	ctx     context.Context // The connection is closed when done.
+	streams *streams
+	conn    io.ReadWriteCloser
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	queue   []frame // To be written.
+	closing bool    // Close frame has been queued.
+	ending  bool    // Writer exits when the queue is empty.
+}
+
+// run until the connection is closed.  Frames received from the backend are
+// sent to the program as data packets, and frames received from the program
+// are written to the backend.
+func (so *socket) run(config packet.Service, id int32, chunkSize int, c chan<- handled) {
+	so.cond.L = &so.mu
+	so.streams.registerSocket(id, so)
+	defer so.streams.unregisterSocket(id, so)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		so.write(config.Code, id, c)
+	}()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-so.ctx.Done():
+			so.conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	c <- handled{res: packet.Buf(packet.MakeFlow(config.Code, id, uploadWindow))}
+
+	err := so.read(config.Code, id, chunkSize, c)
+
+	so.mu.Lock()
+	so.ending = true
+	if err != nil {
+		so.queue = nil
+	}
+	so.cond.Signal()
+	so.mu.Unlock()
+
+	<-written
+}
+
+// read frames from the backend until a close frame or an error.
+func (so *socket) read(code packet.Code, id int32, chunkSize int, c chan<- handled) error {
+	r := bufio.NewReader(so.conn)
+
+	for {
+		fin, op, length, err := readFrameHeader(r)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opContinuation, opText, opBinary:
+			// Large frames are split into fragments.
+			for {
+				n := length
+				if n > int64(chunkSize) {
+					n = int64(chunkSize)
+				}
+				length -= n
+
+				p := packet.MakeData(code, id, int(n))
+				if _, err := io.ReadFull(r, p.Data()); err != nil {
+					return err
+				}
+				note := frameNote | int32(op)
+				if fin && length == 0 {
+					note |= frameNoteFin
+				}
+				p.SetNote(note)
+				c <- handled{res: packet.Buf(p)}
+
+				if length == 0 {
+					break
+				}
+				op = opContinuation
+			}
+
+		case opClose, opPing, opPong:
+			if !fin || length > maxControlPayload {
+				return errInvalidFrame
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+
+			if op == opPing {
+				so.enqueue(frame{opPong, true, payload})
+				continue
+			}
+
+			p := packet.MakeData(code, id, len(payload))
+			copy(p.Data(), payload)
+			p.SetNote(frameNote | frameNoteFin | int32(op))
+			c <- handled{res: packet.Buf(p)}
+
+			if op == opClose {
+				if len(payload) > 2 {
+					payload = payload[:2] // Echo status code.
+				}
+				so.enqueue(frame{opClose, true, payload})
+				return nil
+			}
+
+		default:
+			return errInvalidFrame
+		}
+	}
+}
+
+// write queued frames to the backend.  Flow is granted to the program after
+// its frame has been written.
+func (so *socket) write(code packet.Code, id int32, c chan<- handled) {
+	for {
+		so.mu.Lock()
+		for len(so.queue) == 0 && !so.ending {
+			so.cond.Wait()
+		}
+		if len(so.queue) == 0 {
+			so.mu.Unlock()
+			return
+		}
+		f := so.queue[0]
+		so.queue = so.queue[1:]
+		so.mu.Unlock()
+
+		if err := writeFrame(so.conn, f); err != nil {
+			so.conn.Close() // Interrupt reader.
+			return
+		}
+
+		if n := len(f.payload); n > 0 {
+			c <- handled{res: packet.Buf(packet.MakeFlow(code, id, int32(n)))}
+		}
+	}
+}
+
+// receive a frame from the program.  An empty packet without note is
+// interpreted as a close frame.  Invalid frames are discarded.
+func (so *socket) receive(p packet.DataBuf) {
+	var f frame
+
+	if note := p.Note(); note == 0 && p.DataLen() == 0 {
+		f = frame{opClose, true, nil}
+	} else {
+		if note&^(frameNote|frameNoteFin|0xf) != 0 || note&frameNote == 0 {
+			return
+		}
+		f = frame{byte(note & 0xf), note&frameNoteFin != 0, p.Data()}
+
+		switch f.op {
+		case opContinuation, opText, opBinary:
+		case opClose, opPing, opPong:
+			if !f.fin || len(f.payload) > maxControlPayload {
+				return
+			}
+		default:
+			return
+		}
+	}
+
+	so.enqueue(f)
+}
+
+// enqueue a frame unless a close frame has already been queued.
+func (so *socket) enqueue(f frame) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	if so.closing || so.ending {
+		return
+	}
+	if f.op == opClose {
+		so.closing = true
+	}
+	so.queue = append(so.queue, f)
+	so.cond.Signal()
+}
+
+// readFrameHeader of an unmasked frame without extensions.
+func readFrameHeader(r io.Reader) (fin bool, op byte, length int64, err error) {
+	var h [8]byte
+
+	if _, err = io.ReadFull(r, h[:2]); err != nil {
+		return
+	}
+	if h[0]&0x70 != 0 || h[1]&0x80 != 0 {
+		err = errInvalidFrame
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = h[0] & 0xf
+
+	switch n := h[1] & 0x7f; n {
+	case 126:
+		if _, err = io.ReadFull(r, h[:2]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(h[:2]))
+
+	case 127:
+		if _, err = io.ReadFull(r, h[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(h[:]))
+		if length < 0 {
+			err = errInvalidFrame
+		}
+
+	default:
+		length = int64(n)
+	}
+	return
+}
+
+// writeFrame with a random mask.
+func writeFrame(w io.Writer, f frame) error {
+	buf := make([]byte, 2, 14+len(f.payload))
+
+	buf[0] = f.op
+	if f.fin {
+		buf[0] |= 0x80
+	}
+
+	switch n := len(f.payload); {
+	case n <= maxControlPayload:
+		buf[1] = 0x80 | byte(n)
+
+	case n <= 0xffff:
+		buf[1] = 0x80 | 126
+		buf = buf[:4]
+		binary.BigEndian.PutUint16(buf[2:], uint16(n))
+
+	default:
+		buf[1] = 0x80 | 127
+		buf = buf[:10]
+		binary.BigEndian.PutUint64(buf[2:], uint64(n))
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+	for i, x := range f.payload {
+		buf = append(buf, x^mask[i&3])
+	}
+
+	_, err := w.Write(buf)
+	return err
+}